@@ -40,6 +40,32 @@ func (b aabb) hit(r *ray, tMin float64, tMax float64) bool {
 	return true
 }
 
+// hitInv is hit for a ray whose inverse direction has already been computed,
+// which saves the divisions when testing many boxes against the same ray
+func (b *aabb) hitInv(origin Point3, invDir Vec3, tMin float64, tMax float64) bool {
+	for a := 0; a < 3; a++ {
+		t0 := (b.minimum[a] - origin[a]) * invDir[a]
+		t1 := (b.maximum[a] - origin[a]) * invDir[a]
+
+		if invDir[a] < 0.0 {
+			t0, t1 = t1, t0
+		}
+
+		if t0 > tMin {
+			tMin = t0
+		}
+
+		if t1 < tMax {
+			tMax = t1
+		}
+
+		if tMax <= tMin {
+			return false
+		}
+	}
+	return true
+}
+
 func surroundingBox(box0 aabb, box1 aabb) aabb {
 	small := Point3{
 		math.Min(box0.minimum.X(), box1.minimum.X()),
@@ -55,3 +81,14 @@ func surroundingBox(box0 aabb, box1 aabb) aabb {
 
 	return aabb{small, big}
 }
+
+// surfaceArea of the box, used to estimate how likely rays are to hit it
+func (b aabb) surfaceArea() float64 {
+	d := b.maximum.Sub(b.minimum)
+	return 2 * (d.X()*d.Y() + d.Y()*d.Z() + d.Z()*d.X())
+}
+
+// centroid is the center of the box
+func (b aabb) centroid() Point3 {
+	return b.minimum.Add(b.maximum).Mult(0.5)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Time steps between keyframes used to bound the motion of an animatedTransform
+const animatedBoxSteps = 16
+
+// keyframe is where an animated object is at one point in time: it's scaled,
+// then rotated, then translated
+type keyframe struct {
+	time        float64
+	translation Vec3
+	rotation    Quat
+	scale       Vec3
+}
+
+// animatedTransform moves any object through keyframes. Between two of them
+// translation and scale are interpolated linearly and rotation with a slerp;
+// before the first and after the last one the object stays still. Rays are
+// moved into the object's space at their own time, which blurs the object
+// over the camera's shutter.
+type animatedTransform struct {
+	obj  hittable
+	keys []keyframe
+
+	// Set when every keyframe is the same, so the object can be sampled as a light
+	static *transform
+}
+
+func newAnimatedTransform(obj hittable, keys []keyframe) (*animatedTransform, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("animated transform needs at least one keyframe")
+	}
+	for i, k := range keys {
+		if i > 0 && k.time <= keys[i-1].time {
+			return nil, fmt.Errorf("keyframe %d is not after the one before it", i)
+		}
+		if k.scale[0] == 0 || k.scale[1] == 0 || k.scale[2] == 0 {
+			return nil, fmt.Errorf("keyframe %d has a zero scale", i)
+		}
+	}
+
+	a := animatedTransform{obj: obj, keys: keys}
+	static := true
+	for _, k := range keys[1:] {
+		static = static && k.translation == keys[0].translation && k.rotation == keys[0].rotation && k.scale == keys[0].scale
+	}
+	if static {
+		t, err := newTransform(obj, keys[0].matrix())
+		if err != nil {
+			return nil, err
+		}
+		a.static = t
+	}
+	return &a, nil
+}
+
+// at interpolates the keyframes at time
+func (a *animatedTransform) at(time float64) keyframe {
+	if time <= a.keys[0].time {
+		return a.keys[0]
+	}
+	last := len(a.keys) - 1
+	if time >= a.keys[last].time {
+		return a.keys[last]
+	}
+
+	i := 1
+	for a.keys[i].time < time {
+		i++
+	}
+	k0, k1 := a.keys[i-1], a.keys[i]
+	t := (time - k0.time) / (k1.time - k0.time)
+	return keyframe{
+		time:        time,
+		translation: Lerp(k0.translation, k1.translation, t),
+		rotation:    Slerp(k0.rotation, k1.rotation, t),
+		scale:       Lerp(k0.scale, k1.scale, t),
+	}
+}
+
+func (k keyframe) toWorld(p Point3) Point3 {
+	return k.rotation.Rotate(p.MultEach(k.scale)).Add(k.translation)
+}
+
+func (k keyframe) toObject(p Point3) Point3 {
+	return k.vectorToObject(p.Sub(k.translation))
+}
+
+func (k keyframe) vectorToObject(v Vec3) Vec3 {
+	v = k.rotation.Conjugate().Rotate(v)
+	return Vec3{v[0] / k.scale[0], v[1] / k.scale[1], v[2] / k.scale[2]}
+}
+
+func (a *animatedTransform) hit(r *ray, tMin float64, tMax float64, rnd sampler) (*hitRecord, bool) {
+	k := a.at(r.time)
+	objectRay := ray{k.toObject(r.origin), k.vectorToObject(r.direction), r.time}
+
+	rec, hit := a.obj.hit(&objectRay, tMin, tMax, rnd)
+	if !hit {
+		return nil, false
+	}
+
+	rec.p = k.toWorld(rec.p)
+	// The inverse transpose of rotation * scale is rotation / scale
+	n := rec.normal
+	rec.normal = k.rotation.Rotate(Vec3{n[0] / k.scale[0], n[1] / k.scale[1], n[2] / k.scale[2]}).Normalize()
+
+	return rec, true
+}
+
+// boundingBox bounds the whole motion between time0 and time1. The object's
+// box is placed at a number of steps in between (and at every keyframe), and
+// each one is padded by how far any of its points can move before the next.
+func (a *animatedTransform) boundingBox(time0 float64, time1 float64) (aabb, bool) {
+	box, ok := a.obj.boundingBox(time0, time1)
+	if !ok {
+		return aabb{}, false
+	}
+
+	// Largest distance of any point of the box from the origin, on each axis
+	var extent Vec3
+	for axis := 0; axis < 3; axis++ {
+		extent[axis] = math.Max(math.Abs(box.minimum[axis]), math.Abs(box.maximum[axis]))
+	}
+
+	// Motion is smooth between keyframes, break the interval there
+	times := []float64{time0}
+	for _, k := range a.keys {
+		if k.time > time0 && k.time < time1 {
+			times = append(times, k.time)
+		}
+	}
+	times = append(times, time1)
+
+	prev := a.at(time0)
+	out := transformBox(prev.matrix(), box)
+	for i := 1; i < len(times); i++ {
+		for step := 1; step <= animatedBoxSteps; step++ {
+			k := a.at(times[i-1] + (times[i]-times[i-1])*float64(step)/animatedBoxSteps)
+
+			// In between, a point moves at most by the translation, plus its
+			// change of scale, plus the arc it rotates along
+			moved := k.translation.Sub(prev.translation).Length() +
+				extent.MultEach(k.scale.Sub(prev.scale)).Length() +
+				prev.rotation.Angle(k.rotation)*extent.MultEach(prev.scale).Length()
+			pad := Vec3{moved, moved, moved}
+
+			prevBox := transformBox(prev.matrix(), box)
+			out = surroundingBox(out, aabb{prevBox.minimum.Sub(pad), prevBox.maximum.Add(pad)})
+			out = surroundingBox(out, transformBox(k.matrix(), box))
+			prev = k
+		}
+	}
+	return out, true
+}
+
+// matrix is the transform of k as one Mat4
+func (k keyframe) matrix() Mat4 {
+	return Translate4(k.translation).Mul(k.rotation.Mat4()).Mul(Scale4(k.scale))
+}
+
+// Like movingSphere, an animated object can only be sampled while it stays still
+func (a *animatedTransform) pdfValue(o Point3, v Vec3) float64 {
+	if a.static == nil {
+		return 0
+	}
+	return a.static.pdfValue(o, v)
+}
+
+// A moving one gets a direction with pdfValue 0, which mixturePdf weighs away
+func (a *animatedTransform) random(o Vec3, rnd sampler) Vec3 {
+	if a.static == nil {
+		return RandomUnitVector(rnd)
+	}
+	return a.static.random(o, rnd)
+}
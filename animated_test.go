@@ -0,0 +1,56 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// Interpolating a rotation and a translation must give the rotation and
+// translation part way along, as a matrix and point by point
+func TestAnimatedTransformInterpolation(t *testing.T) {
+	axis := Vec3{1, 2, -1}
+	a, err := newAnimatedTransform(&sphere{Point3{0, 0, 0}, 1, nil}, []keyframe{
+		{0, Vec3{0, 0, 0}, QuatAxisAngle(axis, 0), Vec3{1, 1, 1}},
+		{2, Vec3{2, -4, 6}, QuatAxisAngle(axis, 120), Vec3{1, 1, 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rnd := newStream(1)
+	for _, s := range []float64{0, 0.25, 0.5, 1} {
+		k := a.at(2 * s)
+		want := Translate4(Vec3{2, -4, 6}.Mult(s)).Mul(RotateAxis4(axis, 120*s))
+		if got := k.matrix(); !mat4Near(got, want, 1e-12) {
+			t.Errorf("at %v the matrix is %v, want %v", 2*s, got, want)
+		}
+		for i := 0; i < 10; i++ {
+			p := RandomRangeVec3(-10, 10, rnd)
+			if d := k.toWorld(p).Sub(want.MulPoint(p)).Length(); d > 1e-9 {
+				t.Errorf("at %v %v goes to %v, want %v", 2*s, p, k.toWorld(p), want.MulPoint(p))
+			}
+			if d := k.toObject(k.toWorld(p)).Sub(p).Length(); d > 1e-9 {
+				t.Errorf("at %v %v comes back as %v", 2*s, p, k.toObject(k.toWorld(p)))
+			}
+		}
+	}
+}
+
+// A moving light can't be sampled, but asking it for a direction must not crash
+func TestAnimatedTransformMovingLight(t *testing.T) {
+	a, err := newAnimatedTransform(&sphere{Point3{0, 0, 0}, 1, nil}, []keyframe{
+		{0, Vec3{0, 0, 0}, QuatAxisAngle(Vec3{0, 1, 0}, 0), Vec3{1, 1, 1}},
+		{1, Vec3{0, 2, 0}, QuatAxisAngle(Vec3{0, 1, 0}, 0), Vec3{1, 1, 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := Point3{0, 0, 5}
+	v := a.random(o, newStream(1))
+	if math.Abs(v.Length()-1) > 1e-9 {
+		t.Errorf("random gave %v, want a unit vector", v)
+	}
+	if p := a.pdfValue(o, v); p != 0 {
+		t.Errorf("pdfValue is %v, want 0", p)
+	}
+}
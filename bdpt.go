@@ -0,0 +1,429 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+)
+
+// splatFilm collects light integrators find for pixels other than the one
+// being sampled, like light paths that reach the camera. Any worker can add
+// to any pixel, so the sums are kept in fixed point: they come out the same
+// whatever order the light is added in.
+type splatFilm struct {
+	width, height int
+	pixels        [][3]int64
+}
+
+// splatScale is how many fixed point units make 1
+const splatScale = 1 << 32
+
+func newSplatFilm(width int, height int) *splatFilm {
+	return &splatFilm{width, height, make([][3]int64, width*height)}
+}
+
+// pixel is the pixel sendRays samples at s, t of the camera
+func (f *splatFilm) pixel(s float64, t float64) (x int, y int, ok bool) {
+	x = int(math.Floor(s * float64(f.width-1)))
+	y = int(math.Floor(t * float64(f.height-1)))
+	return x, y, x >= 0 && x < f.width && y >= 0 && y < f.height
+}
+
+// add adds c to the pixel at s, t of the camera
+func (f *splatFilm) add(s float64, t float64, c Color3) {
+	x, y, ok := f.pixel(s, t)
+	if !ok {
+		return
+	}
+	for i := range c {
+		atomic.AddInt64(&f.pixels[y*f.width+x][i], int64(math.Round(c[i]*splatScale)))
+	}
+}
+
+func (f *splatFilm) at(x int, y int) Color3 {
+	p := &f.pixels[y*f.width+x]
+	return Color3{float64(p[0]) / splatScale, float64(p[1]) / splatScale, float64(p[2]) / splatScale}
+}
+
+type vertexKind int
+
+const (
+	cameraVertex vertexKind = iota
+	lightVertex
+	surfaceVertex
+)
+
+// bdptVertex is one vertex of a camera or light subpath
+type bdptVertex struct {
+	kind   vertexKind
+	p      Point3
+	normal Vec3 //zero on the camera and in media
+	rec    *hitRecord
+	rayIn  ray            //the ray that reached a surface vertex
+	sRec   *scatterRecord //nil if the material doesn't scatter
+	beta   Color3         //light (or importance) carried by the subpath up to here over its pdf
+	delta  bool           //specular, can't be connected to
+	// Density of the vertex being sampled by its own subpath (pdfFwd) and
+	// by the other one (pdfRev), per unit area
+	pdfFwd, pdfRev float64
+}
+
+// connectible tells if another vertex can be joined to this one with a
+// straight line: cameras, lights and surfaces that scatter diffusely can
+func (v *bdptVertex) connectible() bool {
+	return v.kind != surfaceVertex || v.sRec != nil && !v.delta
+}
+
+// cosine is |cos| of the angle between d and the normal, 1 where there is none
+func (v *bdptVertex) cosine(d Vec3) float64 {
+	if v.normal == (Vec3{}) {
+		return 1
+	}
+	return math.Abs(v.normal.Dot(d.Normalize()))
+}
+
+// toArea turns the density per solid angle of going from v to next into a
+// density per unit area at next
+func (v *bdptVertex) toArea(pdf float64, next *bdptVertex) float64 {
+	d := next.p.Sub(v.p)
+	distanceSquared := d.LengthSquared()
+	if distanceSquared == 0 {
+		return 0
+	}
+	return pdf * next.cosine(d) / distanceSquared
+}
+
+// f is how much of the light arriving along rayIn the surface scatters
+// towards dir, with the cosine at the surface (what scatteringPdf weights)
+func (v *bdptVertex) f(dir Vec3) Color3 {
+	if v.sRec == nil || v.delta {
+		return Color3{0, 0, 0}
+	}
+	scattered := ray{v.p, dir, v.rayIn.time}
+	return v.sRec.attenuation.Mult(v.rec.mat.scatteringPdf(&v.rayIn, v.rec, &scattered))
+}
+
+// emitPdf is the density per solid angle of a light emitting in direction d,
+// from either side of a surface with the given normal
+func emitPdf(normal Vec3, d Vec3) float64 {
+	return 0.5 * math.Abs(normal.Dot(d.Normalize())) / math.Pi
+}
+
+// emitDirection picks the direction light leaves a surface with the given
+// normal, and its emitPdf
+func emitDirection(normal Vec3, rnd sampler) (Vec3, float64) {
+	side := normal
+	if RandomDouble(rnd) < 0.5 {
+		side = side.Mult(-1)
+	}
+	dir := buildFromW(side).local(RandomCosineDirection(rnd))
+	return dir, emitPdf(normal, dir)
+}
+
+// bdptIntegrator is a bidirectional path tracer. Every sample traces a
+// subpath from the camera and another one from a point on the lights, and
+// joins every vertex of one to every vertex of the other. Each way of making
+// a path (how many vertices come from the lights) is good at different
+// light: subpaths from the lights find caustics that paths from the camera
+// only reach by chance. They are weighted with the power heuristic.
+//
+// Joining light subpaths straight to the camera lands on any pixel, that
+// light is added to the splat film. Only emitters are sampled, the scene's
+// lights list and important objects are not used.
+type bdptIntegrator struct {
+	*renderScene
+	emitters *lightSurfaces
+	filmArea float64 //area of the film one unit from the lens
+}
+
+func newBdptIntegrator(scene *renderScene) (integrator, error) {
+	emitters, err := newLightSurfaces(scene.world)
+	if err != nil {
+		return nil, fmt.Errorf("bdpt: %v", err)
+	}
+	// sendRays samples pixel x at s in [x, x+1) / (width-1), so the film is
+	// a pixel wider and taller than the viewport
+	w, h := float64(scene.opts.imageWidth), float64(scene.opts.imageHeight)
+	return &bdptIntegrator{scene, emitters, scene.cam.viewportArea() * w / (w - 1) * h / (h - 1)}, nil
+}
+
+func (in *bdptIntegrator) onFilm(s float64, t float64) bool {
+	_, _, ok := in.splats.pixel(s, t)
+	return ok
+}
+
+// cameraPdf is the density per solid angle of the camera shooting a ray from
+// lensPoint in direction dir, 0 outside the image
+func (in *bdptIntegrator) cameraPdf(lensPoint Point3, dir Vec3) float64 {
+	s, t, ok := in.cam.project(lensPoint, lensPoint.Add(dir))
+	if !ok || !in.onFilm(s, t) {
+		return 0
+	}
+	cosine := -dir.Normalize().Dot(in.cam.w)
+	return 1 / (in.filmArea * cosine * cosine * cosine)
+}
+
+// pdf is the density per unit area at next of v sampling the direction to it
+func (in *bdptIntegrator) pdf(v *bdptVertex, next *bdptVertex) float64 {
+	dir := next.p.Sub(v.p)
+	pdf := 0.0
+	switch {
+	case v.kind == cameraVertex:
+		pdf = in.cameraPdf(v.p, dir)
+	case v.kind == lightVertex:
+		pdf = emitPdf(v.normal, dir)
+	case v.connectible():
+		pdf = v.sRec.pdf.value(dir)
+	}
+	return v.toArea(pdf, next)
+}
+
+func (in *bdptIntegrator) rayColor(r *ray, rnd sampler) Color3 {
+	camPath, escaped := in.randomWalk([]bdptVertex{{kind: cameraVertex, p: r.origin, beta: Color3{1, 1, 1}}},
+		*r, Color3{1, 1, 1}, in.cameraPdf(r.origin, r.direction), in.opts.maxDepth+1, rnd)
+	lightPath := in.lightSubpath(r.time, rnd)
+
+	// Only camera paths find the background
+	color := escaped.MultEach(in.opts.background)
+
+	for t := 1; t <= len(camPath); t++ {
+		for s := 0; s <= len(lightPath); s++ {
+			// s+t-1 vertices are hits, maxDepth at most like the other integrators
+			if t == 1 && s <= 1 || s+t-1 > in.opts.maxDepth {
+				continue
+			}
+			color = color.Add(in.connect(lightPath, camPath, s, t, r.time, rnd))
+		}
+	}
+	return color
+}
+
+// lightSubpath starts at a point on the lights and walks from there
+func (in *bdptIntegrator) lightSubpath(time float64, rnd sampler) []bdptVertex {
+	p, normal, emitted, ok := in.emitters.sample(time, rnd)
+	if !ok {
+		return nil
+	}
+	pdfPos := in.emitters.pdfArea()
+	path := []bdptVertex{{kind: lightVertex, p: p, normal: normal, beta: emitted.Div(pdfPos), pdfFwd: pdfPos}}
+
+	dir, pdfDir := emitDirection(normal, rnd)
+	if pdfDir <= 0 {
+		return path
+	}
+	beta := emitted.Mult(path[0].cosine(dir) / (pdfPos * pdfDir))
+
+	path, _ = in.randomWalk(path, ray{p, dir, time}, beta, pdfDir, in.opts.maxDepth, rnd)
+	return path
+}
+
+// randomWalk extends path from its last vertex along r, whose direction was
+// sampled with density pdfDir per solid angle, until it has maxVertices
+// vertices or ends. It returns the throughput of the ray that left the scene
+// if it did.
+func (in *bdptIntegrator) randomWalk(path []bdptVertex, r ray, beta Color3, pdfDir float64, maxVertices int, rnd sampler) ([]bdptVertex, Color3) {
+	for len(path) < maxVertices {
+		rec, hit := in.world.hit(&r, 0.001, infinity, rnd)
+		if !hit {
+			return path, beta
+		}
+
+		v := bdptVertex{kind: surfaceVertex, p: rec.p, rec: rec, rayIn: r, beta: beta}
+		if _, medium := rec.mat.(isotropic); !medium {
+			v.normal = rec.normal
+		}
+		v.pdfFwd = path[len(path)-1].toArea(pdfDir, &v)
+
+		sRec, scatter := rec.mat.scatter(&r, rec, rnd)
+		if scatter {
+			v.sRec = sRec
+			v.delta = sRec.isSpecular
+		}
+		path = append(path, v)
+		if !scatter || len(path) == maxVertices {
+			break
+		}
+
+		var next ray
+		pdfRev := 0.0
+		if sRec.isSpecular {
+			next = sRec.specularRay
+			next.time = r.time
+			beta = beta.MultEach(sRec.attenuation)
+			pdfDir = 0
+		} else {
+			next = ray{rec.p, sRec.pdf.generate(rnd), r.time}
+			pdfDir = sRec.pdf.value(next.direction)
+			if pdfDir <= 0 {
+				break
+			}
+			beta = beta.MultEach(sRec.attenuation).Mult(rec.mat.scatteringPdf(&r, rec, &next) / pdfDir)
+			pdfRev = sRec.pdf.value(r.direction.Mult(-1))
+		}
+		n := len(path)
+		path[n-2].pdfRev = path[n-1].toArea(pdfRev, &path[n-2])
+
+		if beta == (Color3{}) {
+			break
+		}
+		r = next
+	}
+	return path, Color3{0, 0, 0}
+}
+
+// connect makes a path out of the first s vertices of the light subpath and
+// the first t of the camera subpath, and returns the light it carries to
+// the pixel. With t == 1 the light subpath is joined to a new point on the
+// lens and may reach any pixel, so it is splatted instead. With s == 1 it
+// starts at a new point on the lights.
+func (in *bdptIntegrator) connect(lightPath []bdptVertex, camPath []bdptVertex, s int, t int, time float64, rnd sampler) Color3 {
+	var color Color3
+	var sampled bdptVertex
+	var splatS, splatT float64
+
+	switch {
+	case s == 0:
+		// The camera subpath hit a light by itself
+		pt := &camPath[t-1]
+		color = pt.beta.MultEach(pt.rec.mat.emitted(&pt.rayIn, pt.rec, pt.rec.u, pt.rec.v, pt.p))
+		if color == (Color3{}) {
+			return color
+		}
+	case t == 1:
+		qs := &lightPath[s-1]
+		if !qs.connectible() {
+			return Color3{0, 0, 0}
+		}
+		sampled = bdptVertex{kind: cameraVertex, p: in.cam.sampleLens(rnd)}
+		var ok bool
+		if splatS, splatT, ok = in.cam.project(sampled.p, qs.p); !ok || !in.onFilm(splatS, splatT) {
+			return Color3{0, 0, 0}
+		}
+		// The camera's importance over the density of picking the lens point
+		d := sampled.p.Sub(qs.p)
+		cosine := d.Normalize().Dot(in.cam.w)
+		importance := 1 / (in.filmArea * cosine * cosine * cosine * d.LengthSquared())
+		color = qs.beta.MultEach(qs.f(d)).Mult(importance)
+		if color == (Color3{}) || !visible(in.world, qs.p, sampled.p, time, rnd) {
+			return Color3{0, 0, 0}
+		}
+	case s == 1:
+		pt := &camPath[t-1]
+		if !pt.connectible() {
+			return Color3{0, 0, 0}
+		}
+		p, normal, emitted, ok := in.emitters.sample(time, rnd)
+		if !ok {
+			return Color3{0, 0, 0}
+		}
+		pdfPos := in.emitters.pdfArea()
+		sampled = bdptVertex{kind: lightVertex, p: p, normal: normal, beta: emitted.Div(pdfPos), pdfFwd: pdfPos}
+		d := p.Sub(pt.p)
+		color = pt.beta.MultEach(pt.f(d)).MultEach(sampled.beta).Mult(sampled.cosine(d) / d.LengthSquared())
+		if color == (Color3{}) || !visible(in.world, pt.p, p, time, rnd) {
+			return Color3{0, 0, 0}
+		}
+	default:
+		qs, pt := &lightPath[s-1], &camPath[t-1]
+		if !qs.connectible() || !pt.connectible() {
+			return Color3{0, 0, 0}
+		}
+		d := pt.p.Sub(qs.p)
+		color = qs.beta.MultEach(qs.f(d)).MultEach(pt.f(d.Mult(-1))).MultEach(pt.beta).Div(d.LengthSquared())
+		if color == (Color3{}) || !visible(in.world, qs.p, pt.p, time, rnd) {
+			return Color3{0, 0, 0}
+		}
+	}
+
+	color = color.Mult(in.misWeight(lightPath, camPath, &sampled, s, t))
+	if t == 1 {
+		in.splats.add(splatS, splatT, color)
+		return Color3{0, 0, 0}
+	}
+	return color
+}
+
+// misWeight is the power heuristic weight of the (s, t) way of making the
+// path against all the other ways of making the same path. The ratios of
+// their densities are built up one vertex at a time from both ends, from the
+// forward and reverse densities of the vertices.
+func (in *bdptIntegrator) misWeight(lightPath []bdptVertex, camPath []bdptVertex, sampled *bdptVertex, s int, t int) float64 {
+	if s+t == 2 {
+		return 1
+	}
+
+	var qs, pt *bdptVertex
+	if s == 1 {
+		qs = sampled
+	} else if s > 1 {
+		qs = &lightPath[s-1]
+	}
+	if t == 1 {
+		pt = sampled
+	} else {
+		pt = &camPath[t-1]
+	}
+
+	// The connection changes the reverse densities of the vertices it joins
+	// and of the ones before them
+	var ptRev, ptMinusRev, qsRev, qsMinusRev float64
+	if s > 0 {
+		ptRev = in.pdf(qs, pt)
+		if t > 1 {
+			ptMinusRev = in.pdf(pt, &camPath[t-2])
+		}
+		qsRev = in.pdf(pt, qs)
+		if s > 1 {
+			qsMinusRev = in.pdf(qs, &lightPath[s-2])
+		}
+	} else {
+		ptRev = in.emitters.pdfArea()
+		ptMinusRev = pt.toArea(emitPdf(pt.normal, camPath[t-2].p.Sub(pt.p)), &camPath[t-2])
+	}
+
+	// Specular vertices have no density, they cancel out
+	remap := func(pdf float64) float64 {
+		if pdf == 0 {
+			return 1
+		}
+		return pdf
+	}
+
+	sumRi := 0.0
+	ri := 1.0
+	for i := t - 1; i > 0; i-- {
+		v := &camPath[i]
+		rev, delta := v.pdfRev, v.delta
+		switch i {
+		case t - 1:
+			rev, delta = ptRev, false
+		case t - 2:
+			rev = ptMinusRev
+		}
+		ri *= remap(rev) / remap(v.pdfFwd)
+		if !delta && !camPath[i-1].delta {
+			sumRi += ri
+		}
+	}
+
+	ri = 1.0
+	for i := s - 1; i >= 0; i-- {
+		v := &lightPath[i]
+		if s == 1 {
+			v = sampled
+		}
+		rev, delta := v.pdfRev, v.delta
+		switch i {
+		case s - 1:
+			rev, delta = qsRev, false
+		case s - 2:
+			rev = qsMinusRev
+		}
+		ri *= remap(rev) / remap(v.pdfFwd)
+		if !delta && (i == 0 || !lightPath[i-1].delta) {
+			sumRi += ri
+		}
+	}
+
+	return 1 / (1 + sumRi)
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Surface Area Heuristic parameters. Costs are relative to intersecting one primitive.
+const (
+	bvhBinCount      = 12
+	bvhMaxLeafSize   = 4
+	bvhTraversalCost = 0.125
+	bvhIntersectCost = 1.0
+)
+
+// bvhNode is either an interior node with two children or a leaf with a few
+// objects (left and right are nil)
+type bvhNode struct {
+	left, right *bvhNode
+	objects     []hittable
+	box         aabb
+	axis        int //Axis the children were split on
+	count       int //Objects in the whole subtree
+}
+
+// bvhPrimitive caches the box of an object while the tree is being built
+type bvhPrimitive struct {
+	obj      hittable
+	box      aabb
+	centroid Point3
+}
+
+// Subtrees with fewer primitives than bvhParallelBuildSize are built on the
+// goroutine that reached them, and bounds are only computed in chunks of
+// bvhParallelChunkSize
+const (
+	bvhParallelBuildSize = 4096
+	bvhParallelChunkSize = 32768
+)
+
+// newBvhNode builds a tree over list with a binned SAH: every split is put
+// where the estimated cost of tracing a ray through the children is lowest.
+// Large subtrees are built in parallel. The build is deterministic, and list
+// is left untouched.
+func newBvhNode(list []hittable, time0 float64, time1 float64) *bvhNode {
+	return newBvhNodeParallel(list, time0, time1, true)
+}
+
+// newBvhNodeParallel is newBvhNode with the parallel build optional. Both
+// builds give the same tree.
+func newBvhNodeParallel(list []hittable, time0 float64, time1 float64, parallel bool) *bvhNode {
+	if len(list) == 0 {
+		panic("No objects in bvhnode constructor")
+	}
+
+	prims := make([]bvhPrimitive, len(list))
+	missing := make([]bool, chunkCount(len(list)))
+	parallelChunks(len(list), parallel, func(chunk int, start int, end int) {
+		for i := start; i < end; i++ {
+			box, exists := list[i].boundingBox(time0, time1)
+			if !exists {
+				missing[chunk] = true
+				return
+			}
+			prims[i] = bvhPrimitive{list[i], box, box.centroid()}
+		}
+	})
+	// Panic here rather than in a goroutine, so callers can still recover
+	for _, m := range missing {
+		if m {
+			panic("No bounding box in bvhnode constructor")
+		}
+	}
+
+	return buildBvh(prims, parallel)
+}
+
+func chunkCount(n int) int {
+	return (n + bvhParallelChunkSize - 1) / bvhParallelChunkSize
+}
+
+// parallelChunks calls f for every chunk of [0, n), each chunk on its own
+// goroutine when parallel is set
+func parallelChunks(n int, parallel bool, f func(chunk int, start int, end int)) {
+	count := chunkCount(n)
+	if !parallel || count == 1 {
+		for c := 0; c < count; c++ {
+			end := (c + 1) * bvhParallelChunkSize
+			if end > n {
+				end = n
+			}
+			f(c, c*bvhParallelChunkSize, end)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	for c := 0; c < count; c++ {
+		end := (c + 1) * bvhParallelChunkSize
+		if end > n {
+			end = n
+		}
+		wg.Add(1)
+		go func(c int, start int, end int) {
+			defer wg.Done()
+			f(c, start, end)
+		}(c, c*bvhParallelChunkSize, end)
+	}
+	wg.Wait()
+}
+
+func newBvhLeaf(prims []bvhPrimitive, box aabb) *bvhNode {
+	leaf := bvhNode{box: box, objects: make([]hittable, len(prims)), count: len(prims)}
+	for i, p := range prims {
+		leaf.objects[i] = p.obj
+	}
+	return &leaf
+}
+
+// primBounds returns the box around all of prims and the box around their centroids
+func primBounds(prims []bvhPrimitive, parallel bool) (aabb, aabb) {
+	boxes := make([]aabb, chunkCount(len(prims)))
+	centroids := make([]aabb, len(boxes))
+	parallelChunks(len(prims), parallel, func(chunk int, start int, end int) {
+		box := prims[start].box
+		c := aabb{prims[start].centroid, prims[start].centroid}
+		for _, p := range prims[start+1 : end] {
+			box = surroundingBox(box, p.box)
+			c = surroundingBox(c, aabb{p.centroid, p.centroid})
+		}
+		boxes[chunk], centroids[chunk] = box, c
+	})
+
+	// Min and max don't depend on the order, so this matches a serial loop exactly
+	box, c := boxes[0], centroids[0]
+	for i := 1; i < len(boxes); i++ {
+		box = surroundingBox(box, boxes[i])
+		c = surroundingBox(c, centroids[i])
+	}
+	return box, c
+}
+
+func buildBvh(prims []bvhPrimitive, parallel bool) *bvhNode {
+	box, centroids := primBounds(prims, parallel)
+
+	if len(prims) == 1 {
+		return newBvhLeaf(prims, box)
+	}
+
+	axis, splitBin, cost, ok := bestSplit(prims, box, centroids)
+	leafCost := bvhIntersectCost * float64(len(prims))
+	if len(prims) <= bvhMaxLeafSize && (!ok || cost >= leafCost) {
+		return newBvhLeaf(prims, box)
+	}
+
+	mid := 0
+	if ok {
+		mid = partitionPrims(prims, func(p bvhPrimitive) bool {
+			return binIndex(p.centroid, centroids, axis) <= splitBin
+		})
+	} else {
+		// Every centroid is in the same spot, no split is better than another
+		mid = len(prims) / 2
+	}
+
+	node := bvhNode{box: box, axis: axis, count: len(prims)}
+	if parallel && len(prims) >= bvhParallelBuildSize {
+		// The children use disjoint parts of prims, so they can be built at the same time
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			node.left = buildBvh(prims[:mid], parallel)
+		}()
+		node.right = buildBvh(prims[mid:], parallel)
+		wg.Wait()
+	} else {
+		node.left = buildBvh(prims[:mid], parallel)
+		node.right = buildBvh(prims[mid:], parallel)
+	}
+	return &node
+}
+
+func binIndex(c Point3, centroids aabb, axis int) int {
+	extent := centroids.maximum[axis] - centroids.minimum[axis]
+	b := int(bvhBinCount * (c[axis] - centroids.minimum[axis]) / extent)
+	if b >= bvhBinCount {
+		b = bvhBinCount - 1
+	}
+	return b
+}
+
+// bestSplit finds the axis and bin boundary with the lowest SAH cost.
+// Objects in bins up to splitBin go to the left child.
+func bestSplit(prims []bvhPrimitive, box aabb, centroids aabb) (axis int, splitBin int, cost float64, ok bool) {
+	type bin struct {
+		box   aabb
+		count int
+	}
+
+	area := box.surfaceArea()
+	if area <= 0 {
+		area = 1
+	}
+
+	for a := 0; a < 3; a++ {
+		if centroids.maximum[a] <= centroids.minimum[a] {
+			continue
+		}
+
+		var bins [bvhBinCount]bin
+		for _, p := range prims {
+			b := &bins[binIndex(p.centroid, centroids, a)]
+			if b.count == 0 {
+				b.box = p.box
+			} else {
+				b.box = surroundingBox(b.box, p.box)
+			}
+			b.count++
+		}
+
+		// Sweep from the right, remembering the cost of everything right of each boundary
+		var rightCost [bvhBinCount]float64
+		var rightBox aabb
+		rightCount := 0
+		for i := bvhBinCount - 1; i > 0; i-- {
+			if bins[i].count > 0 {
+				if rightCount == 0 {
+					rightBox = bins[i].box
+				} else {
+					rightBox = surroundingBox(rightBox, bins[i].box)
+				}
+				rightCount += bins[i].count
+			}
+			rightCost[i-1] = float64(rightCount) * rightBox.surfaceArea()
+			if rightCount == 0 {
+				rightCost[i-1] = -1
+			}
+		}
+
+		var leftBox aabb
+		leftCount := 0
+		for i := 0; i < bvhBinCount-1; i++ {
+			if bins[i].count > 0 {
+				if leftCount == 0 {
+					leftBox = bins[i].box
+				} else {
+					leftBox = surroundingBox(leftBox, bins[i].box)
+				}
+				leftCount += bins[i].count
+			}
+			if leftCount == 0 || rightCost[i] < 0 {
+				continue
+			}
+
+			c := bvhTraversalCost + bvhIntersectCost*(float64(leftCount)*leftBox.surfaceArea()+rightCost[i])/area
+			if !ok || c < cost {
+				axis, splitBin, cost, ok = a, i, c, true
+			}
+		}
+	}
+
+	return axis, splitBin, cost, ok
+}
+
+// partitionPrims moves the primitives for which left is true to the front
+// and returns how many there are
+func partitionPrims(prims []bvhPrimitive, left func(p bvhPrimitive) bool) int {
+	mid := 0
+	for i := range prims {
+		if left(prims[i]) {
+			prims[i], prims[mid] = prims[mid], prims[i]
+			mid++
+		}
+	}
+	return mid
+}
+
+func (bvh *bvhNode) hit(r *ray, tMin float64, tMax float64, rnd sampler) (*hitRecord, bool) {
+	if !bvh.box.hit(r, tMin, tMax) {
+		return nil, false
+	}
+
+	if bvh.left == nil {
+		var result *hitRecord
+		for _, obj := range bvh.objects {
+			if rec, hit := obj.hit(r, tMin, tMax, rnd); hit {
+				result = rec
+				tMax = rec.t
+			}
+		}
+		return result, result != nil
+	}
+
+	var result *hitRecord
+	rec, hitLeft := bvh.left.hit(r, tMin, tMax, rnd)
+	if hitLeft {
+		result = rec
+		tMax = rec.t
+	}
+
+	rec, hitRight := bvh.right.hit(r, tMin, tMax, rnd)
+	if hitRight {
+		result = rec
+	}
+
+	return result, hitLeft || hitRight
+
+}
+
+func (bvh *bvhNode) boundingBox(time0 float64, time1 float64) (aabb, bool) {
+	return bvh.box, true
+}
+
+// pdfValue is that of picking one of the objects uniformly and sampling it,
+// like hittableList, but only objects whose boxes are along v are asked
+func (bvh *bvhNode) pdfValue(o Point3, v Vec3) float64 {
+	return bvh.pdfSum(&ray{o, v, 0}) / float64(bvh.count)
+}
+
+func (bvh *bvhNode) pdfSum(r *ray) float64 {
+	if !bvh.box.hit(r, 0.001, infinity) {
+		return 0
+	}
+	if bvh.left == nil {
+		sum := 0.0
+		for _, obj := range bvh.objects {
+			sum += obj.pdfValue(r.origin, r.direction)
+		}
+		return sum
+	}
+	return bvh.left.pdfSum(r) + bvh.right.pdfSum(r)
+}
+
+func (bvh *bvhNode) random(o Vec3, rnd sampler) Vec3 {
+	node := bvh
+	for node.left != nil {
+		// Going down with odds proportional to the object counts is a uniform pick
+		if randomInt(rnd, node.count) < node.left.count {
+			node = node.left
+		} else {
+			node = node.right
+		}
+	}
+	return node.objects[randomInt(rnd, len(node.objects))].random(o, rnd)
+}
+
+// bvhStats describes the quality of a tree
+type bvhStats struct {
+	nodes, leaves, primitives int
+	maxDepth                  int
+	sahCost                   float64 //Expected cost of tracing a ray through the tree
+}
+
+func (s bvhStats) String() string {
+	return fmt.Sprintf("%d nodes, %d leaves, %d primitives (%.2f per leaf), depth %d, SAH cost %.2f",
+		s.nodes, s.leaves, s.primitives, float64(s.primitives)/float64(s.leaves), s.maxDepth, s.sahCost)
+}
+
+func (bvh *bvhNode) stats() bvhStats {
+	var s bvhStats
+	rootArea := bvh.box.surfaceArea()
+	if rootArea <= 0 {
+		rootArea = 1
+	}
+
+	var walk func(node *bvhNode, depth int)
+	var walkLinear func(bvh *linearBvh, i int, depth int)
+
+	visit := func(obj hittable, p float64, depth int) {
+		// Nested trees (e.g. meshes) count as part of this one
+		switch nested := obj.(type) {
+		case *bvhNode:
+			walk(nested, depth)
+		case *linearBvh:
+			walkLinear(nested, 0, depth)
+		case *triangleMesh:
+			walkLinear(nested.bvh, 0, depth)
+		default:
+			s.primitives++
+			s.sahCost += p * bvhIntersectCost
+		}
+	}
+
+	walk = func(node *bvhNode, depth int) {
+		s.nodes++
+		if depth > s.maxDepth {
+			s.maxDepth = depth
+		}
+		// Probability of a ray through the root also going through this node
+		p := node.box.surfaceArea() / rootArea
+
+		if node.left == nil {
+			s.leaves++
+			for _, obj := range node.objects {
+				visit(obj, p, depth+1)
+			}
+			return
+		}
+		s.sahCost += p * bvhTraversalCost
+		walk(node.left, depth+1)
+		walk(node.right, depth+1)
+	}
+
+	walkLinear = func(bvh *linearBvh, i int, depth int) {
+		node := &bvh.nodes[i]
+		s.nodes++
+		if depth > s.maxDepth {
+			s.maxDepth = depth
+		}
+		p := node.box.surfaceArea() / rootArea
+
+		if node.count > 0 {
+			s.leaves++
+			for _, obj := range bvh.objects[node.offset : node.offset+node.count] {
+				visit(obj, p, depth+1)
+			}
+			return
+		}
+		s.sahCost += p * bvhTraversalCost
+		walkLinear(bvh, i+1, depth+1)
+		walkLinear(bvh, int(node.offset), depth+1)
+	}
+
+	walk(bvh, 1)
+
+	return s
+}
+
+// linearBvhNode is a bvhNode in a flat array. An interior node's first child
+// comes right after it and offset is the index of the second one; a leaf
+// holds objects[offset:offset+count].
+type linearBvhNode struct {
+	box    aabb
+	offset int32
+	count  int32
+	axis   int32
+}
+
+// linearBvh is a bvhNode tree flattened in depth first order, which keeps
+// nodes close together in memory and lets hit walk it with a small stack
+// instead of recursive calls
+type linearBvh struct {
+	nodes   []linearBvhNode
+	objects []hittable
+}
+
+func newLinearBvh(root *bvhNode) *linearBvh {
+	var bvh linearBvh
+
+	var flatten func(node *bvhNode) int
+	flatten = func(node *bvhNode) int {
+		i := len(bvh.nodes)
+		bvh.nodes = append(bvh.nodes, linearBvhNode{box: node.box, axis: int32(node.axis)})
+
+		if node.left == nil {
+			bvh.nodes[i].offset = int32(len(bvh.objects))
+			bvh.nodes[i].count = int32(len(node.objects))
+			bvh.objects = append(bvh.objects, node.objects...)
+			return i
+		}
+
+		flatten(node.left)
+		bvh.nodes[i].offset = int32(flatten(node.right))
+		return i
+	}
+	flatten(root)
+
+	return &bvh
+}
+
+func (bvh *linearBvh) hit(r *ray, tMin float64, tMax float64, rnd sampler) (*hitRecord, bool) {
+	invDir := Vec3{1 / r.direction[0], 1 / r.direction[1], 1 / r.direction[2]}
+	dirIsNeg := [3]bool{invDir[0] < 0, invDir[1] < 0, invDir[2] < 0}
+
+	var result *hitRecord
+	stack := make([]int32, 0, 64)
+	current := int32(0)
+
+	for {
+		node := &bvh.nodes[current]
+		if node.box.hitInv(r.origin, invDir, tMin, tMax) {
+			if node.count > 0 {
+				for _, obj := range bvh.objects[node.offset : node.offset+node.count] {
+					if rec, hit := obj.hit(r, tMin, tMax, rnd); hit {
+						result = rec
+						tMax = rec.t
+					}
+				}
+			} else {
+				// Visit the child nearer to the ray origin first, so hits
+				// found there cut the search in the other one short
+				if dirIsNeg[node.axis] {
+					stack = append(stack, current+1)
+					current = node.offset
+				} else {
+					stack = append(stack, node.offset)
+					current = current + 1
+				}
+				continue
+			}
+		}
+
+		if len(stack) == 0 {
+			break
+		}
+		current = stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+	}
+
+	return result, result != nil
+}
+
+func (bvh *linearBvh) boundingBox(time0 float64, time1 float64) (aabb, bool) {
+	return bvh.nodes[0].box, true
+}
+
+// pdfValue works like bvhNode.pdfValue
+func (bvh *linearBvh) pdfValue(o Point3, v Vec3) float64 {
+	r := ray{o, v, 0}
+	invDir := Vec3{1 / v[0], 1 / v[1], 1 / v[2]}
+
+	sum := 0.0
+	stack := make([]int32, 0, 64)
+	stack = append(stack, 0)
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		node := &bvh.nodes[current]
+
+		if !node.box.hitInv(r.origin, invDir, 0.001, infinity) {
+			continue
+		}
+		if node.count > 0 {
+			for _, obj := range bvh.objects[node.offset : node.offset+node.count] {
+				sum += obj.pdfValue(o, v)
+			}
+		} else {
+			stack = append(stack, current+1, node.offset)
+		}
+	}
+	return sum / float64(len(bvh.objects))
+}
+
+func (bvh *linearBvh) random(o Vec3, rnd sampler) Vec3 {
+	return bvh.objects[randomInt(rnd, len(bvh.objects))].random(o, rnd)
+}
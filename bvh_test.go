@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+// sceneRays builds scene s and makes count rays for it. Half of the rays come
+// from the camera, the other half bounce off what those hit in random
+// directions, like the incoherent rays of a path tracer.
+func sceneRays(s sceneInfo, count int) (*bvhNode, []ray) {
+	world := s.build(s.cam.time0, s.cam.time1, newStream(1, sceneStream))
+	tree, ok := world.(*bvhNode)
+	if !ok {
+		return nil, nil
+	}
+	c := s.cam.build(s.opts.aspectRatio)
+	rnd := newStream(2)
+
+	rays := make([]ray, 0, count)
+	for len(rays) < count {
+		r := c.getRay(RandomDouble(rnd), RandomDouble(rnd), rnd)
+		rays = append(rays, *r)
+		if rec, hit := tree.hit(r, 0.001, infinity, rnd); hit {
+			rays = append(rays, ray{rec.p, rec.normal.Add(RandomUnitVector(rnd)), r.time})
+		}
+	}
+	return tree, rays
+}
+
+// triangleSoup is a mesh of count small triangles scattered in a box
+func triangleSoup(count int) *triangleMesh {
+	rnd := newStream(1)
+	positions := make([]Point3, 3*count)
+	indices := make([]int, 3*count)
+	for i := 0; i < count; i++ {
+		center := RandomRangeVec3(-100, 100, rnd)
+		for v := 0; v < 3; v++ {
+			positions[3*i+v] = center.Add(RandomRangeVec3(-1, 1, rnd))
+			indices[3*i+v] = 3*i + v
+		}
+	}
+	mesh, err := newTriangleMesh(positions, nil, nil, indices, lambertian{})
+	if err != nil {
+		panic(err)
+	}
+	return mesh
+}
+
+func isMedium(rec *hitRecord) bool {
+	_, ok := rec.mat.(isotropic)
+	return ok
+}
+
+func TestLinearBvhMatchesTree(t *testing.T) {
+	for _, s := range scenes {
+		tree, rays := sceneRays(s, 2000)
+		if tree == nil {
+			continue
+		}
+		linear := newLinearBvh(tree)
+		rnd := newStream(3)
+		for i := range rays {
+			want, wantHit := tree.hit(&rays[i], 0.001, infinity, rnd)
+			got, gotHit := linear.hit(&rays[i], 0.001, infinity, rnd)
+			// Media are hit at random distances, those can't be compared
+			if wantHit && isMedium(want) || gotHit && isMedium(got) {
+				continue
+			}
+			if gotHit != wantHit {
+				t.Errorf("%s: ray %d hit %v, want %v", s.name, i, gotHit, wantHit)
+				continue
+			}
+			if gotHit && got.t != want.t {
+				t.Errorf("%s: ray %d hit at t = %v, want %v", s.name, i, got.t, want.t)
+			}
+		}
+	}
+}
+
+// The parallel build must give the tree the serial one does however many
+// threads it gets, so renders are the same on every machine. The soups are
+// big enough to split into subtrees built on their own, and the bigger one
+// into more than one chunk of bounding boxes and partitions.
+func TestParallelBvhMatchesSerial(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	for _, count := range []int{2 * bvhParallelBuildSize, 2*bvhParallelChunkSize + 100} {
+		mesh := triangleSoup(count)
+		serial := newLinearBvh(newBvhNodeParallel(mesh.triangles, 0, 1, false))
+		for _, workers := range []int{1, 2, 3, 8} {
+			runtime.GOMAXPROCS(workers)
+			parallel := newLinearBvh(newBvhNodeParallel(mesh.triangles, 0, 1, true))
+			if len(parallel.nodes) != len(serial.nodes) || len(parallel.objects) != len(serial.objects) {
+				t.Errorf("%d triangles, %d workers: %d nodes and %d objects, want %d and %d", count, workers,
+					len(parallel.nodes), len(parallel.objects), len(serial.nodes), len(serial.objects))
+				continue
+			}
+			for i := range serial.nodes {
+				if parallel.nodes[i] != serial.nodes[i] {
+					t.Errorf("%d triangles, %d workers: node %d is %v, want %v", count, workers, i, parallel.nodes[i], serial.nodes[i])
+					break
+				}
+			}
+			for i := range serial.objects {
+				if parallel.objects[i] != serial.objects[i] {
+					t.Errorf("%d triangles, %d workers: object %d is different", count, workers, i)
+					break
+				}
+			}
+		}
+	}
+}
+
+func benchmarkHit(b *testing.B, accel func(tree *bvhNode) hittable) {
+	for _, s := range scenes {
+		tree, rays := sceneRays(s, 10000)
+		if tree == nil {
+			continue
+		}
+		world := accel(tree)
+		rnd := newStream(3)
+		b.Run(s.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				world.hit(&rays[i%len(rays)], 0.001, infinity, rnd)
+			}
+		})
+	}
+}
+
+func BenchmarkBvhNodeHit(b *testing.B) {
+	benchmarkHit(b, func(tree *bvhNode) hittable { return tree })
+}
+
+func BenchmarkLinearBvhHit(b *testing.B) {
+	benchmarkHit(b, func(tree *bvhNode) hittable { return newLinearBvh(tree) })
+}
+
+func BenchmarkBvhBuild(b *testing.B) {
+	for _, count := range []int{1000, 20000} {
+		mesh := triangleSoup(count)
+		for _, parallel := range []bool{false, true} {
+			b.Run(fmt.Sprintf("triangles=%d/parallel=%v", count, parallel), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					newBvhNodeParallel(mesh.triangles, 0, 1, parallel)
+				}
+			})
+		}
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"math"
-	"math/rand"
 )
 
 type camera struct {
@@ -15,6 +14,21 @@ type camera struct {
 	time0, time1    float64
 }
 
+// cameraSettings holds everything needed to build a camera, so scenes and the
+// command line can describe one before the image aspect ratio is known
+type cameraSettings struct {
+	lookFrom, lookAt Point3
+	up               Vec3
+	vfov             float64 //in degrees
+	aperture         float64
+	focusDist        float64
+	time0, time1     float64
+}
+
+func (s cameraSettings) build(aspectRatio float64) camera {
+	return initCamera(s.lookFrom, s.lookAt, s.up, s.vfov, aspectRatio, s.aperture, s.focusDist, s.time0, s.time1)
+}
+
 //vfov in degrees
 func initCamera(lookFrom Point3, lookAt Point3, up Vec3, vfov float64, aspectRatio float64, aperture float64, focusDist float64, t0 float64, t1 float64) (c camera) {
 	theta := DegToRad(vfov)
@@ -39,10 +53,43 @@ func initCamera(lookFrom Point3, lookAt Point3, up Vec3, vfov float64, aspectRat
 	return c
 }
 
-func (c camera) getRay(s float64, t float64, rnd *rand.Rand) *ray {
+func (c camera) getRay(s float64, t float64, rnd sampler) *ray {
+
+	lensPoint := c.sampleLens(rnd)
+
+	return &ray{lensPoint, c.lowerLeftCorner.Add(c.horizontal.Mult(s)).Add(c.vertical.Mult(t)).Sub(lensPoint), RandomDoubleRange(c.time0, c.time1, rnd)}
+}
 
+// sampleLens picks a point on the lens, where rays start
+func (c camera) sampleLens(rnd sampler) Point3 {
 	rd := RandomInUnitDisk(rnd).Mult(c.lensRadius)
 	offset := (c.u.Mult(rd.X())).Add(c.v.Mult(rd.Y()))
+	return c.origin.Add(offset)
+}
+
+// focusDist is how far the plane in focus is from the lens
+func (c camera) focusDist() float64 {
+	return c.origin.Sub(c.lowerLeftCorner).Dot(c.w)
+}
+
+// project is the inverse of getRay: it returns the s and t of the ray from
+// lensPoint through p, or false if p is behind the camera
+func (c camera) project(lensPoint Point3, p Point3) (s float64, t float64, ok bool) {
+	d := p.Sub(lensPoint)
+	depth := -d.Dot(c.w)
+	if depth <= 0 {
+		return 0, 0, false
+	}
+	// Where the ray crosses the plane in focus, which getRay aims at
+	focus := lensPoint.Add(d.Mult(c.focusDist() / depth)).Sub(c.lowerLeftCorner)
+	s = focus.Dot(c.horizontal) / c.horizontal.LengthSquared()
+	t = focus.Dot(c.vertical) / c.vertical.LengthSquared()
+	return s, t, true
+}
 
-	return &ray{c.origin.Add(offset), c.lowerLeftCorner.Add(c.horizontal.Mult(s)).Add(c.vertical.Mult(t)).Sub(c.origin).Sub(offset), RandomDoubleRange(c.time0, c.time1, rnd)}
+// viewportArea is the area of the s, t in [0, 1] viewport one unit away from
+// the lens
+func (c camera) viewportArea() float64 {
+	focusDist := c.focusDist()
+	return c.horizontal.Length() * c.vertical.Length() / (focusDist * focusDist)
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+)
+
+// A checkpoint file holds everything a progressive render has accumulated
+// after some number of samples per pixel, so it can go on from there:
+//
+//	checkpointHeader
+//	film sums of every pixel's own samples, 3 float64 per pixel
+//	film sums of squared luminance, 1 float64 per pixel
+//	film sample counts, 1 int64 per pixel
+//	filtered film sums, 3 fixed per pixel (int64 whole part, uint64 fraction)
+//	filtered film weights, 1 fixed per pixel
+//	splat film sums, 3 int64 per pixel
+//
+// all little endian. The seed and the number of samples are all the random
+// state there is, every sample has its own stream made from them.
+type checkpointHeader struct {
+	Magic         [4]byte
+	Version       uint32
+	Hash          uint64 //renderHash of the render it was saved from
+	Seed          int64
+	Samples       int64 //samples per pixel taken by the passes that finished
+	Width, Height int64
+}
+
+var checkpointMagic = [4]byte{'R', 'T', 'C', 'K'}
+
+const checkpointVersion = 4
+
+// renderHash identifies what a render draws: the scene, its options except
+// how many samples to take, the camera, the seed and where adaptive sampling
+// stops. A render can only go on from a checkpoint with the same hash.
+// Scene files count with every mesh and image they were built from, built-in
+// scenes only by name: changing one's Go code doesn't stop a resume.
+func renderHash(cfg *config) (uint64, error) {
+	h := fnv.New64a()
+	opts := cfg.opts
+	opts.samplesPerPixel = 0
+	fmt.Fprintf(h, "%#v\n%#v\n%d\n%#v\n", opts, cfg.cam, cfg.seed, cfg.adaptive)
+	if cfg.sceneFile == "" {
+		fmt.Fprintf(h, "scene %s\n", cfg.scene.name)
+		return h.Sum64(), nil
+	}
+	for _, path := range append([]string{cfg.sceneFile}, cfg.scene.files...) {
+		if err := hashFile(h, path); err != nil {
+			return 0, err
+		}
+	}
+	return h.Sum64(), nil
+}
+
+// hashFile writes the contents of a file to h, and their length to tell
+// where they end. The path is left out, so the files can move.
+func hashFile(h io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := io.Copy(h, f)
+	fmt.Fprintf(h, "\n%d bytes\n", n)
+	return err
+}
+
+// readCheckpointHeader reads the header of a checkpoint file, ok is false
+// if there is no file
+func readCheckpointHeader(path string) (header checkpointHeader, ok bool, err error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return header, false, nil
+	}
+	if err != nil {
+		return header, false, err
+	}
+	defer f.Close()
+	if err := readHeader(f, &header, path); err != nil {
+		return header, false, err
+	}
+	return header, true, nil
+}
+
+func readHeader(r io.Reader, header *checkpointHeader, path string) error {
+	if err := binary.Read(r, binary.LittleEndian, header); err != nil {
+		return fmt.Errorf("%s: not a checkpoint: %v", path, err)
+	}
+	if header.Magic != checkpointMagic {
+		return fmt.Errorf("%s: not a checkpoint", path)
+	}
+	if header.Version != checkpointVersion {
+		return fmt.Errorf("%s: checkpoint version %d, expected %d", path, header.Version, checkpointVersion)
+	}
+	return nil
+}
+
+// saveCheckpoint writes what pixels and splats hold after samples samples
+// per pixel
+func saveCheckpoint(path string, hash uint64, seed int64, samples int, pixels *film, splats *splatFilm) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		header := checkpointHeader{checkpointMagic, checkpointVersion, hash, seed, int64(samples), int64(pixels.width), int64(pixels.height)}
+		for _, data := range []interface{}{header, pixels.pixels, pixels.sumSquares, int64s(pixels.samples), pixels.filtered, pixels.weights, splats.pixels} {
+			if err := binary.Write(bw, binary.LittleEndian, data); err != nil {
+				return err
+			}
+		}
+		return bw.Flush()
+	})
+}
+
+// loadCheckpoint fills pixels and splats from a checkpoint saved by a render
+// with the given hash, and returns the samples per pixel it had taken
+func loadCheckpoint(path string, hash uint64, pixels *film, splats *splatFilm) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	var header checkpointHeader
+	if err := readHeader(r, &header, path); err != nil {
+		return 0, err
+	}
+	if header.Hash != hash {
+		return 0, fmt.Errorf("%s: the scene, its options or the camera changed since the checkpoint was saved", path)
+	}
+	if header.Width != int64(pixels.width) || header.Height != int64(pixels.height) {
+		return 0, fmt.Errorf("%s: checkpoint is %dx%d, the image is %dx%d", path, header.Width, header.Height, pixels.width, pixels.height)
+	}
+
+	samples := make([]int64, len(pixels.samples))
+	for _, data := range []interface{}{pixels.pixels, pixels.sumSquares, samples, pixels.filtered, pixels.weights, splats.pixels} {
+		if err := binary.Read(r, binary.LittleEndian, data); err != nil {
+			return 0, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	for i, n := range samples {
+		pixels.samples[i] = int(n)
+	}
+	return int(header.Samples), nil
+}
+
+func int64s(xs []int) []int64 {
+	out := make([]int64, len(xs))
+	for i, x := range xs {
+		out[i] = int64(x)
+	}
+	return out
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRenderHash(t *testing.T) {
+	base := func() config {
+		s, _ := findScene("cornellBox")
+		return config{opts: s.opts, cam: s.cam, scene: s, seed: 1, adaptive: adaptiveSampling{0.01, 16}}
+	}
+	hash := func(cfg config) uint64 {
+		h, err := renderHash(&cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	want := hash(base())
+
+	tests := []struct {
+		name    string
+		change  func(cfg *config)
+		changes bool //if the render can't go on from the checkpoint
+	}{
+		{"more samples", func(cfg *config) { cfg.opts.samplesPerPixel *= 2 }, false},
+		{"seed", func(cfg *config) { cfg.seed = 2 }, true},
+		{"depth", func(cfg *config) { cfg.opts.maxDepth++ }, true},
+		{"camera", func(cfg *config) { cfg.cam.vfov++ }, true},
+		{"adaptive threshold", func(cfg *config) { cfg.adaptive.threshold = 0.02 }, true},
+		{"adaptive min samples", func(cfg *config) { cfg.adaptive.minSamples = 32 }, true},
+		{"scene", func(cfg *config) { cfg.scene, _ = findScene("cornellSmoke") }, true},
+	}
+	for _, test := range tests {
+		cfg := base()
+		test.change(&cfg)
+		if changed := hash(cfg) != want; changed != test.changes {
+			t.Errorf("%s: hash changed %v, want %v", test.name, changed, test.changes)
+		}
+	}
+}
+
+// A scene file's render changes with the meshes and materials it loads, not
+// only with the file itself
+func TestRenderHashSceneFile(t *testing.T) {
+	files := map[string]string{
+		"scene.json":       `{"objects": [{"type": "obj", "file": "models/model.obj"}]}`,
+		"models/model.obj": "mtllib model.mtl\nv 0 0 0\nv 1 0 0\nv 0 1 0\nusemtl red\nf 1 2 3\n",
+		"models/model.mtl": "newmtl red\nKd 1 0 0\n",
+	}
+	hash := func(dir string) uint64 {
+		path := filepath.Join(dir, "scene.json")
+		scene, err := loadSceneFile(path, newStream(1, sceneStream))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := renderHash(&config{scene: scene, sceneFile: path, opts: scene.opts, cam: scene.cam, seed: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	want := hash(writeFiles(t, files))
+
+	if got := hash(writeFiles(t, files)); got != want {
+		t.Errorf("the same scene in another directory hashes to %x, want %x", got, want)
+	}
+	for name, content := range map[string]string{
+		"models/model.obj": "mtllib model.mtl\nv 0 0 0\nv 2 0 0\nv 0 1 0\nusemtl red\nf 1 2 3\n",
+		"models/model.mtl": "newmtl red\nKd 0 1 0\n",
+	} {
+		dir := writeFiles(t, files)
+		if err := os.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if hash(dir) == want {
+			t.Errorf("changing %s doesn't change the hash", name)
+		}
+	}
+}
+
+// A checkpoint loads back into the film and splats it was saved from
+func TestCheckpointRoundTrip(t *testing.T) {
+	pixels := newFilm(5, 4, newPixelFilter("gaussian", 0))
+	fillFilm(pixels, 2, func(x float64, y float64) Color3 { return Color3{x, -y, 1e-9 * x * y} })
+	splats := newSplatFilm(5, 4)
+	splats.add(0.5, 0.25, Color3{1, 2, 3})
+
+	path := filepath.Join(t.TempDir(), "render.ck")
+	if err := saveCheckpoint(path, 42, 7, 4, pixels, splats); err != nil {
+		t.Fatal(err)
+	}
+	loadedPixels := newFilm(5, 4, newPixelFilter("gaussian", 0))
+	loadedSplats := newSplatFilm(5, 4)
+	samples, err := loadCheckpoint(path, 42, loadedPixels, loadedSplats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if samples != 4 {
+		t.Errorf("loaded %d samples per pixel, want 4", samples)
+	}
+	saved := func(f *film, s *splatFilm) string {
+		return fmt.Sprint(f.pixels, f.sumSquares, f.samples, f.filtered, f.weights, s.pixels)
+	}
+	if got, want := saved(loadedPixels, loadedSplats), saved(pixels, splats); got != want {
+		t.Errorf("loaded %s, want %s", got, want)
+	}
+
+	if _, err := loadCheckpoint(path, 43, loadedPixels, loadedSplats); err == nil {
+		t.Error("loaded a checkpoint of another render")
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config is everything a render needs, built from the selected scene's
+// defaults with the command line flags applied on top
+type config struct {
+	scene      sceneInfo
+	sceneFile  string //the file scene was loaded from, if any
+	opts       options
+	cam        cameraSettings
+	outputFile string
+	exr        exrFormat
+	seed       int64
+	threads    int
+	tileSize   int
+	listScenes bool
+	bvhStats   bool
+	accel      string
+
+	// Progressive rendering
+	progressive bool
+	timeLimit   time.Duration //0 for none
+	saveEvery   time.Duration //0 to save after every pass
+	checkpoint  string        //file to save the render to after every pass
+	resume      bool          //go on from checkpoint if it exists
+
+	// Adaptive sampling
+	adaptive    adaptiveSampling
+	heatmapFile string //where to save the samples every pixel got, if anywhere
+}
+
+// vec3Flag parses "r,g,b" style values
+type vec3Flag struct {
+	v *Vec3
+}
+
+func (f *vec3Flag) String() string {
+	if f.v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%g,%g,%g", f.v[0], f.v[1], f.v[2])
+}
+
+func (f *vec3Flag) Set(s string) error {
+	parts := strings.Split(s, ",")
+	if len(parts) != 3 {
+		return errors.New("expected three comma separated numbers")
+	}
+	for i, p := range parts {
+		x, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return err
+		}
+		f.v[i] = x
+	}
+	return nil
+}
+
+// parseAspectRatio accepts "16:9", "16/9" or a plain number
+func parseAspectRatio(s string) (float64, error) {
+	for _, sep := range []string{":", "/"} {
+		if parts := strings.SplitN(s, sep, 2); len(parts) == 2 {
+			w, err := strconv.ParseFloat(parts[0], 64)
+			if err != nil {
+				return 0, err
+			}
+			h, err := strconv.ParseFloat(parts[1], 64)
+			if err != nil {
+				return 0, err
+			}
+			if w <= 0 || h <= 0 {
+				return 0, errors.New("aspect ratio must be positive")
+			}
+			return w / h, nil
+		}
+	}
+	r, err := strconv.ParseFloat(s, 64)
+	if err == nil && r <= 0 {
+		err = errors.New("aspect ratio must be positive")
+	}
+	return r, err
+}
+
+func parseFlags(args []string, output io.Writer) (config, error) {
+	var cfg config
+
+	fs := flag.NewFlagSet("RTinOneWeekend", flag.ContinueOnError)
+	fs.SetOutput(output)
+
+	sceneName := fs.String("scene", "cornellBox", "name of the scene to render (see -list-scenes)")
+	sceneFile := fs.String("scene-file", "", "render a scene description file instead of a built-in scene")
+	fs.BoolVar(&cfg.listScenes, "list-scenes", false, "list the available scenes and exit")
+	width := fs.Int("width", 0, "image width in pixels (default: scene's)")
+	height := fs.Int("height", 0, "image height in pixels (default: width / aspect)")
+	aspect := fs.String("aspect", "", "aspect ratio, e.g. 16:9 or 1.5 (default: scene's)")
+	spp := fs.Int("spp", 0, "samples per pixel (default: scene's)")
+	maxDepth := fs.Int("depth", 0, "maximum ray bounce depth (default: scene's)")
+	rouletteDepth := fs.Int("roulette-depth", 0, "bounces before russian roulette can end a path, 0 for never (default: scene's)")
+	integratorName := fs.String("integrator", "", "light transport algorithm: "+strings.Join(integratorNames(), " or ")+" (default: scene's)")
+	samplerName := fs.String("sampler", "", "what the samples of a pixel are made of: "+strings.Join(samplerNames(), " or ")+" (default: scene's)")
+	filterName := fs.String("filter", "", "how samples are weighed by the pixels around them: "+strings.Join(filterNames(), " or ")+" (default: scene's)")
+	filterRadius := fs.Float64("filter-radius", 0, "radius of the filter in pixels (default: scene's, or the filter's own)")
+	photons := fs.Int("photons", 0, "photons shot for every photon map of the photon and sppm integrators (default: scene's)")
+	photonRadius := fs.Float64("photon-radius", 0, "radius photons are gathered in, the first one for sppm (default: scene's, or a hundredth of the scene's size)")
+	vfov := fs.Float64("vfov", 0, "vertical field of view in degrees (default: scene's)")
+	aperture := fs.Float64("aperture", 0, "camera aperture (default: scene's)")
+	focusDist := fs.Float64("focus-dist", 0, "camera focus distance (default: scene's)")
+	shutterOpen := fs.Float64("shutter-open", 0, "time the camera shutter opens (default: scene's)")
+	shutterClose := fs.Float64("shutter-close", 0, "time the camera shutter closes (default: scene's)")
+	var background Vec3
+	bgFlag := vec3Flag{v: &background}
+	fs.Var(&bgFlag, "background", "background color as r,g,b (default: scene's)")
+	fs.StringVar(&cfg.outputFile, "o", "images/out.png", "output image file, "+strings.Join(imageFormats, ", ")+" by its extension (.hdr, .pfm and .exr keep the light as it is, unclamped)")
+	exrPixel := fs.String("exr-pixel", "half", "pixel type of .exr files: half or float")
+	exrCompression := fs.String("exr-compression", "zip", "compression of .exr files: zip or none")
+	fs.Float64Var(&cfg.adaptive.threshold, "adaptive", 0, "stop sampling pixels once the error of their brightness is below this, e.g. 0.01 for about 2.5 levels of 255 (0 samples every pixel -spp times)")
+	fs.IntVar(&cfg.adaptive.minSamples, "min-spp", 16, "with -adaptive, samples every pixel gets before it can stop, and how often it is checked")
+	fs.StringVar(&cfg.heatmapFile, "heatmap", "", "also save an image of how many samples every pixel got")
+	fs.BoolVar(&cfg.progressive, "progressive", false, "render in passes of 1, 2, 4, ... samples per pixel and save the image after each")
+	fs.DurationVar(&cfg.timeLimit, "time-limit", 0, "with -progressive, stop after this long, e.g. 5m (0 for no limit)")
+	fs.StringVar(&cfg.checkpoint, "checkpoint", "", "with -progressive, save everything rendered so far to this file after every pass")
+	fs.BoolVar(&cfg.resume, "resume", false, "go on from the -checkpoint file if there is one, with its seed")
+	fs.DurationVar(&cfg.saveEvery, "save-every", 0, "with -progressive, keep passes short enough to save the image about this often, e.g. 30s (0 saves after every pass)")
+	fs.Int64Var(&cfg.seed, "seed", 0, "random seed the scene and the render are made with, the same one gives the same image (0 picks one at random)")
+	fs.IntVar(&cfg.threads, "threads", 0, "number of threads to render with (0 uses every CPU)")
+	fs.IntVar(&cfg.tileSize, "tile-size", 16, "width and height in pixels of the tiles the image is rendered in")
+	fs.BoolVar(&cfg.bvhStats, "bvh-stats", false, "print the quality of the scene's BVH")
+	fs.StringVar(&cfg.accel, "accel", "linear", "acceleration structure: linear (flattened BVH) or tree")
+
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if cfg.listScenes {
+		return cfg, nil
+	}
+	if cfg.accel != "linear" && cfg.accel != "tree" {
+		return cfg, fmt.Errorf("unknown -accel %q, expected linear or tree", cfg.accel)
+	}
+	if !knownImageFormat(cfg.outputFile) {
+		return cfg, fmt.Errorf("unknown image format of -o %q, expected one of %s", cfg.outputFile, strings.Join(imageFormats, ", "))
+	}
+	if *exrPixel != "half" && *exrPixel != "float" {
+		return cfg, fmt.Errorf("unknown -exr-pixel %q, expected half or float", *exrPixel)
+	}
+	if *exrCompression != "zip" && *exrCompression != "none" {
+		return cfg, fmt.Errorf("unknown -exr-compression %q, expected zip or none", *exrCompression)
+	}
+	cfg.exr = exrFormat{*exrPixel == "half", *exrCompression == "zip"}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if cfg.resume {
+		// The scene is made from the seed, it must be the checkpoint's
+		header, ok, err := readCheckpointHeader(cfg.checkpoint)
+		if err != nil {
+			return cfg, err
+		}
+		if ok {
+			if set["seed"] && cfg.seed != header.Seed {
+				return cfg, fmt.Errorf("-seed %d is not the checkpoint's %d", cfg.seed, header.Seed)
+			}
+			cfg.seed = header.Seed
+		}
+	}
+	if cfg.seed == 0 {
+		cfg.seed = rand.Int63()
+	}
+
+	var scene sceneInfo
+	if set["scene-file"] {
+		if set["scene"] {
+			return cfg, errors.New("-scene and -scene-file cannot be used together")
+		}
+		var err error
+		if scene, err = loadSceneFile(*sceneFile, newStream(cfg.seed, sceneStream)); err != nil {
+			return cfg, err
+		}
+		cfg.sceneFile = *sceneFile
+	} else {
+		var ok bool
+		if scene, ok = findScene(*sceneName); !ok {
+			return cfg, fmt.Errorf("unknown scene %q, use -list-scenes to see the available ones", *sceneName)
+		}
+	}
+	cfg.scene = scene
+	cfg.opts = scene.opts
+	cfg.cam = scene.cam
+
+	if set["aspect"] {
+		r, err := parseAspectRatio(*aspect)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid -aspect %q: %v", *aspect, err)
+		}
+		cfg.opts.aspectRatio = r
+	}
+	if set["width"] && *width <= 0 || set["height"] && *height <= 0 {
+		return cfg, errors.New("-width and -height must be positive")
+	}
+
+	switch {
+	case set["width"] && set["height"]:
+		if set["aspect"] {
+			return cfg, errors.New("-aspect cannot be combined with both -width and -height")
+		}
+		cfg.opts.imageWidth = *width
+		cfg.opts.imageHeight = *height
+		cfg.opts.aspectRatio = float64(*width) / float64(*height)
+	case set["height"]:
+		cfg.opts.imageHeight = *height
+		cfg.opts.imageWidth = int(float64(*height) * cfg.opts.aspectRatio)
+	default:
+		if set["width"] {
+			cfg.opts.imageWidth = *width
+		}
+		cfg.opts.imageHeight = int(float64(cfg.opts.imageWidth) / cfg.opts.aspectRatio)
+	}
+	if cfg.opts.imageWidth < 2 || cfg.opts.imageHeight < 2 {
+		return cfg, fmt.Errorf("image size %dx%d is too small", cfg.opts.imageWidth, cfg.opts.imageHeight)
+	}
+
+	if set["spp"] {
+		if *spp <= 0 {
+			return cfg, errors.New("-spp must be positive")
+		}
+		cfg.opts.samplesPerPixel = *spp
+	}
+	if set["depth"] {
+		if *maxDepth <= 0 {
+			return cfg, errors.New("-depth must be positive")
+		}
+		cfg.opts.maxDepth = *maxDepth
+	}
+	if set["roulette-depth"] {
+		if *rouletteDepth < 0 {
+			return cfg, errors.New("-roulette-depth cannot be negative")
+		}
+		cfg.opts.rouletteDepth = *rouletteDepth
+	}
+	if set["integrator"] {
+		if _, ok := integrators[*integratorName]; !ok {
+			return cfg, fmt.Errorf("unknown -integrator %q, expected one of %s", *integratorName, strings.Join(integratorNames(), ", "))
+		}
+		cfg.opts.integrator = *integratorName
+	}
+	if set["sampler"] {
+		if _, ok := samplers[*samplerName]; !ok {
+			return cfg, fmt.Errorf("unknown -sampler %q, expected one of %s", *samplerName, strings.Join(samplerNames(), ", "))
+		}
+		cfg.opts.sampler = *samplerName
+	}
+	if set["filter"] {
+		if _, ok := filters[*filterName]; !ok {
+			return cfg, fmt.Errorf("unknown -filter %q, expected one of %s", *filterName, strings.Join(filterNames(), ", "))
+		}
+		cfg.opts.filter = *filterName
+	}
+	if set["filter-radius"] {
+		if *filterRadius <= 0 {
+			return cfg, errors.New("-filter-radius must be positive")
+		}
+		cfg.opts.filterRadius = *filterRadius
+	}
+	if set["photons"] {
+		if *photons <= 0 {
+			return cfg, errors.New("-photons must be positive")
+		}
+		cfg.opts.photons = *photons
+	}
+	if set["photon-radius"] {
+		if *photonRadius <= 0 {
+			return cfg, errors.New("-photon-radius must be positive")
+		}
+		cfg.opts.photonRadius = *photonRadius
+	}
+	if set["background"] {
+		cfg.opts.background = background
+	}
+	if set["vfov"] {
+		if *vfov <= 0 || *vfov >= 180 {
+			return cfg, errors.New("-vfov must be between 0 and 180 degrees")
+		}
+		cfg.cam.vfov = *vfov
+	}
+	if set["aperture"] {
+		if *aperture < 0 {
+			return cfg, errors.New("-aperture cannot be negative")
+		}
+		cfg.cam.aperture = *aperture
+	}
+	if set["focus-dist"] {
+		if *focusDist <= 0 {
+			return cfg, errors.New("-focus-dist must be positive")
+		}
+		cfg.cam.focusDist = *focusDist
+	}
+	if set["shutter-open"] {
+		cfg.cam.time0 = *shutterOpen
+	}
+	if set["shutter-close"] {
+		cfg.cam.time1 = *shutterClose
+	}
+	if cfg.cam.time1 < cfg.cam.time0 {
+		return cfg, fmt.Errorf("the shutter closes (%g) before it opens (%g)", cfg.cam.time1, cfg.cam.time0)
+	}
+	if cfg.threads < 0 {
+		return cfg, errors.New("-threads cannot be negative")
+	}
+	if cfg.tileSize <= 0 {
+		return cfg, errors.New("-tile-size must be positive")
+	}
+	if cfg.timeLimit < 0 || cfg.saveEvery < 0 {
+		return cfg, errors.New("-time-limit and -save-every cannot be negative")
+	}
+	if (set["time-limit"] || set["save-every"] || set["checkpoint"]) && !cfg.progressive {
+		return cfg, errors.New("-time-limit, -save-every and -checkpoint need -progressive")
+	}
+	if cfg.adaptive.threshold < 0 {
+		return cfg, errors.New("-adaptive cannot be negative")
+	}
+	if cfg.adaptive.minSamples < 2 {
+		return cfg, errors.New("-min-spp must be at least 2")
+	}
+	if cfg.resume && cfg.checkpoint == "" {
+		return cfg, errors.New("-resume needs -checkpoint")
+	}
+
+	return cfg, nil
+}
+
+func printScenes(w io.Writer) {
+	for _, s := range scenes {
+		height := int(float64(s.opts.imageWidth) / s.opts.aspectRatio)
+		fmt.Fprintf(w, "%-20s %dx%d, %d spp, depth %d\n", s.name, s.opts.imageWidth, height, s.opts.samplesPerPixel, s.opts.maxDepth)
+	}
+}
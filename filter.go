@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// pixelFilter weighs a sample for a pixel by how far it is from the center of
+// the pixel, in pixels along each axis. Samples further than radius along
+// either axis don't count. Filters wider than a pixel blend every sample into
+// the pixels around it, which trades a little sharpness for less aliasing.
+type pixelFilter struct {
+	radius   float64
+	weight1D func(x float64, radius float64) float64
+}
+
+func (f *pixelFilter) weight(dx float64, dy float64) float64 {
+	return f.weight1D(dx, f.radius) * f.weight1D(dy, f.radius)
+}
+
+// filters are the filters by name, with their radius unless one is given
+var filters = map[string]struct {
+	radius float64
+	weight func(x float64, radius float64) float64
+}{
+	// Every sample counts the same for its own pixel, a plain average
+	"box": {0.5, func(x float64, radius float64) float64 { return 1 }},
+	"tent": {1, func(x float64, radius float64) float64 {
+		return math.Max(0, 1-math.Abs(x)/radius)
+	}},
+	// A gaussian with a standard deviation of a third of the radius, moved
+	// down so it reaches 0 at the radius
+	"gaussian": {1.5, func(x float64, radius float64) float64 {
+		sigma := radius / 3
+		return math.Max(0, math.Exp(-x*x/(2*sigma*sigma))-math.Exp(-radius*radius/(2*sigma*sigma)))
+	}},
+	"mitchell": {2, func(x float64, radius float64) float64 {
+		return mitchell(2*x/radius, 1.0/3, 1.0/3)
+	}},
+	// A sinc windowed by a wider one, with as many lobes as the radius
+	"lanczos": {2, func(x float64, radius float64) float64 {
+		if math.Abs(x) >= radius {
+			return 0
+		}
+		return sinc(x) * sinc(x/radius)
+	}},
+}
+
+func filterNames() []string {
+	var names []string
+	for name := range filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newPixelFilter makes the filter called name, with its own radius if radius is 0
+func newPixelFilter(name string, radius float64) *pixelFilter {
+	f := filters[name]
+	if radius <= 0 {
+		radius = f.radius
+	}
+	return &pixelFilter{radius, f.weight}
+}
+
+// mitchell is the Mitchell-Netravali cubic over [-2, 2]. B = C = 1/3 is the
+// one Mitchell and Netravali recommend, between blurring and ringing.
+func mitchell(x float64, b float64, c float64) float64 {
+	x = math.Abs(x)
+	switch {
+	case x < 1:
+		return ((12-9*b-6*c)*x*x*x + (-18+12*b+6*c)*x*x + (6 - 2*b)) / 6
+	case x < 2:
+		return ((-b-6*c)*x*x*x + (6*b+30*c)*x*x + (-12*b-48*c)*x + (8*b + 24*c)) / 6
+	}
+	return 0
+}
+
+// sinc is sin(πx)/(πx)
+func sinc(x float64) float64 {
+	if math.Abs(x) < 1e-5 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
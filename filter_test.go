@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// fillFilm takes n by n evenly spread samples of every pixel, of color c
+func fillFilm(f *film, n int, c func(x float64, y float64) Color3) {
+	ft := f.newTile(tile{0, 0, f.width, f.height})
+	for y := 0; y < f.height; y++ {
+		for x := 0; x < f.width; x++ {
+			var sum Color3
+			for j := 0; j < n; j++ {
+				for i := 0; i < n; i++ {
+					sx, sy := float64(x)+(float64(i)+0.5)/float64(n), float64(y)+(float64(j)+0.5)/float64(n)
+					f.addSample(ft, sx, sy, c(sx, sy))
+					sum = sum.Add(c(sx, sy))
+				}
+			}
+			f.add(x, y, sum, 0, n*n)
+		}
+	}
+	f.merge(ft)
+}
+
+// Every filter is normalized by the weights of the samples, so an image of
+// one color stays that color, and a gradient along x stays the same gradient
+// away from the edges whatever the filter's lobes
+func TestFiltersAreNormalized(t *testing.T) {
+	for _, name := range filterNames() {
+		for _, radius := range []float64{0, 0.75, 3} {
+			filter := newPixelFilter(name, radius)
+			if w := filter.weight(0, 0); w <= 0 {
+				t.Errorf("%s radius %v: weight at the center is %v", name, filter.radius, w)
+			}
+
+			flat := newFilm(12, 12, filter)
+			fillFilm(flat, 4, func(x float64, y float64) Color3 { return Color3{0.25, 0.5, 2} })
+			gradient := newFilm(12, 12, filter)
+			fillFilm(gradient, 4, func(x float64, y float64) Color3 { return Color3{x, x, x} })
+			margin := int(math.Ceil(filter.radius))
+			for y := 0; y < 12; y++ {
+				for x := 0; x < 12; x++ {
+					if c := flat.color(x, y); c.Sub(Color3{0.25, 0.5, 2}).Length() > 1e-6 {
+						t.Errorf("%s radius %v: pixel %d, %d of a flat image is %v", name, filter.radius, x, y, c)
+					}
+					// Filters are symmetric, so inside the image the
+					// gradient is the value at the center of the pixel
+					if x < margin || x >= 12-margin {
+						continue
+					}
+					if c := gradient.color(x, y); math.Abs(c[0]-(float64(x)+0.5)) > 1e-5 {
+						t.Errorf("%s radius %v: pixel %d, %d of a gradient is %v, want %v", name, filter.radius, x, y, c[0], float64(x)+0.5)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Negative lobes can leave a pixel with no weight or a negative color, which
+// are the pixel's own average and black instead
+func TestFilmColorWithNegativeLobes(t *testing.T) {
+	f := newFilm(4, 1, newPixelFilter("mitchell", 2))
+	ft := f.newTile(tile{0, 0, 4, 1})
+	// The Mitchell filter is negative between 1 and 2 pixels away, so pixel 0
+	// only gets the sample with a negative weight
+	f.addSample(ft, 2.0, 0.5, Color3{1, 1, 1})
+	f.merge(ft)
+	f.add(3, 0, Color3{1, 2, 3}, 0, 1)
+
+	if w := f.weights[0].float(); w >= 0 {
+		t.Fatalf("pixel 0 has weight %v, want a negative one", w)
+	}
+	if c := f.color(0, 0); c != (Color3{}) {
+		t.Errorf("pixel 0, with only a negative weight and no samples of its own, is %v, want black", c)
+	}
+
+	// Weights that nearly cancel out fall back to the pixel's own samples
+	f.weights[3] = toFixed(minFilterWeight / 2)
+	if c := f.color(3, 0); c != (Color3{1, 2, 3}) {
+		t.Errorf("pixel 3, with next to no weight, is %v, want its own average", c)
+	}
+
+	// Filtered colors below zero are clamped
+	f.filtered[1], f.weights[1] = fixedColor{}.add(Color3{-1, 0.5, -0.25}), toFixed(1)
+	if c := f.color(1, 0); c != (Color3{0, 0.5, 0}) {
+		t.Errorf("pixel 1 is %v, want its negative channels clamped", c)
+	}
+}
@@ -2,8 +2,6 @@ package main
 
 import (
 	"math"
-	"math/rand"
-	"sort"
 )
 
 type hitRecord struct {
@@ -14,13 +12,19 @@ type hitRecord struct {
 	mat       material
 	u         float64
 	v         float64
+
+	vertexColor     Color3 //Only set by meshes with vertex colors
+	geometricNormal Vec3   //Only set by triangles, the normal before smooth shading
 }
 
+// hittable is anything rays can hit. Some objects, like media, are hit at
+// random and take numbers from rnd for it; rays that can't reach those (the
+// ones towards lights, see validateLights) may pass a nil rnd.
 type hittable interface {
-	hit(r *ray, tMin float64, tMax float64) (*hitRecord, bool)
+	hit(r *ray, tMin float64, tMax float64, rnd sampler) (*hitRecord, bool)
 	boundingBox(time0 float64, time1 float64) (aabb, bool)
 	pdfValue(o Point3, v Vec3) float64
-	random(o Vec3, rnd *rand.Rand) Vec3
+	random(o Vec3, rnd sampler) Vec3
 }
 
 func (rec *hitRecord) setFaceNormal(r *ray, outwardNormal Vec3) {
@@ -38,7 +42,7 @@ type sphere struct {
 	mat    material
 }
 
-func (s *sphere) hit(r *ray, tMin float64, tMax float64) (*hitRecord, bool) {
+func (s *sphere) hit(r *ray, tMin float64, tMax float64, rnd sampler) (*hitRecord, bool) {
 
 	// const tolerance float64 = 0.01
 
@@ -92,7 +96,7 @@ func (s *sphere) boundingBox(time0 float64, time1 float64) (aabb, bool) {
 }
 
 func (s *sphere) pdfValue(o Point3, v Vec3) float64 {
-	_, hit := s.hit(&ray{o, v, 0}, 0.001, infinity)
+	_, hit := s.hit(&ray{o, v, 0}, 0.001, infinity, nil)
 	if !hit {
 		return 0
 	}
@@ -103,7 +107,7 @@ func (s *sphere) pdfValue(o Point3, v Vec3) float64 {
 	return 1.0 / solidAngle
 }
 
-func (s *sphere) random(o Vec3, rnd *rand.Rand) Vec3 {
+func (s *sphere) random(o Vec3, rnd sampler) Vec3 {
 	direction := s.center.Sub(o)
 	distanceSquared := direction.LengthSquared()
 	uvw := buildFromW(direction)
@@ -135,7 +139,7 @@ type movingSphere struct {
 	mat              material
 }
 
-func (s *movingSphere) hit(r *ray, tMin float64, tMax float64) (*hitRecord, bool) {
+func (s *movingSphere) hit(r *ray, tMin float64, tMax float64, rnd sampler) (*hitRecord, bool) {
 
 	// const tolerance float64 = 0.01
 
@@ -178,9 +182,12 @@ func (s *movingSphere) hit(r *ray, tMin float64, tMax float64) (*hitRecord, bool
 	return &rec, true
 }
 
+// center moves from center0 at time0 to center1 at time1
 func (s *movingSphere) center(time float64) Point3 {
-	return Lerp(s.center0, s.center1, time)
-	// return s.center0 + ((time-s.time0)/(s.time1-s.time0))*(s.center1.Sub(s.center0))
+	if s.time1 == s.time0 {
+		return s.center0
+	}
+	return Lerp(s.center0, s.center1, (time-s.time0)/(s.time1-s.time0))
 }
 
 func (s *movingSphere) boundingBox(time0 float64, time1 float64) (aabb, bool) {
@@ -197,25 +204,34 @@ func (s *movingSphere) boundingBox(time0 float64, time1 float64) (aabb, bool) {
 	return surroundingBox(box0, box1), true
 }
 
+// A moving sphere has no single position to sample without knowing the
+// time, so it can only be a light when it isn't actually moving
+func (s *movingSphere) stationary() bool {
+	return s.center0 == s.center1
+}
+
 func (s *movingSphere) pdfValue(o Point3, v Vec3) float64 {
-	return 0
+	if !s.stationary() {
+		return 0
+	}
+	return (&sphere{s.center0, s.radius, s.mat}).pdfValue(o, v)
 }
 
-func (s *movingSphere) random(o Vec3, rnd *rand.Rand) Vec3 {
-	return Vec3{1, 0, 0}
+func (s *movingSphere) random(o Vec3, rnd sampler) Vec3 {
+	return (&sphere{s.center0, s.radius, s.mat}).random(o, rnd)
 }
 
 type hittableList struct {
 	objects []hittable
 }
 
-func (list *hittableList) hit(r *ray, tMin float64, tMax float64) (rec *hitRecord, hit bool) {
+func (list *hittableList) hit(r *ray, tMin float64, tMax float64, rnd sampler) (rec *hitRecord, hit bool) {
 
 	hitAnything := false
 	closestSoFar := tMax
 
 	for _, obj := range list.objects {
-		if hitRec, hit := obj.hit(r, tMin, closestSoFar); hit {
+		if hitRec, hit := obj.hit(r, tMin, closestSoFar, rnd); hit {
 			hitAnything = true
 			closestSoFar = hitRec.t
 			rec = hitRec
@@ -266,93 +282,8 @@ func (list *hittableList) pdfValue(o Point3, v Vec3) float64 {
 	return sum
 }
 
-func (list *hittableList) random(o Vec3, rnd *rand.Rand) Vec3 {
-	return list.objects[rand.Intn(len(list.objects))].random(o, rnd)
-}
-
-type bvhNode struct {
-	left, right hittable
-	box         aabb
-}
-
-func newBvhNode(list []hittable, time0 float64, time1 float64) *bvhNode {
-	objs := list
-
-	var bvh bvhNode
-
-	axis := rand.Intn(2 + 1)
-
-	objectSpan := len(objs)
-
-	if objectSpan == 1 {
-		bvh.right = objs[0]
-		bvh.left = objs[0]
-	} else {
-		//only part of list
-		// comparator.Sort(objs)
-		sort.Slice(objs, func(h1, h2 int) bool {
-			return boxCompare(objs[h1], objs[h2], axis)
-		})
-
-		mid := objectSpan / 2
-		bvh.left = newBvhNode(objs[:mid], time0, time1)
-		bvh.right = newBvhNode(objs[mid:], time0, time1)
-	}
-
-	boxLeft, existsLeft := bvh.left.boundingBox(time0, time1)
-	boxRight, existsRight := bvh.right.boundingBox(time0, time1)
-
-	if !existsLeft || !existsRight {
-		panic("No bounding box in bvhnode constructor")
-	}
-
-	bvh.box = surroundingBox(boxLeft, boxRight)
-	return &bvh
-}
-
-func (bvh *bvhNode) hit(r *ray, tMin float64, tMax float64) (*hitRecord, bool) {
-	if !bvh.box.hit(r, tMin, tMax) {
-		return nil, false
-	}
-
-	var result *hitRecord
-	rec, hitLeft := bvh.left.hit(r, tMin, tMax)
-	if hitLeft {
-		result = rec
-		tMax = rec.t
-	}
-
-	rec, hitRight := bvh.right.hit(r, tMin, tMax)
-	if hitRight {
-		result = rec
-	}
-
-	return result, hitLeft || hitRight
-
-}
-
-func (bvh *bvhNode) boundingBox(time0 float64, time1 float64) (aabb, bool) {
-	return bvh.box, true
-}
-
-func (bvh *bvhNode) pdfValue(o Point3, v Vec3) float64 {
-	return 0
-}
-
-func (bvh *bvhNode) random(o Vec3, rnd *rand.Rand) Vec3 {
-	return Vec3{1, 0, 0}
-}
-
-func boxCompare(a hittable, b hittable, axis int) bool {
-
-	boxA, existsA := a.boundingBox(0, 0)
-	boxB, existsB := b.boundingBox(0, 0)
-
-	if !existsA || !existsB {
-		panic("No bounding box in bvh_node constructor\n")
-	}
-
-	return boxA.minimum[axis] < boxB.minimum[axis]
+func (list *hittableList) random(o Vec3, rnd sampler) Vec3 {
+	return list.objects[randomInt(rnd, len(list.objects))].random(o, rnd)
 }
 
 type xyRect struct {
@@ -365,7 +296,7 @@ func (rect *xyRect) boundingBox(time0 float64, time1 float64) (outputBox aabb, e
 	return outputBox, true
 }
 
-func (rect *xyRect) hit(r *ray, tMin float64, tMax float64) (*hitRecord, bool) {
+func (rect *xyRect) hit(r *ray, tMin float64, tMax float64, rnd sampler) (*hitRecord, bool) {
 
 	t := (rect.k - r.origin.Z()) / r.direction.Z()
 	if t < tMin || t > tMax {
@@ -395,11 +326,22 @@ func (rect *xyRect) hit(r *ray, tMin float64, tMax float64) (*hitRecord, bool) {
 }
 
 func (rect *xyRect) pdfValue(o Point3, v Vec3) float64 {
-	return 0
+	rec, hit := rect.hit(&ray{o, v, 0.0}, 0.001, infinity, nil)
+	if !hit {
+		return 0
+	}
+
+	area := (rect.x1 - rect.x0) * (rect.y1 - rect.y0)
+	distanceSquared := rec.t * rec.t * v.LengthSquared()
+	cosine := math.Abs(v.Dot(rec.normal) / v.Length())
+
+	return distanceSquared / (cosine * area)
 }
 
-func (rect *xyRect) random(o Vec3, rnd *rand.Rand) Vec3 {
-	return Vec3{1, 0, 0}
+func (rect *xyRect) random(o Vec3, rnd sampler) Vec3 {
+	u, v := rnd.get2D()
+	randomPoint := Point3{rect.x0 + u*(rect.x1-rect.x0), rect.y0 + v*(rect.y1-rect.y0), rect.k}
+	return randomPoint.Sub(o)
 }
 
 type xzRect struct {
@@ -412,7 +354,7 @@ func (rect *xzRect) boundingBox(time0 float64, time1 float64) (outputBox aabb, e
 	return outputBox, true
 }
 
-func (rect *xzRect) hit(r *ray, tMin float64, tMax float64) (*hitRecord, bool) {
+func (rect *xzRect) hit(r *ray, tMin float64, tMax float64, rnd sampler) (*hitRecord, bool) {
 
 	t := (rect.k - r.origin.Y()) / r.direction.Y()
 	if t < tMin || t > tMax {
@@ -442,7 +384,7 @@ func (rect *xzRect) hit(r *ray, tMin float64, tMax float64) (*hitRecord, bool) {
 }
 
 func (rect *xzRect) pdfValue(o Point3, v Vec3) float64 {
-	rec, hit := rect.hit(&ray{o, v, 0.0}, 0.001, infinity)
+	rec, hit := rect.hit(&ray{o, v, 0.0}, 0.001, infinity, nil)
 	if !hit {
 		return 0
 	}
@@ -454,8 +396,9 @@ func (rect *xzRect) pdfValue(o Point3, v Vec3) float64 {
 	return distanceSquared / (cosine * area)
 }
 
-func (rect *xzRect) random(o Vec3, rnd *rand.Rand) Vec3 {
-	randomPoint := Point3{RandomDoubleRange(rect.x0, rect.x1, rnd), rect.k, RandomDoubleRange(rect.z0, rect.z1, rnd)}
+func (rect *xzRect) random(o Vec3, rnd sampler) Vec3 {
+	u, v := rnd.get2D()
+	randomPoint := Point3{rect.x0 + u*(rect.x1-rect.x0), rect.k, rect.z0 + v*(rect.z1-rect.z0)}
 	return randomPoint.Sub(o)
 }
 
@@ -469,7 +412,7 @@ func (rect *yzRect) boundingBox(time0 float64, time1 float64) (outputBox aabb, e
 	return outputBox, true
 }
 
-func (rect *yzRect) hit(r *ray, tMin float64, tMax float64) (*hitRecord, bool) {
+func (rect *yzRect) hit(r *ray, tMin float64, tMax float64, rnd sampler) (*hitRecord, bool) {
 
 	t := (rect.k - r.origin.X()) / r.direction.X()
 	if t < tMin || t > tMax {
@@ -499,11 +442,22 @@ func (rect *yzRect) hit(r *ray, tMin float64, tMax float64) (*hitRecord, bool) {
 }
 
 func (rect *yzRect) pdfValue(o Point3, v Vec3) float64 {
-	return 0
+	rec, hit := rect.hit(&ray{o, v, 0.0}, 0.001, infinity, nil)
+	if !hit {
+		return 0
+	}
+
+	area := (rect.y1 - rect.y0) * (rect.z1 - rect.z0)
+	distanceSquared := rec.t * rec.t * v.LengthSquared()
+	cosine := math.Abs(v.Dot(rec.normal) / v.Length())
+
+	return distanceSquared / (cosine * area)
 }
 
-func (rect *yzRect) random(o Vec3, rnd *rand.Rand) Vec3 {
-	return Vec3{1, 0, 0}
+func (rect *yzRect) random(o Vec3, rnd sampler) Vec3 {
+	u, v := rnd.get2D()
+	randomPoint := Point3{rect.k, rect.y0 + u*(rect.y1-rect.y0), rect.z0 + v*(rect.z1-rect.z0)}
+	return randomPoint.Sub(o)
 }
 
 type box struct {
@@ -533,17 +487,42 @@ func (b *box) boundingBox(time0 float64, time1 float64) (outputBox aabb, exists
 	return outputBox, true
 }
 
-func (b *box) hit(r *ray, tMin float64, tMax float64) (*hitRecord, bool) {
+func (b *box) hit(r *ray, tMin float64, tMax float64, rnd sampler) (*hitRecord, bool) {
 
-	return b.sides.hit(r, tMin, tMax)
+	return b.sides.hit(r, tMin, tMax, rnd)
 }
 
+// sideAreas are the areas of the xy, xz and yz sides, each used twice
+func (b *box) sideAreas() (xy float64, xz float64, yz float64) {
+	size := b.boxMax.Sub(b.boxMin)
+	return size[0] * size[1], size[0] * size[2], size[1] * size[2]
+}
+
+// pdfValue is the density of a point picked uniformly over the box's surface
+// being in direction v. Points behind the first side count too, as random
+// may pick them.
 func (b *box) pdfValue(o Point3, v Vec3) float64 {
-	return 0
+	xy, xz, yz := b.sideAreas()
+	total := 2 * (xy + xz + yz)
+	weights := [6]float64{xy, xy, xz, xz, yz, yz}
+
+	sum := 0.0
+	for i, side := range b.sides.objects {
+		sum += weights[i] / total * side.pdfValue(o, v)
+	}
+	return sum
 }
 
-func (b *box) random(o Vec3, rnd *rand.Rand) Vec3 {
-	return Vec3{1, 0, 0}
+func (b *box) random(o Vec3, rnd sampler) Vec3 {
+	xy, xz, yz := b.sideAreas()
+	pick := RandomDouble(rnd) * (xy + xz + yz)
+	side := 4
+	if pick < xy {
+		side = 0
+	} else if pick < xy+xz {
+		side = 2
+	}
+	return b.sides.objects[side+randomInt(rnd, 2)].random(o, rnd)
 }
 
 type translate struct {
@@ -565,10 +544,10 @@ func (t *translate) boundingBox(time0 float64, time1 float64) (outputBox aabb, e
 	return outputBox, true
 }
 
-func (t *translate) hit(r *ray, tMin float64, tMax float64) (*hitRecord, bool) {
+func (t *translate) hit(r *ray, tMin float64, tMax float64, rnd sampler) (*hitRecord, bool) {
 
 	newRay := ray{r.origin.Sub(t.offset), r.direction, r.time}
-	rec, hit := t.obj.hit(&newRay, tMin, tMax)
+	rec, hit := t.obj.hit(&newRay, tMin, tMax, rnd)
 	if !hit {
 		return nil, false
 	}
@@ -580,11 +559,11 @@ func (t *translate) hit(r *ray, tMin float64, tMax float64) (*hitRecord, bool) {
 }
 
 func (t *translate) pdfValue(o Point3, v Vec3) float64 {
-	return 0
+	return t.obj.pdfValue(o.Sub(t.offset), v)
 }
 
-func (t *translate) random(o Vec3, rnd *rand.Rand) Vec3 {
-	return Vec3{1, 0, 0}
+func (t *translate) random(o Vec3, rnd sampler) Vec3 {
+	return t.obj.random(o.Sub(t.offset), rnd)
 }
 
 type rotateY struct {
@@ -635,7 +614,7 @@ func (rot *rotateY) boundingBox(time0 float64, time1 float64) (outputBox aabb, e
 	return rot.box, rot.hasBox
 }
 
-func (rot *rotateY) hit(r *ray, tMin float64, tMax float64) (*hitRecord, bool) {
+func (rot *rotateY) hit(r *ray, tMin float64, tMax float64, rnd sampler) (*hitRecord, bool) {
 
 	origin := r.origin.Copy()
 	direction := r.direction.Copy()
@@ -648,7 +627,7 @@ func (rot *rotateY) hit(r *ray, tMin float64, tMax float64) (*hitRecord, bool) {
 
 	rotatedRay := ray{origin, direction, r.time}
 
-	rec, hit := rot.obj.hit(&rotatedRay, tMin, tMax)
+	rec, hit := rot.obj.hit(&rotatedRay, tMin, tMax, rnd)
 	if !hit {
 		return nil, false
 	}
@@ -668,12 +647,23 @@ func (rot *rotateY) hit(r *ray, tMin float64, tMax float64) (*hitRecord, bool) {
 	return rec, true
 }
 
+// toObject rotates v from world space into the object's space
+func (rot *rotateY) toObject(v Vec3) Vec3 {
+	return Vec3{rot.cosTheta*v[0] - rot.sinTheta*v[2], v[1], rot.sinTheta*v[0] + rot.cosTheta*v[2]}
+}
+
+// toWorld undoes toObject
+func (rot *rotateY) toWorld(v Vec3) Vec3 {
+	return Vec3{rot.cosTheta*v[0] + rot.sinTheta*v[2], v[1], -rot.sinTheta*v[0] + rot.cosTheta*v[2]}
+}
+
+// A rotation doesn't change solid angles, the pdf is the same in both spaces
 func (rot *rotateY) pdfValue(o Point3, v Vec3) float64 {
-	return 0
+	return rot.obj.pdfValue(rot.toObject(o), rot.toObject(v))
 }
 
-func (rot *rotateY) random(o Vec3, rnd *rand.Rand) Vec3 {
-	return Vec3{1, 0, 0}
+func (rot *rotateY) random(o Vec3, rnd sampler) Vec3 {
+	return rot.toWorld(rot.obj.random(rot.toObject(o), rnd))
 }
 
 type constantMedium struct {
@@ -690,14 +680,14 @@ func (m *constantMedium) boundingBox(time0 float64, time1 float64) (outputBox aa
 	return m.boundary.boundingBox(time0, time1)
 }
 
-func (m *constantMedium) hit(r *ray, tMin float64, tMax float64) (*hitRecord, bool) {
+func (m *constantMedium) hit(r *ray, tMin float64, tMax float64, rnd sampler) (*hitRecord, bool) {
 
-	rec1, hit1 := m.boundary.hit(r, -infinity, infinity)
+	rec1, hit1 := m.boundary.hit(r, -infinity, infinity, rnd)
 	if !hit1 {
 		return nil, false
 	}
 
-	rec2, hit2 := m.boundary.hit(r, rec1.t+0.0001, infinity)
+	rec2, hit2 := m.boundary.hit(r, rec1.t+0.0001, infinity, rnd)
 	if !hit2 {
 		return nil, false
 	}
@@ -719,7 +709,7 @@ func (m *constantMedium) hit(r *ray, tMin float64, tMax float64) (*hitRecord, bo
 
 	rayLength := r.direction.Length()
 	distanceInsideBoundary := (rec2.t - rec1.t) * rayLength
-	hitDistance := m.negInvDensity * math.Log(rand.Float64())
+	hitDistance := m.negInvDensity * math.Log(RandomDouble(rnd))
 
 	if hitDistance > distanceInsideBoundary {
 		return nil, false
@@ -739,11 +729,12 @@ func (m *constantMedium) hit(r *ray, tMin float64, tMax float64) (*hitRecord, bo
 	return &rec, true
 }
 
+// Media scatter inside a volume, they can't be sampled as lights (see validateLights)
 func (m *constantMedium) pdfValue(o Point3, v Vec3) float64 {
 	return 0
 }
 
-func (m *constantMedium) random(o Vec3, rnd *rand.Rand) Vec3 {
+func (m *constantMedium) random(o Vec3, rnd sampler) Vec3 {
 	return Vec3{1, 0, 0}
 }
 
@@ -755,9 +746,9 @@ func (f *flipFace) boundingBox(time0 float64, time1 float64) (outputBox aabb, ex
 	return f.obj.boundingBox(time0, time1)
 }
 
-func (f *flipFace) hit(r *ray, tMin float64, tMax float64) (*hitRecord, bool) {
+func (f *flipFace) hit(r *ray, tMin float64, tMax float64, rnd sampler) (*hitRecord, bool) {
 
-	rec, hit := f.obj.hit(r, tMin, tMax)
+	rec, hit := f.obj.hit(r, tMin, tMax, rnd)
 	if !hit {
 		return nil, false
 	}
@@ -767,9 +758,9 @@ func (f *flipFace) hit(r *ray, tMin float64, tMax float64) (*hitRecord, bool) {
 }
 
 func (f *flipFace) pdfValue(o Point3, v Vec3) float64 {
-	return 0
+	return f.obj.pdfValue(o, v)
 }
 
-func (f *flipFace) random(o Vec3, rnd *rand.Rand) Vec3 {
-	return Vec3{1, 0, 0}
+func (f *flipFace) random(o Vec3, rnd sampler) Vec3 {
+	return f.obj.random(o, rnd)
 }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// integrator estimates the light arriving at the camera along a ray
+type integrator interface {
+	rayColor(r *ray, rnd sampler) Color3
+}
+
+// passIntegrator is an integrator that renders the image in passes of one
+// sample per pixel, and has to get ready for each of them
+type passIntegrator interface {
+	integrator
+	startPass(pass int)
+}
+
+// renderScene is everything an integrator renders
+type renderScene struct {
+	world  hittable
+	lights hittable //importance sampled objects
+	cam    *camera
+	opts   *options
+	splats *splatFilm //light integrators find for pixels other than the one being sampled
+	seed   int64      //the render's, for the integrator's own random numbers
+}
+
+// integrators can be selected by name in the render options. Each render
+// makes its own for its scene.
+var integrators = map[string]func(scene *renderScene) (integrator, error){
+	"mixture": func(scene *renderScene) (integrator, error) { return mixtureIntegrator{scene}, nil },
+	"path":    func(scene *renderScene) (integrator, error) { return pathIntegrator{scene}, nil },
+	"bdpt":    newBdptIntegrator,
+	"photon":  newPhotonIntegrator,
+	"sppm":    newSppmIntegrator,
+}
+
+func integratorNames() []string {
+	var names []string
+	for name := range integrators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hasLights tells if there is anything to sample in lights
+func hasLights(lights hittable) bool {
+	l, ok := lights.(*hittableList)
+	return !ok || len(l.objects) > 0
+}
+
+// mixtureIntegrator is ray.RayColor: diffuse bounces sample a 50/50 mixture
+// of directions towards the lights and from the material
+type mixtureIntegrator struct {
+	*renderScene
+}
+
+func (in mixtureIntegrator) rayColor(r *ray, rnd sampler) Color3 {
+	return r.RayColor(in.world, in.lights, in.opts, rnd)
+}
+
+// pathIntegrator is a path tracer with next event estimation: every diffuse
+// bounce sends a shadow ray towards a point on the lights, on top of
+// continuing the path in a direction sampled from the material. Emission
+// found both ways is weighted with the power heuristic, so each sample
+// counts most where its strategy is best (small lights for light sampling,
+// glossy bounces and big lights for the material's).
+type pathIntegrator struct {
+	*renderScene
+}
+
+func (in pathIntegrator) rayColor(r *ray, rnd sampler) Color3 {
+	world, lights, opts := in.world, in.lights, in.opts
+	sampleLights := hasLights(lights)
+
+	color := Color3{0, 0, 0}
+	throughput := Color3{1, 1, 1}
+	current := *r
+	// pdf of the material sample that made current, 0 for camera and
+	// specular rays whose emission light sampling can't find
+	scatteredPdf := 0.0
+
+	for depth := 0; depth < opts.maxDepth; depth++ {
+		rec, hit := world.hit(&current, 0.001, infinity, rnd)
+		if !hit {
+			color = color.Add(throughput.MultEach(opts.background))
+			break
+		}
+
+		emitted := rec.mat.emitted(&current, rec, rec.u, rec.v, rec.p)
+		if emitted != (Color3{}) {
+			weight := 1.0
+			if scatteredPdf > 0 && sampleLights {
+				weight = powerHeuristic(scatteredPdf, lights.pdfValue(current.origin, current.direction))
+			}
+			color = color.Add(throughput.MultEach(emitted).Mult(weight))
+		}
+
+		sRec, scatter := rec.mat.scatter(&current, rec, rnd)
+		if !scatter {
+			break
+		}
+
+		if sRec.isSpecular {
+			throughput = throughput.MultEach(sRec.attenuation)
+			current = sRec.specularRay
+			current.time = r.time
+			scatteredPdf = 0
+		} else {
+			// The light's emission is the next hit, which must be within maxDepth
+			if sampleLights && depth+1 < opts.maxDepth {
+				color = color.Add(throughput.MultEach(sampleLight(&current, rec, sRec, world, lights, rnd)))
+			}
+
+			scattered := ray{rec.p, sRec.pdf.generate(rnd), r.time}
+			scatteredPdf = sRec.pdf.value(scattered.direction)
+			if scatteredPdf <= 0 {
+				break
+			}
+			throughput = throughput.MultEach(sRec.attenuation).Mult(rec.mat.scatteringPdf(&current, rec, &scattered) / scatteredPdf)
+			current = scattered
+		}
+
+		if !russianRoulette(&throughput, depth+1, opts, rnd) {
+			break
+		}
+	}
+
+	return color
+}
+
+// sampleLight is the light reaching rec along a direction sampled towards
+// the lights, scattered back along rayIn. The shadow ray is traced through
+// the world: whatever it hits first is what is seen in that direction.
+func sampleLight(rayIn *ray, rec *hitRecord, sRec *scatterRecord, world hittable, lights hittable, rnd sampler) Color3 {
+	shadow := ray{rec.p, lights.random(rec.p, rnd), rayIn.time}
+	lightPdf := lights.pdfValue(shadow.origin, shadow.direction)
+	if lightPdf <= 0 {
+		return Color3{0, 0, 0}
+	}
+	scatteringPdf := rec.mat.scatteringPdf(rayIn, rec, &shadow)
+	if scatteringPdf <= 0 {
+		return Color3{0, 0, 0}
+	}
+
+	lightRec, hit := world.hit(&shadow, 0.001, infinity, rnd)
+	if !hit {
+		return Color3{0, 0, 0}
+	}
+	emitted := lightRec.mat.emitted(&shadow, lightRec, lightRec.u, lightRec.v, lightRec.p)
+	if emitted == (Color3{}) {
+		return Color3{0, 0, 0}
+	}
+
+	weight := powerHeuristic(lightPdf, sRec.pdf.value(shadow.direction))
+	return sRec.attenuation.MultEach(emitted).Mult(scatteringPdf * weight / lightPdf)
+}
+
+// russianRoulette randomly ends paths after opts.rouletteDepth bounces, the
+// more likely the less light they carry, and scales up the throughput of the
+// ones that go on to make up for the others. The image stays the same on
+// average but most of the time is spent on the paths that matter, so
+// maxDepth can be very high. It returns false if the path ends.
+func russianRoulette(throughput *Color3, bounces int, opts *options, rnd sampler) bool {
+	if opts.rouletteDepth <= 0 || bounces < opts.rouletteDepth {
+		return *throughput != (Color3{})
+	}
+	survival := math.Min(maxComponent(*throughput), 1)
+	if survival <= 0 || RandomDouble(rnd) >= survival {
+		return false
+	}
+	*throughput = throughput.Div(survival)
+	return true
+}
+
+// visible tells if nothing is in between a and b
+func visible(world hittable, a Point3, b Point3, time float64, rnd sampler) bool {
+	d := b.Sub(a)
+	distance := d.Length()
+	_, hit := world.hit(&ray{a, d.Div(distance), time}, 0.001, distance-0.001, rnd)
+	return !hit
+}
+
+// powerHeuristic is the MIS weight of a sample taken with pdf f when it could
+// also have been taken with pdf g
+func powerHeuristic(f float64, g float64) float64 {
+	if f <= 0 {
+		return 0
+	}
+	return f * f / (f*f + g*g)
+}
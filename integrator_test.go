@@ -0,0 +1,148 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// Russian roulette ends paths early but weighs the ones it keeps up, so it
+// must not change what the image converges to. Both renders of the Cornell
+// box trace paths deep enough for the light they leave out not to matter, and
+// roulette starts at the first bounce so it decides the fate of most paths.
+func TestRouletteIsUnbiased(t *testing.T) {
+	const (
+		samples = 20000
+		depth   = 50
+		k       = 4 //standard errors the means may be apart
+	)
+	s, _ := findScene("cornellBox")
+	world := s.build(s.cam.time0, s.cam.time1, newStream(1, sceneStream))
+	lights := s.lights
+	if lights == nil {
+		lights = collectLights(world)
+	}
+	c := s.cam.build(s.opts.aspectRatio)
+
+	// render returns the mean of every channel over the image and its
+	// standard error
+	render := func(name string, rouletteDepth int, seed int64) (mean Color3, stdErr Color3) {
+		opts := s.opts
+		opts.maxDepth = depth
+		opts.rouletteDepth = rouletteDepth
+		integ, err := integrators[name](&renderScene{world, lights, &c, &opts, nil, seed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rnd := newStream(seed)
+
+		var sum, sumSquares Color3
+		for i := 0; i < samples; i++ {
+			r := c.getRay(RandomDouble(rnd), RandomDouble(rnd), rnd)
+			col := integ.rayColor(r, rnd)
+			sum = sum.Add(col)
+			sumSquares = sumSquares.Add(col.MultEach(col))
+		}
+		for i := range mean {
+			mean[i] = sum[i] / samples
+			variance := sumSquares[i]/samples - mean[i]*mean[i]
+			stdErr[i] = math.Sqrt(math.Max(variance, 0) / samples)
+		}
+		return mean, stdErr
+	}
+
+	// The integrators that use roulette
+	for _, name := range []string{"mixture", "path"} {
+		refMean, refErr := render(name, 0, 1)
+		rrMean, rrErr := render(name, 1, 2)
+		for i := range refMean {
+			sigma := math.Sqrt(refErr[i]*refErr[i] + rrErr[i]*rrErr[i])
+			if math.Abs(rrMean[i]-refMean[i]) > k*sigma {
+				t.Errorf("%s: channel %d is %v ± %v with roulette, %v ± %v without", name, i, rrMean[i], rrErr[i], refMean[i], refErr[i])
+			}
+		}
+	}
+}
+
+// renderMeans renders the scene runs times with integrator name, each time
+// from a new seed, and returns the mean of every channel over the developed
+// image, splats included, and its standard error over the runs
+func renderMeans(t *testing.T, sceneName string, name string, size int, spp int, runs int, setOpts func(opts *options)) (mean Color3, stdErr Color3) {
+	s, _ := findScene(sceneName)
+	world := s.build(s.cam.time0, s.cam.time1, newStream(1, sceneStream))
+	lights := s.lights
+	if lights == nil {
+		lights = collectLights(world)
+	}
+	c := s.cam.build(s.opts.aspectRatio)
+
+	var sum, sumSquares Color3
+	for run := 0; run < runs; run++ {
+		seed := int64(run + 1)
+		opts := s.opts
+		opts.imageWidth, opts.imageHeight = size, size
+		opts.samplesPerPixel = spp
+		opts.integrator = name
+		if setOpts != nil {
+			setOpts(&opts)
+		}
+		splats := newSplatFilm(size, size)
+		integ, err := integrators[name](&renderScene{world, lights, &c, &opts, splats, seed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := newFilm(size, size, newPixelFilter(opts.filter, 0))
+		newTileRenderer(&c, integ, &opts, f, 16, 1, seed).renderSamples(0, spp, nil, func(int) {})
+
+		var imgMean Color3
+		for _, p := range developFilm(f, splats).pixels {
+			imgMean = imgMean.Add(p)
+		}
+		imgMean = imgMean.Div(float64(size * size))
+		sum = sum.Add(imgMean)
+		sumSquares = sumSquares.Add(imgMean.MultEach(imgMean))
+	}
+	for i := range mean {
+		mean[i] = sum[i] / float64(runs)
+		variance := (sumSquares[i] - sum[i]*mean[i]) / float64(runs-1)
+		stdErr[i] = math.Sqrt(math.Max(variance, 0) / float64(runs))
+	}
+	return mean, stdErr
+}
+
+// Connecting light and camera subpaths, and splatting the light tracing ones
+// onto other pixels, must add up to the same light a path tracer finds
+func TestBdptMatchesPath(t *testing.T) {
+	const k = 4 //standard errors the means may be apart
+	for _, sceneName := range []string{"cornellBox", "cornellSmoke"} {
+		pathMean, pathErr := renderMeans(t, sceneName, "path", 24, 32, 8, nil)
+		bdptMean, bdptErr := renderMeans(t, sceneName, "bdpt", 24, 32, 8, nil)
+		for i := range pathMean {
+			sigma := math.Sqrt(pathErr[i]*pathErr[i] + bdptErr[i]*bdptErr[i])
+			if math.Abs(bdptMean[i]-pathMean[i]) > k*sigma {
+				t.Errorf("%s: channel %d is %v ± %v with bdpt, %v ± %v with path", sceneName, i, bdptMean[i], bdptErr[i], pathMean[i], pathErr[i])
+			}
+		}
+	}
+}
+
+// Progressive photon mapping is biased by the radius it gathers photons in,
+// which shrinks pass after pass: after enough of them the direct light and
+// the light the photons bring add up to what a path tracer finds
+func TestSppmMatchesPath(t *testing.T) {
+	const (
+		passes = 64
+		k      = 4 //standard errors the means may be apart
+	)
+	deep := func(opts *options) { opts.maxDepth = 50 }
+	pathMean, pathErr := renderMeans(t, "cornellBox", "path", 24, 32, 4, deep)
+	sppmMean, sppmErr := renderMeans(t, "cornellBox", "sppm", 24, passes, 4, func(opts *options) {
+		deep(opts)
+		opts.photons = 5000
+	})
+	for i := range pathMean {
+		sigma := math.Sqrt(pathErr[i]*pathErr[i] + sppmErr[i]*sppmErr[i])
+		if math.Abs(sppmMean[i]-pathMean[i]) > k*sigma {
+			t.Errorf("channel %d is %v ± %v after %d sppm passes, %v ± %v with path", i, sppmMean[i], sppmErr[i], passes, pathMean[i], pathErr[i])
+		}
+	}
+}
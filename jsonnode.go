@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+type jsonKind int
+
+const (
+	jsonNull jsonKind = iota
+	jsonBool
+	jsonNumber
+	jsonString
+	jsonArray
+	jsonObject
+)
+
+func (k jsonKind) String() string {
+	return [...]string{"null", "boolean", "number", "string", "array", "object"}[k]
+}
+
+// jsonNode is a parsed JSON value that remembers where it came from, so scene
+// errors can point at the offending line instead of just naming a field
+type jsonNode struct {
+	kind      jsonKind
+	line, col int
+
+	boolean bool
+	number  float64
+	str     string
+	items   []*jsonNode
+
+	keys   []string
+	fields map[string]*jsonNode
+	used   map[string]bool
+}
+
+// field returns the member called name of an object node, or nil if missing.
+// Every key looked up is remembered so unknown keys can be reported later.
+func (n *jsonNode) field(name string) *jsonNode {
+	if n.kind != jsonObject {
+		return nil
+	}
+	n.used[name] = true
+	return n.fields[name]
+}
+
+// unusedKey returns the first key that was never looked up with field
+func (n *jsonNode) unusedKey() (string, bool) {
+	for _, k := range n.keys {
+		if !n.used[k] {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+func (n *jsonNode) pos() string {
+	return fmt.Sprintf("%d:%d", n.line, n.col)
+}
+
+type jsonParser struct {
+	data []byte
+	dec  *json.Decoder
+}
+
+func parseJSON(data []byte) (*jsonNode, error) {
+	p := jsonParser{data: data, dec: json.NewDecoder(bytes.NewReader(data))}
+	p.dec.UseNumber()
+
+	root, err := p.value()
+	if err != nil {
+		return nil, p.wrap(err)
+	}
+	if _, err := p.dec.Token(); err != io.EOF {
+		line, col := p.lineCol(p.start())
+		return nil, fmt.Errorf("%d:%d: unexpected data after the top level value", line, col)
+	}
+	return root, nil
+}
+
+// start is the offset of the next token: the decoder only reports where the
+// previous one ended, so skip the separators in between
+func (p *jsonParser) start() int64 {
+	off := p.dec.InputOffset()
+	for off < int64(len(p.data)) {
+		switch p.data[off] {
+		case ' ', '\t', '\r', '\n', ':', ',':
+			off++
+		default:
+			return off
+		}
+	}
+	return off
+}
+
+func (p *jsonParser) lineCol(offset int64) (line int, col int) {
+	line, col = 1, 1
+	for _, c := range p.data[:offset] {
+		if c == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return line, col
+}
+
+func (p *jsonParser) wrap(err error) error {
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		// The offset is past the character that was wrong
+		line, col := p.lineCol(syntaxErr.Offset - 1)
+		return fmt.Errorf("%d:%d: %v", line, col, err)
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		line, col := p.lineCol(int64(len(p.data)))
+		return fmt.Errorf("%d:%d: unexpected end of file", line, col)
+	}
+	return err
+}
+
+func (p *jsonParser) value() (*jsonNode, error) {
+	var n jsonNode
+	n.line, n.col = p.lineCol(p.start())
+
+	tok, err := p.dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := tok.(type) {
+	case nil:
+		n.kind = jsonNull
+	case bool:
+		n.kind = jsonBool
+		n.boolean = t
+	case json.Number:
+		n.kind = jsonNumber
+		n.number, err = strconv.ParseFloat(string(t), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid number %s", n.pos(), t)
+		}
+	case string:
+		n.kind = jsonString
+		n.str = t
+	case json.Delim:
+		switch t {
+		case '[':
+			n.kind = jsonArray
+			for p.dec.More() {
+				item, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+				n.items = append(n.items, item)
+			}
+		case '{':
+			n.kind = jsonObject
+			n.fields = map[string]*jsonNode{}
+			n.used = map[string]bool{}
+			for p.dec.More() {
+				line, col := p.lineCol(p.start())
+				keyTok, err := p.dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				key := keyTok.(string)
+				if _, dup := n.fields[key]; dup {
+					return nil, fmt.Errorf("%d:%d: duplicate key %q", line, col, key)
+				}
+				val, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+				n.keys = append(n.keys, key)
+				n.fields[key] = val
+			}
+		}
+		// closing delimiter
+		if _, err := p.dec.Token(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &n, nil
+}
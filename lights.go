@@ -0,0 +1,396 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// validateLights checks that every object in lights can be importance
+// sampled, i.e. that its pdfValue and random agree and cover the object.
+// Anything else would quietly bias the image.
+func validateLights(lights hittable) error {
+	switch l := lights.(type) {
+	case *sphere, *xyRect, *xzRect, *yzRect, *box, *triangle, *triangleMesh:
+		return nil
+	case *movingSphere:
+		if !l.stationary() {
+			return errors.New("a moving sphere can't be sampled as a light, its position depends on the time")
+		}
+		return nil
+	case *animatedTransform:
+		if l.static == nil {
+			return errors.New("an animated object can't be sampled as a light, its position depends on the time")
+		}
+		return validateLights(l.obj)
+	case *constantMedium:
+		return errors.New("a constant medium can't be sampled as a light")
+	case *translate:
+		return validateLights(l.obj)
+	case *important:
+		return validateLights(l.obj)
+	case *rotateY:
+		return validateLights(l.obj)
+	case *transform:
+		return validateLights(l.obj)
+	case *flipFace:
+		return validateLights(l.obj)
+	case *hittableList:
+		return validateObjects(l.objects)
+	case *bvhNode:
+		if l.left == nil {
+			return validateObjects(l.objects)
+		}
+		if err := validateLights(l.left); err != nil {
+			return err
+		}
+		return validateLights(l.right)
+	case *linearBvh:
+		return validateObjects(l.objects)
+	default:
+		return fmt.Errorf("%T can't be sampled as a light", lights)
+	}
+}
+
+func validateObjects(objects []hittable) error {
+	for _, obj := range objects {
+		if err := validateLights(obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// important marks an object that is worth sampling directly even though it
+// doesn't emit light, like a glass sphere that focuses a light onto the
+// scene. It's otherwise the object itself.
+type important struct {
+	obj hittable
+}
+
+func (imp *important) hit(r *ray, tMin float64, tMax float64, rnd sampler) (*hitRecord, bool) {
+	return imp.obj.hit(r, tMin, tMax, rnd)
+}
+
+func (imp *important) boundingBox(time0 float64, time1 float64) (aabb, bool) {
+	return imp.obj.boundingBox(time0, time1)
+}
+
+func (imp *important) pdfValue(o Point3, v Vec3) float64 {
+	return imp.obj.pdfValue(o, v)
+}
+
+func (imp *important) random(o Vec3, rnd sampler) Vec3 {
+	return imp.obj.random(o, rnd)
+}
+
+func emissive(mat material) bool {
+	_, ok := mat.(diffuseLight)
+	return ok
+}
+
+// collectLights finds every object in world with a diffuseLight material or
+// marked important, so they can be importance sampled. Objects inside
+// translate, rotateY, transform, flipFace and static animations come wrapped
+// the same way, so they are sampled where they are drawn. Objects that can't
+// be sampled (media and moving objects) are left out.
+func collectLights(world hittable) *hittableList {
+	c := lightCollector{shared: map[hittable][]hittable{}}
+	return &hittableList{c.collect(world)}
+}
+
+// collectEmitters is collectLights without the important objects, only what
+// actually emits light. moving is how many emitters were left out because
+// they move.
+func collectEmitters(world hittable) (emitters []hittable, moving int) {
+	c := lightCollector{shared: map[hittable][]hittable{}, emittersOnly: true}
+	return c.collect(world), c.moving
+}
+
+type lightCollector struct {
+	// Lights already found in geometry shared by several transforms
+	shared       map[hittable][]hittable
+	emittersOnly bool
+	moving       int
+}
+
+func (c *lightCollector) collect(h hittable) []hittable {
+	switch h := h.(type) {
+	case *important:
+		if c.emittersOnly {
+			return c.collect(h.obj)
+		}
+		if validateLights(h.obj) != nil {
+			return nil
+		}
+		return []hittable{h.obj}
+	case *sphere:
+		return c.ifEmissive(h, h.mat)
+	case *movingSphere:
+		if !h.stationary() {
+			if emissive(h.mat) {
+				c.moving++
+			}
+			return nil
+		}
+		return c.ifEmissive(h, h.mat)
+	case *xyRect:
+		return c.ifEmissive(h, h.mat)
+	case *xzRect:
+		return c.ifEmissive(h, h.mat)
+	case *yzRect:
+		return c.ifEmissive(h, h.mat)
+	case *box:
+		return c.ifEmissive(h, h.sides.objects[0].(*xyRect).mat)
+	case *triangle:
+		return c.ifEmissive(h, h.mesh.mat)
+	case *triangleMesh:
+		return c.ifEmissive(h, h.mat)
+	case *hittableList:
+		return c.collectAll(h.objects)
+	case *bvhNode:
+		if h.left == nil {
+			return c.collectAll(h.objects)
+		}
+		return append(c.collect(h.left), c.collect(h.right)...)
+	case *linearBvh:
+		return c.collectShared(h, func() []hittable { return c.collectAll(h.objects) })
+	case *translate:
+		return c.wrap(h.obj, func(light hittable) hittable { return &translate{light, h.offset} })
+	case *rotateY:
+		return c.wrap(h.obj, func(light hittable) hittable {
+			return &rotateY{light, h.sinTheta, h.cosTheta, h.hasBox, h.box}
+		})
+	case *transform:
+		return c.wrap(h.obj, func(light hittable) hittable {
+			t := *h
+			t.obj = light
+			return &t
+		})
+	case *animatedTransform:
+		if h.static == nil {
+			c.moving += len(c.collect(h.obj))
+			return nil
+		}
+		return c.collect(h.static)
+	case *flipFace:
+		return c.wrap(h.obj, func(light hittable) hittable { return &flipFace{light} })
+	}
+	// Media and anything unknown
+	return nil
+}
+
+func (c *lightCollector) ifEmissive(h hittable, mat material) []hittable {
+	if emissive(mat) {
+		return []hittable{h}
+	}
+	return nil
+}
+
+func (c *lightCollector) collectAll(objects []hittable) []hittable {
+	var lights []hittable
+	for _, obj := range objects {
+		lights = append(lights, c.collect(obj)...)
+	}
+	return lights
+}
+
+// collectShared only looks through geometry used by many instances once
+func (c *lightCollector) collectShared(h hittable, collect func() []hittable) []hittable {
+	lights, ok := c.shared[h]
+	if !ok {
+		lights = collect()
+		c.shared[h] = lights
+	}
+	return lights
+}
+
+// wrap collects the lights in obj and puts each one in its own copy of the
+// wrapper around obj
+func (c *lightCollector) wrap(obj hittable, wrapper func(light hittable) hittable) []hittable {
+	var lights []hittable
+	for _, light := range c.collect(obj) {
+		lights = append(lights, wrapper(light))
+	}
+	return lights
+}
+
+// surfaceSampler picks points uniformly over the surface of a light, with
+// the normal there. Unlike random it doesn't depend on where the light is
+// seen from, for integrators that start paths on the lights.
+type surfaceSampler struct {
+	area   float64
+	sample func(rnd sampler) (p Point3, normal Vec3)
+}
+
+func newSurfaceSampler(h hittable) (surfaceSampler, error) {
+	switch h := h.(type) {
+	case *sphere:
+		return sphereSampler(h.center, h.radius), nil
+	case *movingSphere:
+		if !h.stationary() {
+			return surfaceSampler{}, errors.New("a moving sphere can't be sampled by area")
+		}
+		return sphereSampler(h.center0, h.radius), nil
+	case *xyRect:
+		return rectSampler(h, (h.x1-h.x0)*(h.y1-h.y0), Vec3{0, 0, 1}), nil
+	case *xzRect:
+		return rectSampler(h, (h.x1-h.x0)*(h.z1-h.z0), Vec3{0, 1, 0}), nil
+	case *yzRect:
+		return rectSampler(h, (h.y1-h.y0)*(h.z1-h.z0), Vec3{1, 0, 0}), nil
+	case *box:
+		return newSurfaceSampler(&h.sides)
+	case *triangle:
+		return surfaceSampler{h.area(), func(rnd sampler) (Point3, Vec3) {
+			return h.randomPoint(rnd), h.geometricNormal()
+		}}, nil
+	case *triangleMesh:
+		return surfaceSampler{h.area, func(rnd sampler) (Point3, Vec3) {
+			tri := h.pickTriangle(rnd)
+			return tri.randomPoint(rnd), tri.geometricNormal()
+		}}, nil
+	case *hittableList:
+		samplers := make([]surfaceSampler, len(h.objects))
+		for i, obj := range h.objects {
+			var err error
+			if samplers[i], err = newSurfaceSampler(obj); err != nil {
+				return surfaceSampler{}, err
+			}
+		}
+		return combineSamplers(samplers), nil
+	case *translate:
+		inner, err := newSurfaceSampler(h.obj)
+		return surfaceSampler{inner.area, func(rnd sampler) (Point3, Vec3) {
+			p, n := inner.sample(rnd)
+			return p.Add(h.offset), n
+		}}, err
+	case *rotateY:
+		inner, err := newSurfaceSampler(h.obj)
+		return surfaceSampler{inner.area, func(rnd sampler) (Point3, Vec3) {
+			p, n := inner.sample(rnd)
+			return h.toWorld(p), h.toWorld(n)
+		}}, err
+	case *transform:
+		// Only rotations and uniform scales keep uniform points uniform
+		scale, ok := similarityScale(h.objectToWorld)
+		if !ok {
+			return surfaceSampler{}, errors.New("a light with a non-uniform scale or shear can't be sampled by area")
+		}
+		inner, err := newSurfaceSampler(h.obj)
+		return surfaceSampler{inner.area * scale * scale, func(rnd sampler) (Point3, Vec3) {
+			p, n := inner.sample(rnd)
+			return h.objectToWorld.MulPoint(p), h.normalMatrix.MulVector(n).Normalize()
+		}}, err
+	case *animatedTransform:
+		if h.static == nil {
+			return surfaceSampler{}, errors.New("an animated light can't be sampled by area")
+		}
+		return newSurfaceSampler(h.static)
+	case *flipFace:
+		return newSurfaceSampler(h.obj)
+	case *important:
+		return newSurfaceSampler(h.obj)
+	}
+	return surfaceSampler{}, fmt.Errorf("%T can't be sampled by area", h)
+}
+
+func sphereSampler(center Point3, radius float64) surfaceSampler {
+	return surfaceSampler{4 * math.Pi * radius * radius, func(rnd sampler) (Point3, Vec3) {
+		n := RandomUnitVector(rnd)
+		return center.Add(n.Mult(radius)), n
+	}}
+}
+
+// rectSampler uses the rect's random, which is already uniform over its area
+func rectSampler(rect hittable, area float64, normal Vec3) surfaceSampler {
+	return surfaceSampler{area, func(rnd sampler) (Point3, Vec3) {
+		return rect.random(Point3{0, 0, 0}, rnd), normal
+	}}
+}
+
+// combineSamplers picks one of samplers with odds proportional to its area,
+// so points are uniform over all of them
+func combineSamplers(samplers []surfaceSampler) surfaceSampler {
+	cdf := make([]float64, len(samplers))
+	area := 0.0
+	for i, s := range samplers {
+		area += s.area
+		cdf[i] = area
+	}
+	return surfaceSampler{area, func(rnd sampler) (Point3, Vec3) {
+		i := sort.SearchFloat64s(cdf, RandomDouble(rnd)*area)
+		if i >= len(samplers) {
+			i = len(samplers) - 1
+		}
+		return samplers[i].sample(rnd)
+	}}
+}
+
+// similarityScale returns s if m only rotates, scales by s and translates
+func similarityScale(m Mat4) (float64, bool) {
+	var columns [3]Vec3
+	for c := 0; c < 3; c++ {
+		columns[c] = Vec3{m[0][c], m[1][c], m[2][c]}
+	}
+	scale2 := columns[0].LengthSquared()
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			expected := 0.0
+			if i == j {
+				expected = scale2
+			}
+			if math.Abs(columns[i].Dot(columns[j])-expected) > 1e-9*scale2 {
+				return 0, false
+			}
+		}
+	}
+	return math.Sqrt(scale2), true
+}
+
+// lightSurfaces picks points uniformly over the total area of the emitters
+// in a world, so every point on a light is as likely as any other
+type lightSurfaces struct {
+	lights  hittableList
+	sampler surfaceSampler
+}
+
+func newLightSurfaces(world hittable) (*lightSurfaces, error) {
+	emitters, moving := collectEmitters(world)
+	if moving > 0 {
+		return nil, fmt.Errorf("%d lights move during the shutter, they can't be sampled by area", moving)
+	}
+	ls := lightSurfaces{lights: hittableList{emitters}}
+	sampler, err := newSurfaceSampler(&ls.lights)
+	if err != nil {
+		return nil, err
+	}
+	ls.sampler = sampler
+	return &ls, nil
+}
+
+// pdfArea is the density of sample picking any point on the lights
+func (ls *lightSurfaces) pdfArea() float64 {
+	if ls.sampler.area <= 0 {
+		return 0
+	}
+	return 1 / ls.sampler.area
+}
+
+// sample returns a point on the lights with its normal and the light's
+// emission there. The emission (which may be textured) is found by hitting
+// the lights right at the point.
+func (ls *lightSurfaces) sample(time float64, rnd sampler) (p Point3, normal Vec3, emitted Color3, ok bool) {
+	if ls.sampler.area <= 0 {
+		return p, normal, emitted, false
+	}
+	p, normal = ls.sampler.sample(rnd)
+
+	eps := 1e-4 * (1 + math.Max(math.Abs(p[0]), math.Max(math.Abs(p[1]), math.Abs(p[2]))))
+	probe := ray{p.Add(normal.Mult(eps)), normal.Mult(-1), time}
+	rec, hit := ls.lights.hit(&probe, 0, 2*eps, rnd)
+	if !hit {
+		return p, normal, emitted, false
+	}
+	return p, normal, rec.mat.emitted(&probe, rec, rec.u, rec.v, rec.p), true
+}
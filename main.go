@@ -1,12 +1,15 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"image"
+	"image/color"
 	"image/png"
-	"math/rand"
+	"io"
 	"os"
-	"sync"
+	"path/filepath"
+	"runtime"
 	"time"
 
 	"github.com/schollz/progressbar/v3"
@@ -18,195 +21,150 @@ type options struct {
 	imageHeight     int
 	samplesPerPixel int
 	maxDepth        int
+	rouletteDepth   int //bounces before russian roulette can end a path, 0 for never
 	background      Color3
+	integrator      string
+	sampler         string  //what the samples of every pixel are made of
+	filter          string  //how samples are weighed by the pixels around them
+	filterRadius    float64 //in pixels, 0 for the filter's own
+	photons         int     //photons shot for every photon map
+	photonRadius    float64 //radius photons are gathered in (the first one for sppm), 0 to pick one from the size of the scene
 }
 
 func main() {
 
-	//Image
-	aspectRatio := 16.0 / 9.0
-	imageWidth := 800
-	imageHeight := int(float64(imageWidth) / aspectRatio)
-
-	opts := options{
-		aspectRatio:     aspectRatio,
-		imageWidth:      imageWidth,
-		imageHeight:     imageHeight,
-		samplesPerPixel: 500,
-		maxDepth:        5,
-		background:      Color3{0, 0, 0},
-	}
-
-	var world hittable
-
-	var lookAt, lookFrom Point3
-	vfov := 40.0
-	aperture := 0.0
-
-	var lights hittableList
-	lights.Add(&xzRect{lambertian{}, 213, 343, 227, 332, 554})
-	lights.Add(&sphere{Point3{190, 90, 190}, 90, metal{}})
-
-	switch 6 {
-	case 1:
-		world = randomScene()
-		opts.background = Color3{0.7, 0.8, 1.00}
-
-		//Camera
-		lookFrom = Point3{13, 2, 3}
-		lookAt = Point3{0, 0, 0}
-		aperture = 0.1
-		vfov = 20
-	case 2:
-		world = twoSpheres()
-		opts.background = Color3{0.7, 0.8, 1.00}
-
-		//Camera
-		lookFrom = Point3{13, 2, 3}
-		lookAt = Point3{0, 0, 0}
-		aperture = 0.1
-		vfov = 20
-	case 3:
-		world = twoPerlinSpheres()
-		opts.background = Color3{0.7, 0.8, 1.00}
-
-		//Camera
-		lookFrom = Point3{13, 2, 3}
-		lookAt = Point3{0, 0, 0}
-		vfov = 20
-	case 4:
-		world = imageTextureTest()
-		opts.background = Color3{0.7, 0.8, 1.00}
-
-		//Camera
-		lookFrom = Point3{13, 2, 3}
-		lookAt = Point3{0, 0, 0}
-		vfov = 20
-	case 5:
-		world = simpleLight()
-		opts.samplesPerPixel = 50
-		opts.background = Color3{0, 0, 0}
-
-		//Camera
-		lookFrom = Point3{26, 3, 6}
-		lookAt = Point3{0, 2, 0}
-		vfov = 20
-	case 6:
-		//next week chapter 6.11 -> 2min
-		world = cornellBox()
-		opts.aspectRatio = 1.0
-		opts.imageWidth = 600
-		opts.imageHeight = int(float64(opts.imageWidth) / opts.aspectRatio)
-		// opts.samplesPerPixel = 2500
-		opts.samplesPerPixel = 2000
-		// opts.maxDepth = 50
-		opts.maxDepth = 5
-		opts.background = Color3{0, 0, 0}
-
-		//Camera
-		lookFrom = Point3{278, 278, -800}
-		lookAt = Point3{278, 278, 0}
-		vfov = 40
-
-	case 7:
-		world = cornellSmoke()
-		opts.aspectRatio = 1.0
-		opts.imageWidth = 600
-		opts.imageHeight = int(float64(opts.imageWidth) / opts.aspectRatio)
-		opts.samplesPerPixel = 50
-		opts.background = Color3{0, 0, 0}
-
-		//Camera
-		lookFrom = Point3{278, 278, -800}
-		lookAt = Point3{278, 278, 0}
-		vfov = 40
-
-	case 8:
-		world = finalScene()
-		opts.aspectRatio = 1.0
-		opts.imageWidth = 800
-		opts.imageHeight = int(float64(opts.imageWidth) / opts.aspectRatio)
-		opts.samplesPerPixel = 100
-		opts.maxDepth = 3
-		opts.background = Color3{0, 0, 0}
-
-		//Camera
-		lookFrom = Point3{478, 278, -600}
-		lookAt = Point3{278, 278, 0}
-		vfov = 40
+	cfg, err := parseFlags(os.Args[1:], os.Stderr)
+	if err == flag.ErrHelp {
+		return
 	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if cfg.listScenes {
+		printScenes(os.Stdout)
+		return
+	}
+
+	if cfg.threads > 0 {
+		runtime.GOMAXPROCS(cfg.threads)
+	}
+	fmt.Printf("Seed %d\n", cfg.seed)
+
+	opts := cfg.opts
 
 	// World/Camera
 
-	up := Vec3{0, 1, 0}
-	distToFocus := 10.0 //lookAt.Sub(lookFrom).Length()
-	c := initCamera(lookFrom, lookAt, up, vfov, opts.aspectRatio, aperture, distToFocus, 0.0, 1.0)
+	t0 := time.Now()
+	world := cfg.scene.build(cfg.cam.time0, cfg.cam.time1, newStream(cfg.seed, sceneStream))
+
+	lights := cfg.scene.lights
+	if lights == nil {
+		lights = collectLights(world)
+	}
+	if err := validateLights(lights); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid lights:", err)
+		os.Exit(1)
+	}
+	if bvh, ok := world.(*bvhNode); ok {
+		if cfg.bvhStats {
+			fmt.Printf("BVH built in %v: %v\n", time.Since(t0), bvh.stats())
+		}
+		if cfg.accel == "linear" {
+			world = newLinearBvh(bvh)
+		}
+	}
+	c := cfg.cam.build(opts.aspectRatio)
+	splats := newSplatFilm(opts.imageWidth, opts.imageHeight)
+	integ, err := integrators[opts.integrator](&renderScene{world, lights, &c, &opts, splats, cfg.seed})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
 	//Render
 
-	t0 := time.Now()
+	t0 = time.Now()
 
-	upLeft := image.Point{0, 0}
-	lowRight := image.Point{opts.imageWidth - 1, opts.imageHeight - 1}
-
-	img := image.NewRGBA(image.Rectangle{upLeft, lowRight})
-
-	// Set color for each pixel.
-	wg := sync.WaitGroup{}
-	for y := opts.imageHeight - 1; y >= 0; y-- {
-		//Draw each pixel of line
-		wg.Add(1)
-		go func(row int) {
-			var bar *progressbar.ProgressBar
-			if row == 0 {
-				bar = progressbar.Default(int64(opts.imageWidth))
-			}
-			for x := 0; x < opts.imageWidth; x++ {
-				ch := make(chan Color3, opts.samplesPerPixel)
-
-				pixelColor := Color3{0, 0, 0}
-				sendRays(world, &c, x, row, &opts, ch, &lights)
-
-				for i := 0; i < opts.samplesPerPixel; i++ {
-					pixelColor = pixelColor.Add(<-ch)
-				}
-				// Colors are defined by Red, Green, Blue, Alpha uint8 values.
-				img.Set(x, opts.imageHeight-row, Color3ToRGBA(pixelColor, opts.samplesPerPixel))
-				if row == 0 {
-					bar.Add(1)
-				}
-			}
-			//Maybe change later
-			fmt.Printf("%d/%d lines\n", opts.imageHeight-row, opts.imageHeight)
-			wg.Done()
-		}(y)
-	}
-	wg.Wait()
-
-	// Encode as PNG.
-	f, _ := os.Create("images/out.png")
-	png.Encode(f, img)
+	pixels := newFilm(opts.imageWidth, opts.imageHeight, newPixelFilter(opts.filter, opts.filterRadius))
+	renderer := newTileRenderer(&c, integ, &opts, pixels, cfg.tileSize, runtime.GOMAXPROCS(0), cfg.seed)
+	renderer.adaptive = cfg.adaptive
+
+	if cfg.progressive {
+		err = renderProgressive(renderer, splats, &cfg)
+	} else {
+		bar := progressbar.Default(int64(opts.imageWidth * opts.imageHeight * opts.samplesPerPixel))
+		renderer.renderSamples(0, opts.samplesPerPixel, nil, func(samples int) { bar.Add(samples) })
+		err = saveImages(&cfg, pixels, splats)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	elapsed := time.Since(t0)
+	totalSamples := pixels.totalSamples()
+	fmt.Printf("%d samples in %v, %.0f samples/sec\n", totalSamples, elapsed, float64(totalSamples)/elapsed.Seconds())
+	if cfg.adaptive.threshold > 0 {
+		fmt.Printf("%.1f samples per pixel on average\n", float64(totalSamples)/float64(opts.imageWidth*opts.imageHeight))
+	}
 
 	t1 := time.Now()
 	fmt.Printf("The call took %v to run.\n", t1.Sub(t0))
 }
 
-func sendRays(world hittable, c *camera, x int, y int, opts *options, ch chan Color3, lights hittable) {
-	go func() {
-		for s := 0; s < opts.samplesPerPixel; s++ {
-			// go func() {
-			rnd := rand.New(rand.NewSource(rand.Int63()))
-
-			//Horizontal ratio?
-			u := (float64(x) + RandomDouble(rnd)) / float64(opts.imageWidth-1)
-			//Vertical ratio?
-			v := (float64(y) + RandomDouble(rnd)) / float64(opts.imageHeight-1)
-
-			currentRay := c.getRay(u, v, rnd)
-			rayColor := currentRay.RayColor(world, opts.background, opts.maxDepth, rnd, lights)
-			// pixelColor = pixelColor.Add(rayColor)
-			ch <- rayColor
-			// }()
+// saveImages writes the image, and the heatmap if one was asked for
+func saveImages(cfg *config, pixels *film, splats *splatFilm) error {
+	if err := writeImage(cfg.outputFile, pixels, splats, cfg.exr); err != nil {
+		return err
+	}
+	if cfg.heatmapFile == "" {
+		return nil
+	}
+	return writeHeatmap(cfg.heatmapFile, pixels)
+}
+
+// writeHeatmap saves a PNG of how many samples every pixel got, from black
+// for none through red and yellow to white for the most any pixel got
+func writeHeatmap(path string, pixels *film) error {
+	most := 1
+	for _, n := range pixels.samples {
+		if n > most {
+			most = n
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, pixels.width, pixels.height))
+	for row := 0; row < pixels.height; row++ {
+		for x := 0; x < pixels.width; x++ {
+			_, samples := pixels.at(x, row)
+			t := 3 * float64(samples) / float64(most)
+			heat := color.RGBA{uint8(255 * Clamp(t, 0, 1)), uint8(255 * Clamp(t-1, 0, 1)), uint8(255 * Clamp(t-2, 0, 1)), 0xff}
+			img.Set(x, pixels.height-1-row, heat)
 		}
-	}()
+	}
+	return writeFileAtomic(path, func(w io.Writer) error { return png.Encode(w, img) })
+}
+
+// writeFileAtomic writes a file next to path with write and then renames it
+// over path, so path is never left half written
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	// Temporary files are only readable by their owner
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Every pixel of the film is in the heatmap, the bottom row of the film at
+// the bottom of the image
+func TestWriteHeatmap(t *testing.T) {
+	f := newFilm(3, 2, newPixelFilter("box", 0))
+	for y := 0; y < f.height; y++ {
+		for x := 0; x < f.width; x++ {
+			f.add(x, y, Color3{}, 0, 1)
+		}
+	}
+	f.add(2, 0, Color3{}, 0, 2) //bottom right, the most sampled pixel
+
+	path := filepath.Join(t.TempDir(), "heat.png")
+	if err := writeHeatmap(path, f); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	img, err := png.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b := img.Bounds(); b.Dx() != 3 || b.Dy() != 2 {
+		t.Fatalf("heatmap is %dx%d, want 3x2", b.Dx(), b.Dy())
+	}
+	if r, g, b, _ := img.At(2, 1).RGBA(); r != 0xffff || g != 0xffff || b != 0xffff {
+		t.Errorf("the most sampled pixel is %v, want white", img.At(2, 1))
+	}
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				t.Errorf("pixel %d, %d was not written", x, y)
+			}
+			if r, g, _, _ := img.At(x, y).RGBA(); (x != 2 || y != 1) && (r != 0xffff || g != 0) {
+				t.Errorf("pixel %d, %d with a third of the samples is %v, want red", x, y, img.At(x, y))
+			}
+		}
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"math"
-	"math/rand"
 )
 
 type scatterRecord struct {
@@ -13,7 +12,7 @@ type scatterRecord struct {
 }
 
 type material interface {
-	scatter(rayIn *ray, rec *hitRecord, rnd *rand.Rand) (sRec *scatterRecord, scatter bool)
+	scatter(rayIn *ray, rec *hitRecord, rnd sampler) (sRec *scatterRecord, scatter bool)
 	emitted(rayIn *ray, rec *hitRecord, u float64, v float64, p Point3) Color3
 	scatteringPdf(rayIn *ray, rec *hitRecord, scattered *ray) float64
 }
@@ -22,11 +21,11 @@ type lambertian struct {
 	albedo texture
 }
 
-func (lamb lambertian) scatter(rayIn *ray, rec *hitRecord, rnd *rand.Rand) (sRec *scatterRecord, scatter bool) {
+func (lamb lambertian) scatter(rayIn *ray, rec *hitRecord, rnd sampler) (sRec *scatterRecord, scatter bool) {
 
 	var sRecord scatterRecord
 	sRecord.isSpecular = false
-	sRecord.attenuation = lamb.albedo.value(rec.u, rec.v, rec.p)
+	sRecord.attenuation = textureValue(lamb.albedo, rec)
 	sRecord.pdf = newCosinePdf(rec.normal)
 
 	return &sRecord, true
@@ -49,7 +48,7 @@ type metal struct {
 	fuzz   float64 //Radius of sphere
 }
 
-func (m metal) scatter(rayIn *ray, rec *hitRecord, rnd *rand.Rand) (sRec *scatterRecord, scatter bool) {
+func (m metal) scatter(rayIn *ray, rec *hitRecord, rnd sampler) (sRec *scatterRecord, scatter bool) {
 
 	reflected := Reflect(rayIn.direction.Normalize(), rec.normal)
 	var sRecord scatterRecord
@@ -72,7 +71,7 @@ type dielectric struct {
 	ir float64 //Index of Refraction
 }
 
-func (m dielectric) scatter(rayIn *ray, rec *hitRecord, rnd *rand.Rand) (sRec *scatterRecord, scatter bool) {
+func (m dielectric) scatter(rayIn *ray, rec *hitRecord, rnd sampler) (sRec *scatterRecord, scatter bool) {
 
 	var sRecord scatterRecord
 	sRecord.isSpecular = true
@@ -123,7 +122,7 @@ type diffuseLight struct {
 	emit texture
 }
 
-func (m diffuseLight) scatter(rayIn *ray, rec *hitRecord, rnd *rand.Rand) (sRec *scatterRecord, scatter bool) {
+func (m diffuseLight) scatter(rayIn *ray, rec *hitRecord, rnd sampler) (sRec *scatterRecord, scatter bool) {
 	return nil, false
 }
 
@@ -142,11 +141,11 @@ type isotropic struct {
 	albedo texture
 }
 
-func (m isotropic) scatter(rayIn *ray, rec *hitRecord, rnd *rand.Rand) (sRec *scatterRecord, scatter bool) {
+func (m isotropic) scatter(rayIn *ray, rec *hitRecord, rnd sampler) (sRec *scatterRecord, scatter bool) {
 	var sRecord scatterRecord
 	sRecord.isSpecular = false
 	sRecord.pdf = newSpherePdf()
-	sRecord.attenuation = m.albedo.value(rec.u, rec.v, rec.p)
+	sRecord.attenuation = textureValue(m.albedo, rec)
 	return &sRecord, true
 }
 
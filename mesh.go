@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// triangleMesh is an indexed triangle mesh. Vertex data is shared by all
+// triangles: every three entries of indices form one triangle.
+// normals, uvs and colors are optional, but if present they have one entry per position.
+type triangleMesh struct {
+	positions []Point3
+	normals   []Vec3
+	uvs       [][2]float64
+	colors    []Color3
+	indices   []int
+	mat       material
+
+	triangles []hittable
+	bvh       *linearBvh
+
+	// Cumulative triangle areas, used to pick triangles when sampling the mesh as a light
+	areaCDF []float64
+	area    float64
+}
+
+func newTriangleMesh(positions []Point3, normals []Vec3, uvs [][2]float64, indices []int, mat material) (*triangleMesh, error) {
+	if len(indices) == 0 || len(indices)%3 != 0 {
+		return nil, fmt.Errorf("mesh needs a multiple of 3 indices, got %d", len(indices))
+	}
+	if normals != nil && len(normals) != len(positions) {
+		return nil, fmt.Errorf("mesh has %d normals for %d positions", len(normals), len(positions))
+	}
+	if uvs != nil && len(uvs) != len(positions) {
+		return nil, fmt.Errorf("mesh has %d uvs for %d positions", len(uvs), len(positions))
+	}
+	for _, i := range indices {
+		if i < 0 || i >= len(positions) {
+			return nil, fmt.Errorf("mesh index %d out of range [0, %d)", i, len(positions))
+		}
+	}
+
+	m := &triangleMesh{
+		positions: positions,
+		normals:   normals,
+		uvs:       uvs,
+		indices:   indices,
+		mat:       mat,
+	}
+
+	triangleCount := len(indices) / 3
+	m.triangles = make([]hittable, triangleCount)
+	m.areaCDF = make([]float64, triangleCount)
+	for i := 0; i < triangleCount; i++ {
+		tri := &triangle{m, 3 * i}
+		m.triangles[i] = tri
+		m.area += tri.area()
+		m.areaCDF[i] = m.area
+	}
+	if m.area == 0 {
+		return nil, errors.New("mesh has no area")
+	}
+
+	m.bvh = newLinearBvh(newBvhNode(m.triangles, 0, 1))
+
+	return m, nil
+}
+
+// setVertexColors gives the mesh per-vertex colors, read by vertexColorTexture
+func (m *triangleMesh) setVertexColors(colors []Color3) error {
+	if len(colors) != len(m.positions) {
+		return fmt.Errorf("mesh has %d colors for %d positions", len(colors), len(m.positions))
+	}
+	m.colors = colors
+	return nil
+}
+
+func (m *triangleMesh) hit(r *ray, tMin float64, tMax float64, rnd sampler) (*hitRecord, bool) {
+	return m.bvh.hit(r, tMin, tMax, rnd)
+}
+
+func (m *triangleMesh) boundingBox(time0 float64, time1 float64) (aabb, bool) {
+	return m.bvh.boundingBox(time0, time1)
+}
+
+// pdfValue is the solid angle density of picking a point uniformly over the
+// whole surface of the mesh and it being the first one seen along v
+func (m *triangleMesh) pdfValue(o Point3, v Vec3) float64 {
+	rec, hit := m.hit(&ray{o, v, 0}, 0.001, infinity, nil)
+	if !hit {
+		return 0
+	}
+
+	distanceSquared := rec.t * rec.t * v.LengthSquared()
+	// The points are picked on the flat triangles, so their normal is the
+	// one that counts, not the smooth shading one
+	cosine := math.Abs(v.Dot(rec.geometricNormal) / v.Length())
+
+	return distanceSquared / (cosine * m.area)
+}
+
+func (m *triangleMesh) random(o Vec3, rnd sampler) Vec3 {
+	return m.pickTriangle(rnd).randomPoint(rnd).Sub(o)
+}
+
+// pickTriangle picks a triangle with odds proportional to its area
+func (m *triangleMesh) pickTriangle(rnd sampler) *triangle {
+	i := sort.SearchFloat64s(m.areaCDF, RandomDouble(rnd)*m.area)
+	if i >= len(m.triangles) {
+		i = len(m.triangles) - 1
+	}
+	return m.triangles[i].(*triangle)
+}
+
+// triangle is one face of a triangleMesh
+type triangle struct {
+	mesh  *triangleMesh
+	index int //Position in mesh.indices of the first vertex
+}
+
+// newTriangle creates a standalone triangle, with its own one triangle mesh
+func newTriangle(p0 Point3, p1 Point3, p2 Point3, mat material) (*triangle, error) {
+	m, err := newTriangleMesh([]Point3{p0, p1, p2}, nil, nil, []int{0, 1, 2}, mat)
+	if err != nil {
+		return nil, err
+	}
+	return m.triangles[0].(*triangle), nil
+}
+
+func (tri *triangle) vertices() (Point3, Point3, Point3) {
+	idx := tri.mesh.indices[tri.index : tri.index+3]
+	return tri.mesh.positions[idx[0]], tri.mesh.positions[idx[1]], tri.mesh.positions[idx[2]]
+}
+
+// geometricNormal is the normal of the flat triangle, ignoring smooth shading
+func (tri *triangle) geometricNormal() Vec3 {
+	p0, p1, p2 := tri.vertices()
+	return p1.Sub(p0).Cross(p2.Sub(p0)).Normalize()
+}
+
+func (tri *triangle) area() float64 {
+	p0, p1, p2 := tri.vertices()
+	return p1.Sub(p0).Cross(p2.Sub(p0)).Length() / 2
+}
+
+func (tri *triangle) hit(r *ray, tMin float64, tMax float64, rnd sampler) (*hitRecord, bool) {
+	// Möller–Trumbore
+	p0, p1, p2 := tri.vertices()
+	edge1 := p1.Sub(p0)
+	edge2 := p2.Sub(p0)
+
+	pVec := r.direction.Cross(edge2)
+	det := edge1.Dot(pVec)
+	if math.Abs(det) < 1e-12 {
+		// Ray parallel to the triangle
+		return nil, false
+	}
+	invDet := 1.0 / det
+
+	tVec := r.origin.Sub(p0)
+	b1 := tVec.Dot(pVec) * invDet
+	if b1 < 0 || b1 > 1 {
+		return nil, false
+	}
+
+	qVec := tVec.Cross(edge1)
+	b2 := r.direction.Dot(qVec) * invDet
+	if b2 < 0 || b1+b2 > 1 {
+		return nil, false
+	}
+
+	t := edge2.Dot(qVec) * invDet
+	if t < tMin || t > tMax {
+		return nil, false
+	}
+	b0 := 1 - b1 - b2
+
+	rec := hitRecord{
+		t:   t,
+		p:   r.At(t),
+		mat: tri.mesh.mat,
+		u:   b1,
+		v:   b2,
+	}
+	rec.geometricNormal = edge1.Cross(edge2).Normalize()
+	rec.setFaceNormal(r, rec.geometricNormal)
+
+	idx := tri.mesh.indices[tri.index : tri.index+3]
+
+	if tri.mesh.uvs != nil {
+		uv0, uv1, uv2 := tri.mesh.uvs[idx[0]], tri.mesh.uvs[idx[1]], tri.mesh.uvs[idx[2]]
+		rec.u = b0*uv0[0] + b1*uv1[0] + b2*uv2[0]
+		rec.v = b0*uv0[1] + b1*uv1[1] + b2*uv2[1]
+	}
+
+	if tri.mesh.colors != nil {
+		c0, c1, c2 := tri.mesh.colors[idx[0]], tri.mesh.colors[idx[1]], tri.mesh.colors[idx[2]]
+		rec.vertexColor = c0.Mult(b0).Add(c1.Mult(b1)).Add(c2.Mult(b2))
+	}
+
+	if tri.mesh.normals != nil {
+		// Smooth shading, kept on the side of the surface the ray is on
+		n0, n1, n2 := tri.mesh.normals[idx[0]], tri.mesh.normals[idx[1]], tri.mesh.normals[idx[2]]
+		shading := n0.Mult(b0).Add(n1.Mult(b1)).Add(n2.Mult(b2))
+		if !shading.NearZero() {
+			shading = shading.Normalize()
+			if shading.Dot(rec.normal) < 0 {
+				shading = shading.Mult(-1)
+			}
+			rec.normal = shading
+		}
+	}
+
+	return &rec, true
+}
+
+func (tri *triangle) boundingBox(time0 float64, time1 float64) (aabb, bool) {
+	p0, p1, p2 := tri.vertices()
+	box := aabb{p0, p0}
+	box = surroundingBox(box, aabb{p1, p1})
+	box = surroundingBox(box, aabb{p2, p2})
+
+	// Axis aligned triangles would have a flat box, pad it like the rects do
+	for a := 0; a < 3; a++ {
+		if box.maximum[a]-box.minimum[a] < 0.0001 {
+			box.minimum[a] -= 0.0001
+			box.maximum[a] += 0.0001
+		}
+	}
+	return box, true
+}
+
+func (tri *triangle) pdfValue(o Point3, v Vec3) float64 {
+	rec, hit := tri.hit(&ray{o, v, 0}, 0.001, infinity, nil)
+	if !hit {
+		return 0
+	}
+
+	normal := tri.geometricNormal()
+	distanceSquared := rec.t * rec.t * v.LengthSquared()
+	cosine := math.Abs(v.Dot(normal) / v.Length())
+
+	return distanceSquared / (cosine * tri.area())
+}
+
+func (tri *triangle) random(o Vec3, rnd sampler) Vec3 {
+	return tri.randomPoint(rnd).Sub(o)
+}
+
+// randomPoint is uniformly distributed over the triangle's area
+func (tri *triangle) randomPoint(rnd sampler) Point3 {
+	p0, p1, p2 := tri.vertices()
+	r1, r2 := rnd.get2D()
+	su := math.Sqrt(r1)
+	b0 := 1 - su
+	b1 := r2 * su
+	return p0.Mult(b0).Add(p1.Mult(b1)).Add(p2.Mult(1 - b0 - b1))
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// A smooth shaded mesh is still sampled over its flat triangles, so as a
+// light it must have the pdf of a flat one
+func TestMeshPdfIgnoresShadingNormals(t *testing.T) {
+	positions := []Point3{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}}
+	normals := []Vec3{Vec3{1, 0, 1}.Normalize(), Vec3{0, 1, 1}.Normalize(), Vec3{-1, -1, 1}.Normalize()}
+	smooth, err := newTriangleMesh(positions, normals, nil, []int{0, 1, 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flat, err := newTriangleMesh(positions, nil, nil, []int{0, 1, 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := Point3{0.1, 0.2, 2}
+	for _, target := range []Point3{{0.2, 0.2, 0}, {0.6, 0.1, 0}, {0.1, 0.7, 0}} {
+		v := target.Sub(o)
+		got, want := smooth.pdfValue(o, v), flat.pdfValue(o, v)
+		if want == 0 || math.Abs(got-want) > 1e-9*want {
+			t.Errorf("pdfValue towards %v = %v, want %v", target, got, want)
+		}
+	}
+}
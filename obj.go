@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// objMaterial holds the MTL parameters we understand, before they are turned
+// into one of our materials
+type objMaterial struct {
+	kd, ks, ke Color3
+	ns, ni, d  float64
+	illum      int
+	mapKd      string
+}
+
+// objGroup collects the faces of one o/g group using one material, which
+// becomes one triangleMesh
+type objGroup struct {
+	material string
+
+	positions []Point3
+	normals   []Vec3
+	uvs       [][2]float64
+	indices   []int
+
+	vertexIndex          map[[3]int]int
+	missingN, missingUVs bool
+}
+
+// objFile is an OBJ being parsed, with the shared vertex data of the whole file
+type objFile struct {
+	path string
+	line int
+	dir  string
+
+	positions []Point3
+	normals   []Vec3
+	uvs       [][2]float64
+
+	materials    map[string]objMaterial
+	groups       []*objGroup
+	current      *objGroup
+	materialName string
+	warned       map[string]bool //materials that were missing, warned about once
+	files        []string        //MTL libraries and texture maps read
+}
+
+// loadOBJ reads a Wavefront OBJ file and the MTL libraries it references and
+// returns one mesh per group/material pair. Faces without a material, or with
+// one that isn't in any library (or whose library is missing), use defaultMat
+// with a warning. Texture maps are looked up relative to the MTL file.
+// files are the other files the model was read from.
+func loadOBJ(path string, defaultMat material) (meshes []*triangleMesh, files []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	obj := objFile{
+		path:      path,
+		dir:       filepath.Dir(path),
+		materials: map[string]objMaterial{},
+		warned:    map[string]bool{},
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		obj.line++
+		if err := obj.parseLine(scanner.Text()); err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %v", path, obj.line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("%s:%d: %v", path, obj.line, err)
+	}
+
+	mats := map[string]material{}
+	for _, g := range obj.groups {
+		if len(g.indices) == 0 {
+			continue
+		}
+
+		mat := defaultMat
+		if objMat, ok := obj.materials[g.material]; ok {
+			if mat = mats[g.material]; mat == nil {
+				if mat, err = objMat.toMaterial(); err != nil {
+					return nil, nil, err
+				}
+				mats[g.material] = mat
+				if objMat.mapKd != "" {
+					obj.files = append(obj.files, objMat.mapKd)
+				}
+			}
+		}
+
+		// A mesh has normals/uvs for every vertex or for none
+		normals, uvs := g.normals, g.uvs
+		if g.missingN {
+			normals = nil
+		}
+		if g.missingUVs {
+			uvs = nil
+		}
+
+		m, err := newTriangleMesh(g.positions, normals, uvs, g.indices, mat)
+		if err != nil {
+			// Degenerate groups (lines, points, zero area) have nothing to render
+			continue
+		}
+		meshes = append(meshes, m)
+	}
+	if len(meshes) == 0 {
+		return nil, nil, fmt.Errorf("%s: no faces found", path)
+	}
+
+	return meshes, obj.files, nil
+}
+
+// objModel is loadOBJ with all the meshes in a single bvh
+func objModel(path string, defaultMat material) (hittable, []string, error) {
+	meshes, files, err := loadOBJ(path, defaultMat)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(meshes) == 1 {
+		return meshes[0], files, nil
+	}
+	objects := make([]hittable, len(meshes))
+	for i, m := range meshes {
+		objects[i] = m
+	}
+	return newBvhNode(objects, 0, 1), files, nil
+}
+
+func parseFloats(fields []string, min int, max int) ([]float64, error) {
+	if len(fields) < min || len(fields) > max {
+		return nil, fmt.Errorf("expected %d to %d numbers, got %d", min, max, len(fields))
+	}
+	values := make([]float64, len(fields))
+	for i, s := range fields {
+		x, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", s)
+		}
+		values[i] = x
+	}
+	return values, nil
+}
+
+func (obj *objFile) parseLine(text string) error {
+	if i := strings.IndexByte(text, '#'); i >= 0 {
+		text = text[:i]
+	}
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	switch fields[0] {
+	case "v":
+		v, err := parseFloats(fields[1:], 3, 4)
+		if err != nil {
+			return err
+		}
+		obj.positions = append(obj.positions, Point3{v[0], v[1], v[2]})
+	case "vt":
+		v, err := parseFloats(fields[1:], 1, 3)
+		if err != nil {
+			return err
+		}
+		uv := [2]float64{v[0], 0}
+		if len(v) > 1 {
+			uv[1] = v[1]
+		}
+		obj.uvs = append(obj.uvs, uv)
+	case "vn":
+		v, err := parseFloats(fields[1:], 3, 3)
+		if err != nil {
+			return err
+		}
+		obj.normals = append(obj.normals, Vec3{v[0], v[1], v[2]})
+	case "f":
+		return obj.face(fields[1:])
+	case "o", "g":
+		// Faces after this go in a new mesh
+		obj.current = nil
+	case "usemtl":
+		name := strings.Join(fields[1:], " ")
+		if _, ok := obj.materials[name]; !ok && !obj.warned[name] {
+			obj.warn("unknown material %q, using the default one", name)
+			obj.warned[name] = true
+		}
+		obj.materialName = name
+		obj.current = nil
+	case "mtllib":
+		// Names can't contain spaces here, as several libraries may be listed
+		for _, lib := range fields[1:] {
+			err := obj.loadMTL(filepath.Join(obj.dir, filepath.FromSlash(lib)))
+			if errors.Is(err, os.ErrNotExist) {
+				obj.warn("%v", err)
+			} else if err != nil {
+				return err
+			}
+		}
+	default:
+		// Smoothing groups, lines, curves and display attributes: nothing to render
+	}
+
+	return nil
+}
+
+// warn tells about something in the file that is rendered differently than
+// it asks for, but not so wrong the file can't be loaded
+func (obj *objFile) warn(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "%s:%d: warning: %s\n", obj.path, obj.line, fmt.Sprintf(format, args...))
+}
+
+// resolveIndex turns a 1 based (or negative, relative to the end) OBJ index
+// into a 0 based one
+func resolveIndex(s string, count int, what string) (int, error) {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s index %q", what, s)
+	}
+	if i < 0 {
+		i += count
+	} else {
+		i--
+	}
+	if i < 0 || i >= count {
+		return 0, fmt.Errorf("%s index %s out of range, there are %d", what, s, count)
+	}
+	return i, nil
+}
+
+func (obj *objFile) face(vertices []string) error {
+	if len(vertices) < 3 {
+		return fmt.Errorf("face needs at least 3 vertices, got %d", len(vertices))
+	}
+
+	g := obj.current
+	if g == nil {
+		g = &objGroup{material: obj.materialName, vertexIndex: map[[3]int]int{}}
+		obj.groups = append(obj.groups, g)
+		obj.current = g
+	}
+
+	local := make([]int, len(vertices))
+	for i, vertex := range vertices {
+		// v, v/vt, v//vn or v/vt/vn; -1 marks a missing vt/vn
+		key := [3]int{0, -1, -1}
+		parts := strings.Split(vertex, "/")
+		if len(parts) > 3 {
+			return fmt.Errorf("invalid face vertex %q", vertex)
+		}
+
+		var err error
+		if key[0], err = resolveIndex(parts[0], len(obj.positions), "vertex"); err != nil {
+			return err
+		}
+		if len(parts) > 1 && parts[1] != "" {
+			if key[1], err = resolveIndex(parts[1], len(obj.uvs), "texture coordinate"); err != nil {
+				return err
+			}
+		}
+		if len(parts) > 2 && parts[2] != "" {
+			if key[2], err = resolveIndex(parts[2], len(obj.normals), "normal"); err != nil {
+				return err
+			}
+		}
+
+		idx, ok := g.vertexIndex[key]
+		if !ok {
+			idx = len(g.positions)
+			g.vertexIndex[key] = idx
+			g.positions = append(g.positions, obj.positions[key[0]])
+
+			var uv [2]float64
+			if key[1] >= 0 {
+				uv = obj.uvs[key[1]]
+			} else {
+				g.missingUVs = true
+			}
+			g.uvs = append(g.uvs, uv)
+
+			var n Vec3
+			if key[2] >= 0 {
+				n = obj.normals[key[2]]
+			} else {
+				g.missingN = true
+			}
+			g.normals = append(g.normals, n)
+		}
+		local[i] = idx
+	}
+
+	// Polygons are triangulated as a fan around the first vertex
+	for i := 1; i+1 < len(local); i++ {
+		g.indices = append(g.indices, local[0], local[i], local[i+1])
+	}
+	return nil
+}
+
+func (obj *objFile) loadMTL(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	obj.files = append(obj.files, path)
+
+	dir := filepath.Dir(path)
+	var name string
+	var current *objMaterial
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] == "newmtl" {
+			if current != nil {
+				obj.materials[name] = *current
+			}
+			name = strings.Join(fields[1:], " ")
+			current = &objMaterial{kd: Color3{0.8, 0.8, 0.8}, ni: 1, d: 1, illum: 2}
+			continue
+		}
+		if current == nil {
+			return fmt.Errorf("%s:%d: %q before any newmtl", path, line, fields[0])
+		}
+
+		var values []float64
+		switch fields[0] {
+		case "Kd", "Ks", "Ke":
+			if values, err = parseFloats(fields[1:], 1, 3); err == nil {
+				c := Color3{values[0], values[0], values[0]}
+				if len(values) == 3 {
+					c = Color3{values[0], values[1], values[2]}
+				}
+				switch fields[0] {
+				case "Kd":
+					current.kd = c
+				case "Ks":
+					current.ks = c
+				case "Ke":
+					current.ke = c
+				}
+			}
+		case "Ns", "Ni", "d", "Tr":
+			if values, err = parseFloats(fields[1:], 1, 1); err == nil {
+				switch fields[0] {
+				case "Ns":
+					current.ns = values[0]
+				case "Ni":
+					current.ni = values[0]
+				case "d":
+					current.d = values[0]
+				case "Tr":
+					current.d = 1 - values[0]
+				}
+			}
+		case "illum":
+			if len(fields) != 2 {
+				err = fmt.Errorf("illum needs one value")
+			} else {
+				current.illum, err = strconv.Atoi(fields[1])
+			}
+		case "map_Kd":
+			if len(fields) < 2 {
+				err = fmt.Errorf("map_Kd needs a file name")
+			} else {
+				// Options (-s, -o, ...) come before the file name
+				file := filepath.FromSlash(strings.ReplaceAll(fields[len(fields)-1], "\\", "/"))
+				if !filepath.IsAbs(file) {
+					file = filepath.Join(dir, file)
+				}
+				current.mapKd = file
+			}
+		default:
+			// Ka, Tf, other maps, ...: not supported by our materials
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s:%d: %v", path, line, err)
+	}
+	if current != nil {
+		obj.materials[name] = *current
+	}
+	return nil
+}
+
+func maxComponent(c Color3) float64 {
+	return math.Max(c[0], math.Max(c[1], c[2]))
+}
+
+// toMaterial maps the MTL parameters onto the closest material we have:
+// emissive surfaces become lights, transparent ones glass, mirror-like ones
+// metal and everything else lambertian
+func (m objMaterial) toMaterial() (material, error) {
+	switch {
+	case maxComponent(m.ke) > 0:
+		return diffuseLight{solidColor{m.ke}}, nil
+	case m.d < 1 || m.illum == 4 || m.illum == 6 || m.illum == 7 || m.illum == 9:
+		ir := m.ni
+		if ir <= 1 {
+			ir = 1.5
+		}
+		return dielectric{ir}, nil
+	case m.illum == 3 || maxComponent(m.kd) == 0 && maxComponent(m.ks) > 0:
+		// Phong exponent to a rough fuzz radius: 0 is a mirror, 1 very rough
+		fuzz := Clamp(math.Sqrt(2/(m.ns+2)), 0, 1)
+		return metal{m.ks, fuzz}, nil
+	}
+
+	if m.mapKd != "" {
+		tex, err := loadImageTexture(m.mapKd)
+		if err != nil {
+			return nil, err
+		}
+		return lambertian{tex}, nil
+	}
+	return lambertian{solidColor{m.kd}}, nil
+}
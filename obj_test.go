@@ -0,0 +1,276 @@
+package main
+
+import (
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes files, by their path relative to a new directory, and
+// returns the directory
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadOBJ(t *testing.T) {
+	white := lambertian{solidColor{Color3{1, 1, 1}}}
+	tests := []struct {
+		name string
+		obj  string
+		// for every mesh: how many triangles, and if it has normals and uvs
+		triangles         []int
+		normals, uvs      []bool
+		indices           []int //of the first mesh, if not nil
+		positions         []Point3
+		firstNormal       Vec3
+		firstUV           [2]float64
+		checkFirstNormals bool
+	}{
+		{
+			name: "fan",
+			obj: `v 0 0 0
+v 1 0 0
+v 1 1 0
+v 0.5 1.5 0
+v 0 1 0
+f 1 2 3 4 5
+`,
+			triangles: []int{3}, normals: []bool{false}, uvs: []bool{false},
+			indices: []int{0, 1, 2, 0, 2, 3, 0, 3, 4},
+		},
+		{
+			name: "negative indices",
+			obj: `v 5 5 5
+v 0 0 0
+v 1 0 0
+v 0 1 0
+f -3 -2 -1
+`,
+			triangles: []int{1}, normals: []bool{false}, uvs: []bool{false},
+			indices:   []int{0, 1, 2},
+			positions: []Point3{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}},
+		},
+		{
+			name: "normals without uvs",
+			obj: `v 0 0 0
+v 1 0 0
+v 0 1 0
+vn 0 0 1
+f 1//1 2//1 3//1
+`,
+			triangles: []int{1}, normals: []bool{true}, uvs: []bool{false},
+			firstNormal: Vec3{0, 0, 1}, checkFirstNormals: true,
+		},
+		{
+			name: "uvs without normals",
+			obj: `v 0 0 0
+v 1 0 0
+v 0 1 0
+vt 0.25 0.75
+vt 1 0
+vt 0 1
+f 1/1 2/2 3/3
+`,
+			triangles: []int{1}, normals: []bool{false}, uvs: []bool{true},
+			firstUV: [2]float64{0.25, 0.75},
+		},
+		{
+			name: "objects and groups",
+			obj: `v 0 0 0
+v 1 0 0
+v 0 1 0
+v 1 1 0
+o first
+f 1 2 3
+f 2 4 3
+g second
+f 1 2 4
+o third
+f 1 2 3 4
+`,
+			triangles: []int{2, 1, 2}, normals: []bool{false, false, false}, uvs: []bool{false, false, false},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeFiles(t, map[string]string{"model.obj": test.obj})
+			meshes, _, err := loadOBJ(filepath.Join(dir, "model.obj"), white)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(meshes) != len(test.triangles) {
+				t.Fatalf("%d meshes, want %d", len(meshes), len(test.triangles))
+			}
+			for i, m := range meshes {
+				if n := len(m.indices) / 3; n != test.triangles[i] {
+					t.Errorf("mesh %d has %d triangles, want %d", i, n, test.triangles[i])
+				}
+				if (m.normals != nil) != test.normals[i] || (m.uvs != nil) != test.uvs[i] {
+					t.Errorf("mesh %d has normals %v and uvs %v, want %v and %v", i, m.normals != nil, m.uvs != nil, test.normals[i], test.uvs[i])
+				}
+				if m.mat != white {
+					t.Errorf("mesh %d has material %v, want the default one", i, m.mat)
+				}
+			}
+			m := meshes[0]
+			if test.indices != nil && !reflect.DeepEqual(m.indices, test.indices) {
+				t.Errorf("indices = %v, want %v", m.indices, test.indices)
+			}
+			if test.positions != nil && !reflect.DeepEqual(m.positions, test.positions) {
+				t.Errorf("positions = %v, want %v", m.positions, test.positions)
+			}
+			if test.checkFirstNormals && m.normals[0] != test.firstNormal {
+				t.Errorf("first normal = %v, want %v", m.normals[0], test.firstNormal)
+			}
+			if test.uvs[0] && m.uvs[0] != test.firstUV {
+				t.Errorf("first uv = %v, want %v", m.uvs[0], test.firstUV)
+			}
+		})
+	}
+}
+
+// Texture maps are found next to the MTL file, not the OBJ
+func TestLoadOBJMaterials(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"model.obj": `mtllib materials/model.mtl
+v 0 0 0
+v 1 0 0
+v 0 1 0
+vt 0 0
+usemtl red
+f 1 2 3
+usemtl earth
+f 1/1 2/1 3/1
+usemtl lamp
+f 3 2 1
+`,
+		"materials/model.mtl": `newmtl red
+Kd 1 0 0
+newmtl earth
+map_Kd textures/earth.png
+newmtl lamp
+Ke 4 4 4
+`,
+	})
+	textures := filepath.Join(dir, "materials", "textures")
+	if err := os.MkdirAll(textures, 0755); err != nil {
+		t.Fatal(err)
+	}
+	texture, err := os.Create(filepath.Join(textures, "earth.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(texture, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	texture.Close()
+
+	meshes, _, err := loadOBJ(filepath.Join(dir, "model.obj"), lambertian{solidColor{Color3{1, 1, 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meshes) != 3 {
+		t.Fatalf("%d meshes, want 3", len(meshes))
+	}
+	if want := (lambertian{solidColor{Color3{1, 0, 0}}}); meshes[0].mat != want {
+		t.Errorf("red is %v, want %v", meshes[0].mat, want)
+	}
+	if lamb, ok := meshes[1].mat.(lambertian); !ok {
+		t.Errorf("earth is %v, want a lambertian", meshes[1].mat)
+	} else if _, ok := lamb.albedo.(imageTexture); !ok {
+		t.Errorf("earth's albedo is %v, want an image texture", lamb.albedo)
+	}
+	if want := (diffuseLight{solidColor{Color3{4, 4, 4}}}); meshes[2].mat != want {
+		t.Errorf("lamp is %v, want %v", meshes[2].mat, want)
+	}
+}
+
+func TestLoadOBJErrors(t *testing.T) {
+	const triangle = "v 0 0 0\nv 1 0 0\nv 0 1 0\n"
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string //with the directory as {dir}
+	}{
+		{"bad number", map[string]string{"model.obj": "v 0 0 0\nv 1 zero 0\n"},
+			`{dir}/model.obj:2: invalid number "zero"`},
+		{"too few numbers", map[string]string{"model.obj": "# a comment\n\nvn 0 1\n"},
+			`{dir}/model.obj:3: expected 3 to 3 numbers, got 2`},
+		{"index out of range", map[string]string{"model.obj": triangle + "f 1 2 4\n"},
+			`{dir}/model.obj:4: vertex index 4 out of range, there are 3`},
+		{"negative index out of range", map[string]string{"model.obj": triangle + "f -1 -2 -4\n"},
+			`{dir}/model.obj:4: vertex index -4 out of range, there are 3`},
+		{"normal out of range", map[string]string{"model.obj": triangle + "vn 0 0 1\nf 1//1 2//2 3//1\n"},
+			`{dir}/model.obj:5: normal index 2 out of range, there are 1`},
+		{"two vertices", map[string]string{"model.obj": triangle + "f 1 2\n"},
+			`{dir}/model.obj:4: face needs at least 3 vertices, got 2`},
+		{"bad vertex", map[string]string{"model.obj": triangle + "f 1/1/1/1 2 3\n"},
+			`{dir}/model.obj:4: invalid face vertex "1/1/1/1"`},
+		{"no faces", map[string]string{"model.obj": triangle},
+			`{dir}/model.obj: no faces found`},
+		{"bad mtl", map[string]string{"model.obj": "mtllib model.mtl\n" + triangle, "model.mtl": "newmtl red\nKd 1 0 0 0\n"},
+			`{dir}/model.obj:1: {dir}/model.mtl:2: expected 1 to 3 numbers, got 4`},
+		{"mtl without newmtl", map[string]string{"model.obj": "mtllib model.mtl\n" + triangle, "model.mtl": "# red\nKd 1 0 0\n"},
+			`{dir}/model.obj:1: {dir}/model.mtl:2: "Kd" before any newmtl`},
+		{"missing texture", map[string]string{"model.obj": "mtllib model.mtl\nusemtl wood\n" + triangle + "f 1 2 3\n", "model.mtl": "newmtl wood\nmap_Kd wood.png\n"},
+			`could not open file: {dir}/wood.png`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeFiles(t, test.files)
+			_, _, err := loadOBJ(filepath.Join(dir, "model.obj"), nil)
+			if err == nil {
+				t.Fatal("loaded a broken file")
+			}
+			if want := strings.ReplaceAll(test.want, "{dir}/", dir+string(filepath.Separator)); err.Error() != want {
+				t.Errorf("error = %q, want %q", err, want)
+			}
+		})
+	}
+}
+
+// Materials that aren't in any library, or whose library is missing, are the
+// default one
+func TestLoadOBJUnknownMaterials(t *testing.T) {
+	const faces = "v 0 0 0\nv 1 0 0\nv 0 1 0\nusemtl None\nf 1 2 3\nusemtl red\nf 3 2 1\n"
+	white := lambertian{solidColor{Color3{1, 1, 1}}}
+	tests := []struct {
+		name  string
+		files map[string]string
+	}{
+		{"no library", map[string]string{"model.obj": faces}},
+		{"missing library", map[string]string{"model.obj": "mtllib lost.mtl\n" + faces}},
+		{"not in the library", map[string]string{"model.obj": "mtllib model.mtl\n" + faces, "model.mtl": "newmtl blue\nKd 0 0 1\n"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeFiles(t, test.files)
+			meshes, _, err := loadOBJ(filepath.Join(dir, "model.obj"), white)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(meshes) != 2 {
+				t.Fatalf("%d meshes, want 2", len(meshes))
+			}
+			for i, m := range meshes {
+				if m.mat != white {
+					t.Errorf("mesh %d has material %v, want the default one", i, m.mat)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+// imageFormats are the extensions of the files images can be saved as
+var imageFormats = []string{".png", ".hdr", ".pfm", ".exr"}
+
+func knownImageFormat(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, f := range imageFormats {
+		if ext == f {
+			return true
+		}
+	}
+	return false
+}
+
+// exrFormat is how OpenEXR files are written: half (16 bit) or 32 bit
+// floats, and ZIP compressed or not
+type exrFormat struct {
+	half bool
+	zip  bool
+}
+
+// linearImage is the light that reached every pixel, as the film and the
+// splats add up to, before gamma correction or clamping, row 0 at the bottom
+type linearImage struct {
+	width, height int
+	pixels        []Color3
+	sampled       []bool //if the pixel got any samples at all
+}
+
+func developFilm(pixels *film, splats *splatFilm) *linearImage {
+	img := &linearImage{pixels.width, pixels.height, make([]Color3, pixels.width*pixels.height), make([]bool, pixels.width*pixels.height)}
+	// Every sample may splat light anywhere, so splats are averaged over the
+	// samples of the whole image
+	meanSamples := float64(pixels.totalSamples()) / float64(pixels.width*pixels.height)
+	for y := 0; y < pixels.height; y++ {
+		for x := 0; x < pixels.width; x++ {
+			if _, samples := pixels.at(x, y); samples == 0 {
+				continue
+			}
+			c := pixels.color(x, y).Add(splats.at(x, y).Div(meanSamples))
+			for i := range c {
+				if math.IsNaN(c[i]) {
+					c[i] = 0
+				}
+			}
+			img.pixels[y*img.width+x] = c
+			img.sampled[y*img.width+x] = true
+		}
+	}
+	return img
+}
+
+// writeImage saves what is on the film in the format the extension of path
+// asks for
+func writeImage(path string, pixels *film, splats *splatFilm, exr exrFormat) error {
+	img := developFilm(pixels, splats)
+	var write func(w io.Writer) error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png":
+		write = img.writePNG
+	case ".hdr":
+		write = img.writeRadianceHDR
+	case ".pfm":
+		write = img.writePFM
+	case ".exr":
+		write = func(w io.Writer) error { return img.writeEXR(w, exr) }
+	default:
+		return fmt.Errorf("%s: unknown image format, expected one of %s", path, strings.Join(imageFormats, ", "))
+	}
+	return writeFileAtomic(path, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		if err := write(bw); err != nil {
+			return err
+		}
+		return bw.Flush()
+	})
+}
+
+// writePNG writes the image gamma corrected and clamped to 8 bits
+func (img *linearImage) writePNG(w io.Writer) error {
+	out := image.NewRGBA(image.Rect(0, 0, img.width, img.height))
+	for row := 0; row < img.height; row++ {
+		for x := 0; x < img.width; x++ {
+			if !img.sampled[row*img.width+x] {
+				continue
+			}
+			// Colors are defined by Red, Green, Blue, Alpha uint8 values.
+			out.Set(x, img.height-1-row, Color3ToRGBA(img.pixels[row*img.width+x], 1))
+		}
+	}
+	return png.Encode(w, out)
+}
+
+// writeRadianceHDR writes a Radiance picture: a text header, then every
+// pixel as an 8 bit mantissa for each color and a shared exponent (RGBE),
+// top row first. Scanlines are left uncompressed, which readers accept.
+func (img *linearImage) writeRadianceHDR(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "#?RADIANCE\nFORMAT=32-bit_rle_rgbe\n\n-Y %d +X %d\n", img.height, img.width); err != nil {
+		return err
+	}
+	line := make([]byte, 4*img.width)
+	for row := img.height - 1; row >= 0; row-- {
+		for x := 0; x < img.width; x++ {
+			copy(line[4*x:], rgbe(img.pixels[row*img.width+x]))
+		}
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rgbe encodes a color as three mantissas sharing the exponent of the
+// brightest one. Negative colors can't be encoded and are black.
+func rgbe(c Color3) []byte {
+	r, g, b := math.Max(c[0], 0), math.Max(c[1], 0), math.Max(c[2], 0)
+	brightest := math.Max(r, math.Max(g, b))
+	if brightest < 1e-32 {
+		return []byte{0, 0, 0, 0}
+	}
+	if math.IsInf(brightest, 1) || brightest >= math.Ldexp(1, 127) {
+		return []byte{255, 255, 255, 255}
+	}
+	mantissa, exponent := math.Frexp(brightest)
+	scale := mantissa * 256 / brightest
+	return []byte{byte(r * scale), byte(g * scale), byte(b * scale), byte(exponent + 128)}
+}
+
+// writePFM writes a portable float map: a text header, then the red, green
+// and blue of every pixel as little endian 32 bit floats, bottom row first
+// (the negative scale says little endian)
+func (img *linearImage) writePFM(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "PF\n%d %d\n-1.0\n", img.width, img.height); err != nil {
+		return err
+	}
+	line := make([]byte, 12*img.width)
+	for row := 0; row < img.height; row++ {
+		for x := 0; x < img.width; x++ {
+			for i, v := range img.pixels[row*img.width+x] {
+				binary.LittleEndian.PutUint32(line[12*x+4*i:], math.Float32bits(float32(v)))
+			}
+		}
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenEXR pixel types and compressions
+const (
+	exrHalf        = 1
+	exrFloat       = 2
+	exrNoCompress  = 0
+	exrZipCompress = 3 //zlib, 16 scanlines at a time
+)
+
+// writeEXR writes a single part scanline OpenEXR file with R, G and B
+// channels, top row first
+func (img *linearImage) writeEXR(w io.Writer, format exrFormat) error {
+	pixelType, bytesPerValue := int32(exrFloat), 4
+	if format.half {
+		pixelType, bytesPerValue = exrHalf, 2
+	}
+	compression, linesPerChunk := byte(exrNoCompress), 1
+	if format.zip {
+		compression, linesPerChunk = exrZipCompress, 16
+	}
+
+	var header bytes.Buffer
+	header.Write([]byte{0x76, 0x2f, 0x31, 0x01}) //magic
+	header.Write([]byte{2, 0, 0, 0})             //version 2, single part scanlines
+	var channels bytes.Buffer
+	// Channels are in alphabetical order, in the header and in the pixels
+	for _, name := range []string{"B", "G", "R"} {
+		channels.WriteString(name + "\x00")
+		binary.Write(&channels, binary.LittleEndian, []int32{pixelType, 0, 1, 1}) //type, linear and reserved, sampling
+	}
+	channels.WriteByte(0)
+	window := []int32{0, 0, int32(img.width - 1), int32(img.height - 1)}
+	exrAttribute(&header, "channels", "chlist", channels.Bytes())
+	exrAttribute(&header, "compression", "compression", []byte{compression})
+	exrAttribute(&header, "dataWindow", "box2i", window)
+	exrAttribute(&header, "displayWindow", "box2i", window)
+	exrAttribute(&header, "lineOrder", "lineOrder", []byte{0}) //increasing y
+	exrAttribute(&header, "pixelAspectRatio", "float", float32(1))
+	exrAttribute(&header, "screenWindowCenter", "v2f", []float32{0, 0})
+	exrAttribute(&header, "screenWindowWidth", "float", float32(1))
+	header.WriteByte(0)
+
+	// The chunks go after the table of where each of them starts
+	var chunks bytes.Buffer
+	chunkCount := (img.height + linesPerChunk - 1) / linesPerChunk
+	offsets := make([]uint64, chunkCount)
+	tableEnd := uint64(header.Len() + 8*chunkCount)
+	raw := make([]byte, 0, 3*bytesPerValue*img.width*linesPerChunk)
+	for chunk := 0; chunk < chunkCount; chunk++ {
+		y0 := chunk * linesPerChunk
+		y1 := y0 + linesPerChunk
+		if y1 > img.height {
+			y1 = img.height
+		}
+		raw = raw[:0]
+		for y := y0; y < y1; y++ {
+			row := img.height - 1 - y
+			for _, channel := range []int{2, 1, 0} {
+				for x := 0; x < img.width; x++ {
+					v := img.pixels[row*img.width+x][channel]
+					if format.half {
+						raw = binary.LittleEndian.AppendUint16(raw, halfBits(v))
+					} else {
+						raw = binary.LittleEndian.AppendUint32(raw, math.Float32bits(float32(v)))
+					}
+				}
+			}
+		}
+		data := raw
+		if format.zip {
+			data = exrZip(raw)
+		}
+		offsets[chunk] = tableEnd + uint64(chunks.Len())
+		binary.Write(&chunks, binary.LittleEndian, []int32{int32(y0), int32(len(data))})
+		chunks.Write(data)
+	}
+
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, offsets); err != nil {
+		return err
+	}
+	_, err := w.Write(chunks.Bytes())
+	return err
+}
+
+// exrAttribute writes a header attribute: its name, its type, its size and
+// its value
+func exrAttribute(header *bytes.Buffer, name string, typ string, value interface{}) {
+	header.WriteString(name + "\x00" + typ + "\x00")
+	binary.Write(header, binary.LittleEndian, int32(binary.Size(value)))
+	binary.Write(header, binary.LittleEndian, value)
+}
+
+// exrZip compresses scanlines the way OpenEXR's ZIP compression does: the
+// bytes are split into the even and the odd ones, each is stored as its
+// difference from the one before, and the result goes through zlib. Data
+// that doesn't get smaller is stored as it is, which readers tell by its size.
+func exrZip(raw []byte) []byte {
+	split := make([]byte, len(raw))
+	half := (len(raw) + 1) / 2
+	for i, b := range raw {
+		if i%2 == 0 {
+			split[i/2] = b
+		} else {
+			split[half+i/2] = b
+		}
+	}
+	for i := len(split) - 1; i > 0; i-- {
+		split[i] = split[i] - split[i-1] + 128
+	}
+
+	var out bytes.Buffer
+	zw := zlib.NewWriter(&out)
+	zw.Write(split)
+	zw.Close()
+	if out.Len() >= len(raw) {
+		return raw
+	}
+	return out.Bytes()
+}
+
+// halfBits is v as an IEEE 754 half precision float, rounded to the nearest
+// one. Values too big for a half are infinite.
+func halfBits(v float64) uint16 {
+	bits := math.Float32bits(float32(v))
+	sign := uint16(bits>>16) & 0x8000
+	exponent := int(bits>>23&0xff) - 127 + 15
+	mantissa := bits & 0x7fffff
+
+	switch {
+	case bits&0x7fffffff > 0x7f800000: //NaN
+		return sign | 0x7e00
+	case exponent >= 0x1f: //too big, or infinite
+		return sign | 0x7c00
+	case exponent <= 0:
+		// A subnormal half, or zero
+		if exponent < -10 {
+			return sign
+		}
+		mantissa |= 0x800000
+		shift := uint(14 - exponent)
+		h := mantissa >> shift
+		// Round half to even
+		rest := mantissa & (1<<shift - 1)
+		halfway := uint32(1) << (shift - 1)
+		if rest > halfway || (rest == halfway && h&1 == 1) {
+			h++
+		}
+		return sign | uint16(h)
+	}
+	h := uint32(exponent)<<10 | mantissa>>13
+	rest := mantissa & 0x1fff
+	if rest > 0x1000 || (rest == 0x1000 && h&1 == 1) {
+		// Carrying into the exponent rounds up to the next power of two, or
+		// to infinity
+		h++
+	}
+	return sign | uint16(h)
+}
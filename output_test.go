@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"image/png"
+	"io"
+	"math"
+	"testing"
+)
+
+// Every pixel is in the PNG, row 0 at the bottom
+func TestWritePNG(t *testing.T) {
+	img := &linearImage{3, 2, make([]Color3, 6), make([]bool, 6)}
+	for i := range img.pixels {
+		img.sampled[i] = true
+	}
+	img.pixels[2] = Color3{1, 0, 0}    //bottom right
+	img.pixels[3] = Color3{0, 0, 1}    //top left
+	img.pixels[5] = Color3{0.25, 0, 0} //top right, gamma corrected to 0.5
+
+	var buf bytes.Buffer
+	if err := img.writePNG(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := out.Bounds(); b.Dx() != 3 || b.Dy() != 2 {
+		t.Fatalf("image is %dx%d, want 3x2", b.Dx(), b.Dy())
+	}
+	tests := []struct {
+		x, y    int
+		r, g, b uint32
+	}{
+		{0, 0, 0, 0, 255},
+		{2, 0, 128, 0, 0},
+		{2, 1, 255, 0, 0},
+		{0, 1, 0, 0, 0},
+	}
+	for _, test := range tests {
+		r, g, b, a := out.At(test.x, test.y).RGBA()
+		if r>>8 != test.r || g>>8 != test.g || b>>8 != test.b || a>>8 != 255 {
+			t.Errorf("pixel %d, %d is %v, want %d %d %d", test.x, test.y, out.At(test.x, test.y), test.r, test.g, test.b)
+		}
+	}
+}
+
+// halfToFloat is what a reader makes of a half
+func halfToFloat(h uint16) float64 {
+	sign := 1.0
+	if h&0x8000 != 0 {
+		sign = -1
+	}
+	exponent := int(h >> 10 & 0x1f)
+	mantissa := float64(h & 0x3ff)
+	switch exponent {
+	case 0:
+		return sign * math.Ldexp(mantissa, -24)
+	case 0x1f:
+		if mantissa != 0 {
+			return math.NaN()
+		}
+		return math.Inf(int(sign))
+	}
+	return sign * math.Ldexp(1+mantissa/1024, exponent-15)
+}
+
+func TestHalfBits(t *testing.T) {
+	tests := []struct {
+		v    float64
+		want uint16
+	}{
+		{0, 0},
+		{math.Copysign(0, -1), 0x8000},
+		{1, 0x3c00},
+		{-2, 0xc000},
+		{0.333251953125, 0x3555},
+		{65504, 0x7bff},                  //the biggest half
+		{65519, 0x7bff},                  //rounds down to it
+		{65520, 0x7c00},                  //rounds up to infinity
+		{1e6, 0x7c00},                    //too big
+		{math.Inf(-1), 0xfc00},           //infinite
+		{math.NaN(), 0x7e00},             //not a number
+		{math.Ldexp(1, -14), 0x0400},     //the smallest normal half
+		{math.Ldexp(1, -24), 0x0001},     //the smallest subnormal
+		{math.Ldexp(1, -25), 0},          //half way to it, rounds to even
+		{math.Ldexp(1.5, -25), 0x0001},   //past half way
+		{math.Ldexp(3, -25), 0x0002},     //half way between 1 and 2, rounds to even
+		{math.Ldexp(1, -30), 0},          //too small
+		{1 + math.Ldexp(1, -11), 0x3c00}, //half way between 1 and the next, rounds to even
+		{1 + math.Ldexp(3, -11), 0x3c02}, //half way between the next two, rounds to even
+		{math.Ldexp(2047, -25), 0x0400},  //the biggest subnormal rounds up to a normal
+	}
+	for _, test := range tests {
+		if got := halfBits(test.v); got != test.want {
+			t.Errorf("halfBits(%v) = %#04x, want %#04x", test.v, got, test.want)
+		}
+	}
+
+	// Every half is written as itself
+	for h := 0; h < 1<<16; h++ {
+		v := halfToFloat(uint16(h))
+		if math.IsNaN(v) {
+			continue
+		}
+		if got := halfBits(v); got != uint16(h) {
+			t.Errorf("halfBits(%v) = %#04x, want %#04x", v, got, h)
+		}
+	}
+}
+
+func TestRGBE(t *testing.T) {
+	tests := []struct {
+		c    Color3
+		want [4]byte
+	}{
+		{Color3{0, 0, 0}, [4]byte{0, 0, 0, 0}},
+		{Color3{1e-40, 0, 0}, [4]byte{0, 0, 0, 0}},
+		{Color3{1, 1, 1}, [4]byte{128, 128, 128, 129}},
+		{Color3{0.5, 0.25, 0}, [4]byte{128, 64, 0, 128}},
+		{Color3{-1, 3, 0.75}, [4]byte{0, 192, 48, 130}},
+		{Color3{math.Inf(1), 0, 0}, [4]byte{255, 255, 255, 255}},
+	}
+	for _, test := range tests {
+		if got := rgbe(test.c); !bytes.Equal(got, test.want[:]) {
+			t.Errorf("rgbe(%v) = %v, want %v", test.c, got, test.want)
+		}
+	}
+
+	// Readers get every channel back within a mantissa step of the brightest
+	rnd := newStream(1)
+	for i := 0; i < 1000; i++ {
+		c := RandomRangeVec3(0, 1, rnd).Mult(math.Pow(10, RandomDoubleRange(-10, 10, rnd)))
+		e := rgbe(c)
+		scale := math.Ldexp(1, int(e[3])-128-8)
+		brightest := math.Max(c[0], math.Max(c[1], c[2]))
+		for j := 0; j < 3; j++ {
+			if back := (float64(e[j]) + 0.5) * scale; math.Abs(back-c[j]) > brightest/128 {
+				t.Errorf("%v is read back with channel %d %v", c, j, back)
+			}
+		}
+	}
+}
+
+// exrUnzip undoes exrZip the way OpenEXR readers do
+func exrUnzip(data []byte, size int) ([]byte, error) {
+	if len(data) == size {
+		return data, nil
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	split, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(split); i++ {
+		split[i] = split[i-1] + split[i] - 128
+	}
+	raw := make([]byte, len(split))
+	half := (len(split) + 1) / 2
+	for i := range raw {
+		if i%2 == 0 {
+			raw[i] = split[i/2]
+		} else {
+			raw[i] = split[half+i/2]
+		}
+	}
+	return raw, nil
+}
+
+func TestExrZip(t *testing.T) {
+	// What goes into zlib: the even bytes then the odd ones, each as its
+	// difference from the one before plus 128
+	raw := bytes.Repeat([]byte{1, 2, 3, 4, 5}, 20)
+	zr, err := zlib.NewReader(bytes.NewReader(exrZip(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	predicted, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{1, 130, 130, 125, 130}; !bytes.Equal(predicted[:5], want) {
+		t.Errorf("the first bytes given to zlib are %v, want %v", predicted[:5], want)
+	}
+	if len(predicted) != len(raw) {
+		t.Errorf("zlib was given %d bytes, want %d", len(predicted), len(raw))
+	}
+
+	rnd := newStream(1)
+	noise := make([]byte, 1000)
+	for i := range noise {
+		noise[i] = byte(randomInt(rnd, 256))
+	}
+	tests := []struct {
+		name       string
+		raw        []byte
+		compressed bool
+	}{
+		{"pattern", raw, true},
+		{"odd length", bytes.Repeat([]byte{7, 0, 7}, 101), true},
+		{"noise", noise, false},
+		{"one byte", []byte{42}, false},
+	}
+	for _, test := range tests {
+		data := exrZip(test.raw)
+		if compressed := len(data) < len(test.raw); compressed != test.compressed {
+			t.Errorf("%s: compressed %v, want %v", test.name, compressed, test.compressed)
+		}
+		back, err := exrUnzip(data, len(test.raw))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(back, test.raw) {
+			t.Errorf("%s: read back as %v, want %v", test.name, back, test.raw)
+		}
+	}
+}
@@ -2,12 +2,11 @@ package main
 
 import (
 	"math"
-	"math/rand"
 )
 
 type pdf interface {
 	value(direction Vec3) float64
-	generate(rnd *rand.Rand) Vec3
+	generate(rnd sampler) Vec3
 }
 
 type cosinePdf struct {
@@ -26,7 +25,7 @@ func (pdf cosinePdf) value(direction Vec3) float64 {
 	return cosine / math.Pi
 }
 
-func (pdf cosinePdf) generate(rnd *rand.Rand) Vec3 {
+func (pdf cosinePdf) generate(rnd sampler) Vec3 {
 	return pdf.uvw.local(RandomCosineDirection(rnd))
 }
 
@@ -39,7 +38,7 @@ func (pdf hittablePdf) value(direction Vec3) float64 {
 	return pdf.obj.pdfValue(pdf.o, direction)
 }
 
-func (pdf hittablePdf) generate(rnd *rand.Rand) Vec3 {
+func (pdf hittablePdf) generate(rnd sampler) Vec3 {
 	return pdf.obj.random(pdf.o, rnd)
 }
 
@@ -51,7 +50,7 @@ func (pdf mixturePdf) value(direction Vec3) float64 {
 	return 0.5*pdf.p[0].value(direction) + 0.5*pdf.p[1].value(direction)
 }
 
-func (pdf mixturePdf) generate(rnd *rand.Rand) Vec3 {
+func (pdf mixturePdf) generate(rnd sampler) Vec3 {
 	if RandomDouble(rnd) < 0.5 {
 		return pdf.p[0].generate(rnd)
 	}
@@ -68,6 +67,6 @@ func (pdf spherePdf) value(direction Vec3) float64 {
 	return 1.0 / (4.0 * math.Pi)
 }
 
-func (pdf spherePdf) generate(rnd *rand.Rand) Vec3 {
+func (pdf spherePdf) generate(rnd sampler) Vec3 {
 	return RandomUnitVector(rnd)
 }
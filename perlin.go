@@ -2,7 +2,6 @@ package main
 
 import (
 	"math"
-	"math/rand"
 )
 
 type perlin struct {
@@ -13,18 +12,18 @@ type perlin struct {
 	permZ      []int
 }
 
-func newPerlin() perlin {
+func newPerlin(rnd sampler) perlin {
 	var p perlin
 	p.pointCount = 256
 
 	p.ranVec = make([]Vec3, 256)
 	for i := 0; i < p.pointCount; i++ {
-		p.ranVec[i] = Vec3{rand.Float64()*2 - 1, rand.Float64()*2 - 1, rand.Float64()*2 - 1}.Normalize()
+		p.ranVec[i] = Vec3{RandomDouble(rnd)*2 - 1, RandomDouble(rnd)*2 - 1, RandomDouble(rnd)*2 - 1}.Normalize()
 	}
 
-	p.permX = p.perlinGeneratePerm()
-	p.permY = p.perlinGeneratePerm()
-	p.permZ = p.perlinGeneratePerm()
+	p.permX = p.perlinGeneratePerm(rnd)
+	p.permY = p.perlinGeneratePerm(rnd)
+	p.permZ = p.perlinGeneratePerm(rnd)
 
 	return p
 }
@@ -59,14 +58,14 @@ func (p perlin) noise(point Point3) float64 {
 	return perlinInterp(c, u, v, w)
 }
 
-func (p perlin) perlinGeneratePerm() []int {
+func (p perlin) perlinGeneratePerm(rnd sampler) []int {
 	points := make([]int, p.pointCount)
 
 	for i := 0; i < p.pointCount; i++ {
 		points[i] = i
 	}
 
-	permute(points, p.pointCount)
+	permute(points, p.pointCount, rnd)
 
 	return points
 }
@@ -85,9 +84,9 @@ func (p perlin) turb(point Point3, depth int) float64 {
 	return math.Abs(accum)
 }
 
-func permute(p []int, n int) {
+func permute(p []int, n int, rnd sampler) {
 	for i := n - 1; i > 0; i-- {
-		target := rand.Intn(i + 1)
+		target := randomInt(rnd, i+1)
 		p[i], p[target] = p[target], p[i]
 	}
 }
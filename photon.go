@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// photon is light that arrived at a diffuse surface from the lights
+type photon struct {
+	p     Point3
+	dir   Vec3 //direction it was travelling in, normalized
+	power Color3
+}
+
+// photonMap is a kd-tree of photons kept in a slice: the middle photon of
+// every range splits the rest of the range along axes[middle]
+type photonMap struct {
+	photons []photon
+	axes    []int8
+}
+
+func newPhotonMap(photons []photon) *photonMap {
+	m := &photonMap{photons, make([]int8, len(photons))}
+	m.build(0, len(photons))
+	return m
+}
+
+func (m *photonMap) build(start int, end int) {
+	if end-start <= 1 {
+		return
+	}
+	box := aabb{m.photons[start].p, m.photons[start].p}
+	for _, ph := range m.photons[start+1 : end] {
+		box = surroundingBox(box, aabb{ph.p, ph.p})
+	}
+	axis := 0
+	extent := box.maximum.Sub(box.minimum)
+	if extent[1] > extent[axis] {
+		axis = 1
+	}
+	if extent[2] > extent[axis] {
+		axis = 2
+	}
+
+	mid := (start + end) / 2
+	m.selectNth(start, end, mid, axis)
+	m.axes[mid] = int8(axis)
+	m.build(start, mid)
+	m.build(mid+1, end)
+}
+
+// selectNth reorders photons[start:end] so the one at n is where it would be
+// if they were sorted along axis, with none bigger before it and none
+// smaller after
+func (m *photonMap) selectNth(start int, end int, n int, axis int) {
+	ph := m.photons
+	for end-start > 1 {
+		pivot := ph[(start+end)/2].p[axis]
+		i, j := start, end-1
+		for i <= j {
+			for ph[i].p[axis] < pivot {
+				i++
+			}
+			for ph[j].p[axis] > pivot {
+				j--
+			}
+			if i <= j {
+				ph[i], ph[j] = ph[j], ph[i]
+				i++
+				j--
+			}
+		}
+		switch {
+		case n <= j:
+			end = j + 1
+		case n >= i:
+			start = i
+		default:
+			return
+		}
+	}
+}
+
+// lookup calls f for every photon closer to p than radius
+func (m *photonMap) lookup(p Point3, radius float64, f func(ph *photon)) {
+	m.lookupRange(0, len(m.photons), p, radius*radius, f)
+}
+
+func (m *photonMap) lookupRange(start int, end int, p Point3, radiusSquared float64, f func(ph *photon)) {
+	if start >= end {
+		return
+	}
+	mid := (start + end) / 2
+	ph := &m.photons[mid]
+	if ph.p.Sub(p).LengthSquared() <= radiusSquared {
+		f(ph)
+	}
+	if end-start == 1 {
+		return
+	}
+
+	d := p[m.axes[mid]] - ph.p[m.axes[mid]]
+	if d < 0 {
+		m.lookupRange(start, mid, p, radiusSquared, f)
+		if d*d <= radiusSquared {
+			m.lookupRange(mid+1, end, p, radiusSquared, f)
+		}
+	} else {
+		m.lookupRange(mid+1, end, p, radiusSquared, f)
+		if d*d <= radiusSquared {
+			m.lookupRange(start, mid, p, radiusSquared, f)
+		}
+	}
+}
+
+// photonIntegrator renders with a photon map. Photons are shot from the
+// emitters and left wherever they land on a diffuse surface after bouncing
+// at least once. Camera paths follow specular bounces and media up to the
+// first diffuse surface, which is lit directly by sampling the lights and
+// indirectly by the photons around it (density estimation). Caustics come
+// from the photons that went through glass and mirrors, which camera paths
+// can't find.
+//
+// The map is made once, so its error is the same blur on every sample: more
+// samples per pixel don't make it go away, more photons and a smaller radius
+// do. See sppmIntegrator for one that converges.
+type photonIntegrator struct {
+	*renderScene
+	emitters *lightSurfaces
+	radius   float64
+	photons  *photonMap
+}
+
+func newPhotonIntegrator(scene *renderScene) (integrator, error) {
+	in, err := newPhotonMapper(scene)
+	if err != nil {
+		return nil, err
+	}
+	in.photons = in.tracePhotons(scene.opts.photons, 0)
+	return in, nil
+}
+
+func newPhotonMapper(scene *renderScene) (*photonIntegrator, error) {
+	emitters, err := newLightSurfaces(scene.world)
+	if err != nil {
+		return nil, fmt.Errorf("photon mapping: %v", err)
+	}
+	radius := scene.opts.photonRadius
+	if radius <= 0 {
+		radius = defaultPhotonRadius(scene.world, scene.cam)
+	}
+	return &photonIntegrator{scene, emitters, radius, newPhotonMap(nil)}, nil
+}
+
+// defaultPhotonRadius is a hundredth of the size of the scene
+func defaultPhotonRadius(world hittable, cam *camera) float64 {
+	box, ok := world.boundingBox(cam.time0, cam.time1)
+	if !ok {
+		return 1
+	}
+	diagonal := box.maximum.Sub(box.minimum).Length()
+	if diagonal <= 0 || math.IsInf(diagonal, 0) || math.IsNaN(diagonal) {
+		return 1
+	}
+	return diagonal / 100
+}
+
+// tracePhotons shoots count photons from the lights for the given pass and
+// maps the ones that land on diffuse surfaces. Every photon carries its
+// share of the power of the lights.
+func (in *photonIntegrator) tracePhotons(count int, pass int) *photonMap {
+	found := make([][]photon, chunkCount(count))
+	parallelChunks(count, true, func(chunk int, start int, end int) {
+		chunkRnd := newStream(in.seed, photonStream, pass, chunk)
+		for i := start; i < end; i++ {
+			found[chunk] = in.tracePhoton(found[chunk], count, chunkRnd)
+		}
+	})
+
+	var photons []photon
+	for _, f := range found {
+		photons = append(photons, f...)
+	}
+	return newPhotonMap(photons)
+}
+
+// tracePhoton shoots one of count photons and appends where it lands to photons
+func (in *photonIntegrator) tracePhoton(photons []photon, count int, rnd sampler) []photon {
+	time := in.cam.time0 + RandomDouble(rnd)*(in.cam.time1-in.cam.time0)
+	p, normal, emitted, ok := in.emitters.sample(time, rnd)
+	if !ok || emitted == (Color3{}) {
+		return photons
+	}
+	dir, pdfDir := emitDirection(normal, rnd)
+	if pdfDir <= 0 {
+		return photons
+	}
+	power := emitted.Mult(math.Abs(normal.Dot(dir.Normalize())) / (in.emitters.pdfArea() * pdfDir * float64(count)))
+
+	current := ray{p, dir, time}
+	for bounces := 0; bounces < in.opts.maxDepth; bounces++ {
+		rec, hit := in.world.hit(&current, 0.001, infinity, rnd)
+		if !hit {
+			break
+		}
+		sRec, scatter := rec.mat.scatter(&current, rec, rnd)
+		if !scatter {
+			break
+		}
+		// Light straight from the lights is sampled at the camera's end
+		_, medium := rec.mat.(isotropic)
+		if !sRec.isSpecular && !medium && bounces > 0 {
+			photons = append(photons, photon{rec.p, current.direction.Normalize(), power})
+		}
+
+		var next ray
+		var nextPower Color3
+		if sRec.isSpecular {
+			next = sRec.specularRay
+			next.time = time
+			nextPower = power.MultEach(sRec.attenuation)
+		} else {
+			next = ray{rec.p, sRec.pdf.generate(rnd), time}
+			pdf := sRec.pdf.value(next.direction)
+			if pdf <= 0 {
+				break
+			}
+			nextPower = power.MultEach(sRec.attenuation).Mult(rec.mat.scatteringPdf(&current, rec, &next) / pdf)
+		}
+
+		// Russian roulette on what the bounce absorbed keeps the power of
+		// the photons that go on the same
+		survival := math.Min(1, maxComponent(nextPower)/maxComponent(power))
+		if survival <= 0 || RandomDouble(rnd) >= survival {
+			break
+		}
+		power = nextPower.Div(survival)
+		current = next
+	}
+	return photons
+}
+
+func (in *photonIntegrator) rayColor(r *ray, rnd sampler) Color3 {
+	color := Color3{0, 0, 0}
+	throughput := Color3{1, 1, 1}
+	current := *r
+
+	for depth := 0; depth < in.opts.maxDepth; depth++ {
+		rec, hit := in.world.hit(&current, 0.001, infinity, rnd)
+		if !hit {
+			color = color.Add(throughput.MultEach(in.opts.background))
+			break
+		}
+		// Only reached through specular bounces and media, where the
+		// lights aren't sampled
+		color = color.Add(throughput.MultEach(rec.mat.emitted(&current, rec, rec.u, rec.v, rec.p)))
+
+		sRec, scatter := rec.mat.scatter(&current, rec, rnd)
+		if !scatter {
+			break
+		}
+		if sRec.isSpecular {
+			throughput = throughput.MultEach(sRec.attenuation)
+			current = sRec.specularRay
+			current.time = r.time
+			continue
+		}
+		if _, medium := rec.mat.(isotropic); medium {
+			// No photons are kept in media, the path goes on through them
+			scattered := ray{rec.p, sRec.pdf.generate(rnd), r.time}
+			pdf := sRec.pdf.value(scattered.direction)
+			if pdf <= 0 {
+				break
+			}
+			throughput = throughput.MultEach(sRec.attenuation).Mult(rec.mat.scatteringPdf(&current, rec, &scattered) / pdf)
+			current = scattered
+			continue
+		}
+
+		light := in.directLight(&current, rec, sRec, rnd).Add(in.gather(&current, rec, sRec))
+		color = color.Add(throughput.MultEach(light))
+		break
+	}
+	return color
+}
+
+// directLight is the light reaching rec straight from a point on the lights,
+// scattered back along rayIn
+func (in *photonIntegrator) directLight(rayIn *ray, rec *hitRecord, sRec *scatterRecord, rnd sampler) Color3 {
+	p, normal, emitted, ok := in.emitters.sample(rayIn.time, rnd)
+	if !ok || emitted == (Color3{}) {
+		return Color3{0, 0, 0}
+	}
+	d := p.Sub(rec.p)
+	distanceSquared := d.LengthSquared()
+	if distanceSquared == 0 {
+		return Color3{0, 0, 0}
+	}
+	scatteringPdf := rec.mat.scatteringPdf(rayIn, rec, &ray{rec.p, d, rayIn.time})
+	if scatteringPdf <= 0 || !visible(in.world, rec.p, p, rayIn.time, rnd) {
+		return Color3{0, 0, 0}
+	}
+	cosine := math.Abs(normal.Dot(d)) / math.Sqrt(distanceSquared)
+	return sRec.attenuation.MultEach(emitted).Mult(scatteringPdf * cosine / (distanceSquared * in.emitters.pdfArea()))
+}
+
+// gather estimates the light the photons around rec bring, scattered back
+// along rayIn: the power of the ones within the radius over the area of the disk
+func (in *photonIntegrator) gather(rayIn *ray, rec *hitRecord, sRec *scatterRecord) Color3 {
+	sum := Color3{0, 0, 0}
+	in.photons.lookup(rec.p, in.radius, func(ph *photon) {
+		wi := ph.dir.Mult(-1)
+		// Photons on the other side of the surface lit the other side
+		cosine := rec.normal.Dot(wi)
+		if cosine <= 0 {
+			return
+		}
+		scatteringPdf := rec.mat.scatteringPdf(rayIn, rec, &ray{rec.p, wi, rayIn.time})
+		if scatteringPdf <= 0 {
+			return
+		}
+		sum = sum.Add(sRec.attenuation.MultEach(ph.power).Mult(scatteringPdf / cosine))
+	})
+	return sum.Div(math.Pi * in.radius * in.radius)
+}
+
+// sppmIntegrator is progressive photon mapping: the image is rendered in
+// passes of one sample per pixel, each with a new photon map and a smaller
+// radius, so both the noise and the blur of the photons go away as passes
+// add up. Every pass is independent, so the image is their plain average
+// (Knaus and Zwicker's formulation).
+type sppmIntegrator struct {
+	*photonIntegrator
+	initialRadius float64
+}
+
+// sppmAlpha is how much of its photons a pass keeps compared to the one
+// before: the radius shrinks so the area of the disk goes down with (i+α)/(i+1)
+const sppmAlpha = 2.0 / 3.0
+
+func newSppmIntegrator(scene *renderScene) (integrator, error) {
+	in, err := newPhotonMapper(scene)
+	if err != nil {
+		return nil, err
+	}
+	return &sppmIntegrator{in, in.radius}, nil
+}
+
+// startPass shoots the photons of pass (counting from 0) before any of its
+// samples are taken
+func (in *sppmIntegrator) startPass(pass int) {
+	radiusSquared := in.initialRadius * in.initialRadius
+	for i := 1; i <= pass; i++ {
+		radiusSquared *= (float64(i) + sppmAlpha) / float64(i+1)
+	}
+	in.radius = math.Sqrt(radiusSquared)
+
+	in.photons = in.tracePhotons(in.opts.photons, pass)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"testing"
+)
+
+// Looking photons up in the kd-tree finds the same ones as checking every
+// photon, with clumps, duplicates and points lined up on the split axes
+func TestPhotonMapLookup(t *testing.T) {
+	rnd := newStream(1)
+	for _, n := range []int{0, 1, 2, 3, 10, 1000} {
+		photons := make([]photon, n)
+		for i := range photons {
+			p := RandomRangeVec3(-1, 1, rnd)
+			switch i % 4 {
+			case 1: //on a grid, so many share a coordinate
+				p = Point3{math.Round(p[0] * 4), math.Round(p[1] * 4), math.Round(p[2] * 4)}.Div(4)
+			case 2: //in a clump
+				p = p.Mult(0.01)
+			}
+			photons[i] = photon{p, Vec3{}, Color3{float64(i), 0, 0}}
+		}
+		if n > 5 {
+			photons[5] = photons[4] //a duplicate
+		}
+		m := newPhotonMap(append([]photon(nil), photons...))
+
+		ids := func(found []photon) []float64 {
+			var out []float64
+			for _, ph := range found {
+				out = append(out, ph.power[0])
+			}
+			sort.Float64s(out)
+			return out
+		}
+		if got, want := ids(m.photons), ids(photons); !equalFloats(got, want) {
+			t.Fatalf("%d photons: building the map changed them to %v", n, got)
+		}
+
+		for i := 0; i < 200; i++ {
+			p := RandomRangeVec3(-1.2, 1.2, rnd)
+			if i%3 == 0 && n > 0 {
+				p = photons[randomInt(rnd, n)].p //right on a photon
+			}
+			radius := math.Pow(10, -3+3*RandomDouble(rnd))
+
+			var found []photon
+			m.lookup(p, radius, func(ph *photon) { found = append(found, *ph) })
+			var want []photon
+			for _, ph := range photons {
+				if ph.p.Sub(p).LengthSquared() <= radius*radius {
+					want = append(want, ph)
+				}
+			}
+			if got, want := ids(found), ids(want); !equalFloats(got, want) {
+				t.Errorf("%d photons: around %v within %v found %v, want %v", n, p, radius, got, want)
+			}
+		}
+	}
+}
+
+func equalFloats(a []float64, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
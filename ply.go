@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type plyFormat int
+
+const (
+	plyASCII plyFormat = iota
+	plyBinaryLittleEndian
+	plyBinaryBigEndian
+)
+
+type plyProperty struct {
+	name      string
+	typ       string
+	countType string //Only for list properties
+}
+
+type plyElement struct {
+	name       string
+	count      int
+	properties []plyProperty
+}
+
+// plyReader reads the body of a PLY file one value at a time, so files larger
+// than memory can be loaded as long as the mesh itself fits
+type plyReader struct {
+	r      *bufio.Reader
+	format plyFormat
+	order  binary.ByteOrder
+	buf    [8]byte
+}
+
+var plyTypeSizes = map[string]int{
+	"char": 1, "int8": 1, "uchar": 1, "uint8": 1,
+	"short": 2, "int16": 2, "ushort": 2, "uint16": 2,
+	"int": 4, "int32": 4, "uint": 4, "uint32": 4,
+	"float": 4, "float32": 4, "double": 8, "float64": 8,
+}
+
+// word returns the next whitespace separated token of an ASCII body
+func (p *plyReader) word() (string, error) {
+	var sb strings.Builder
+	for {
+		c, err := p.r.ReadByte()
+		if err != nil {
+			if err == io.EOF && sb.Len() > 0 {
+				return sb.String(), nil
+			}
+			return "", err
+		}
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			if sb.Len() > 0 {
+				return sb.String(), nil
+			}
+			continue
+		}
+		sb.WriteByte(c)
+	}
+}
+
+func (p *plyReader) value(typ string) (float64, error) {
+	if p.format == plyASCII {
+		w, err := p.word()
+		if err != nil {
+			return 0, err
+		}
+		return strconv.ParseFloat(w, 64)
+	}
+
+	b := p.buf[:plyTypeSizes[typ]]
+	if _, err := io.ReadFull(p.r, b); err != nil {
+		return 0, err
+	}
+	switch typ {
+	case "char", "int8":
+		return float64(int8(b[0])), nil
+	case "uchar", "uint8":
+		return float64(b[0]), nil
+	case "short", "int16":
+		return float64(int16(p.order.Uint16(b))), nil
+	case "ushort", "uint16":
+		return float64(p.order.Uint16(b)), nil
+	case "int", "int32":
+		return float64(int32(p.order.Uint32(b))), nil
+	case "uint", "uint32":
+		return float64(p.order.Uint32(b)), nil
+	case "float", "float32":
+		return float64(math.Float32frombits(p.order.Uint32(b))), nil
+	default:
+		return math.Float64frombits(p.order.Uint64(b)), nil
+	}
+}
+
+func readPLYHeader(r *bufio.Reader) (plyFormat, []plyElement, error) {
+	var format plyFormat
+	var elements []plyElement
+
+	line, err := r.ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != "ply" {
+		return format, nil, errors.New("not a PLY file")
+	}
+
+	for lineNumber := 2; ; lineNumber++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return format, nil, fmt.Errorf("header line %d: %v", lineNumber, err)
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		bad := func(format string, args ...interface{}) error {
+			return fmt.Errorf("header line %d: %s", lineNumber, fmt.Sprintf(format, args...))
+		}
+
+		switch fields[0] {
+		case "format":
+			if len(fields) != 3 {
+				return format, nil, bad("invalid format line")
+			}
+			switch fields[1] {
+			case "ascii":
+				format = plyASCII
+			case "binary_little_endian":
+				format = plyBinaryLittleEndian
+			case "binary_big_endian":
+				format = plyBinaryBigEndian
+			default:
+				return format, nil, bad("unknown format %q", fields[1])
+			}
+		case "element":
+			if len(fields) != 3 {
+				return format, nil, bad("invalid element line")
+			}
+			count, err := strconv.Atoi(fields[2])
+			if err != nil || count < 0 {
+				return format, nil, bad("invalid element count %q", fields[2])
+			}
+			elements = append(elements, plyElement{name: fields[1], count: count})
+		case "property":
+			if len(elements) == 0 {
+				return format, nil, bad("property before any element")
+			}
+			var prop plyProperty
+			if len(fields) == 5 && fields[1] == "list" {
+				prop = plyProperty{name: fields[4], typ: fields[3], countType: fields[2]}
+			} else if len(fields) == 3 {
+				prop = plyProperty{name: fields[2], typ: fields[1]}
+			} else {
+				return format, nil, bad("invalid property line")
+			}
+			for _, t := range []string{prop.typ, prop.countType} {
+				if _, ok := plyTypeSizes[t]; t != "" && !ok {
+					return format, nil, bad("unknown property type %q", t)
+				}
+			}
+			e := &elements[len(elements)-1]
+			e.properties = append(e.properties, prop)
+		case "end_header":
+			return format, elements, nil
+		case "comment", "obj_info":
+		default:
+			return format, nil, bad("unknown header keyword %q", fields[0])
+		}
+	}
+}
+
+// loadPLY reads an ASCII or binary PLY mesh. Vertex normals, texture
+// coordinates and colors are used when present; colors can be rendered with
+// a vertexColorTexture. Faces with more than three vertices are triangulated.
+func loadPLY(path string, mat material) (*triangleMesh, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 1<<20)
+	format, elements, err := readPLYHeader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	p := plyReader{r: r, format: format, order: binary.LittleEndian}
+	if format == plyBinaryBigEndian {
+		p.order = binary.BigEndian
+	}
+
+	var positions []Point3
+	var normals []Vec3
+	var uvs [][2]float64
+	var colors []Color3
+	var indices []int
+
+	for _, e := range elements {
+		switch e.name {
+		case "vertex":
+			positions, normals, uvs, colors, err = p.vertices(e)
+		case "face":
+			indices, err = p.faces(e, len(positions))
+		default:
+			err = p.skip(e)
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, fmt.Errorf("%s: reading %s elements: %v", path, e.name, err)
+		}
+	}
+
+	m, err := newTriangleMesh(positions, normals, uvs, indices, mat)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if colors != nil {
+		if err := m.setVertexColors(colors); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return m, nil
+}
+
+func (p *plyReader) vertices(e plyElement) (positions []Point3, normals []Vec3, uvs [][2]float64, colors []Color3, err error) {
+	// Where each property of a vertex goes, -1 for ignored ones
+	const (
+		posSlot = iota * 3
+		normalSlot
+		colorSlot
+		uvSlot
+		slotCount = uvSlot + 2
+	)
+	slots := make([]int, len(e.properties))
+	var has [slotCount]bool
+	colorScale := 1.0
+	for i, prop := range e.properties {
+		slots[i] = -1
+		if prop.countType != "" {
+			continue
+		}
+		switch prop.name {
+		case "x", "y", "z":
+			slots[i] = posSlot + int(prop.name[0]-'x')
+		case "nx", "ny", "nz":
+			slots[i] = normalSlot + int(prop.name[1]-'x')
+		case "red", "green", "blue", "r", "g", "b", "diffuse_red", "diffuse_green", "diffuse_blue":
+			name := strings.TrimPrefix(prop.name, "diffuse_")
+			slots[i] = colorSlot + strings.IndexByte("rgb", name[0])
+			if prop.typ != "float" && prop.typ != "float32" && prop.typ != "double" && prop.typ != "float64" {
+				colorScale = 1.0 / float64(int(1)<<(8*plyTypeSizes[prop.typ])-1)
+			}
+		case "u", "s", "texture_u", "texture_s":
+			slots[i] = uvSlot
+		case "v", "t", "texture_v", "texture_t":
+			slots[i] = uvSlot + 1
+		}
+		if slots[i] >= 0 {
+			has[slots[i]] = true
+		}
+	}
+	if !has[posSlot] || !has[posSlot+1] || !has[posSlot+2] {
+		return nil, nil, nil, nil, errors.New("vertices need x, y and z")
+	}
+	hasNormals := has[normalSlot] && has[normalSlot+1] && has[normalSlot+2]
+	hasColors := has[colorSlot] && has[colorSlot+1] && has[colorSlot+2]
+	hasUVs := has[uvSlot] && has[uvSlot+1]
+
+	// The count comes from the header, and a broken or hostile one can ask for
+	// more than memory holds: the vertices are only allocated as they are read
+	positions = make([]Point3, 0, plyCapacity(e.count))
+	if hasNormals {
+		normals = make([]Vec3, 0, plyCapacity(e.count))
+	}
+	if hasColors {
+		colors = make([]Color3, 0, plyCapacity(e.count))
+	}
+	if hasUVs {
+		uvs = make([][2]float64, 0, plyCapacity(e.count))
+	}
+
+	var values [slotCount]float64
+	for v := 0; v < e.count; v++ {
+		for i, prop := range e.properties {
+			if prop.countType != "" {
+				if err := p.skipList(prop); err != nil {
+					return nil, nil, nil, nil, err
+				}
+				continue
+			}
+			x, err := p.value(prop.typ)
+			if err != nil {
+				return nil, nil, nil, nil, err
+			}
+			if slots[i] >= 0 {
+				values[slots[i]] = x
+			}
+		}
+
+		positions = append(positions, Point3{values[0], values[1], values[2]})
+		if hasNormals {
+			normals = append(normals, Vec3{values[normalSlot], values[normalSlot+1], values[normalSlot+2]})
+		}
+		if hasColors {
+			colors = append(colors, Color3{values[colorSlot], values[colorSlot+1], values[colorSlot+2]}.Mult(colorScale))
+		}
+		if hasUVs {
+			uvs = append(uvs, [2]float64{values[uvSlot], values[uvSlot+1]})
+		}
+	}
+
+	return positions, normals, uvs, colors, nil
+}
+
+// plyCapacity is how many of count elements to make room for before reading
+// them. Past a few megabytes they have to be read to be allocated.
+func plyCapacity(count int) int {
+	if count > 1<<16 {
+		return 1 << 16
+	}
+	return count
+}
+
+func (p *plyReader) faces(e plyElement, vertexCount int) ([]int, error) {
+	indices := make([]int, 0, 3*plyCapacity(e.count))
+	var face []int
+
+	for f := 0; f < e.count; f++ {
+		for _, prop := range e.properties {
+			if prop.countType == "" || prop.name != "vertex_indices" && prop.name != "vertex_index" {
+				if err := p.skipProperty(prop); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			count, err := p.value(prop.countType)
+			if err != nil {
+				return nil, err
+			}
+			face = face[:0]
+			for i := 0; i < int(count); i++ {
+				x, err := p.value(prop.typ)
+				if err != nil {
+					return nil, err
+				}
+				if x < 0 || int(x) >= vertexCount {
+					return nil, fmt.Errorf("face %d: vertex index %v out of range, there are %d", f, x, vertexCount)
+				}
+				face = append(face, int(x))
+			}
+			for i := 1; i+1 < len(face); i++ {
+				indices = append(indices, face[0], face[i], face[i+1])
+			}
+		}
+	}
+
+	return indices, nil
+}
+
+func (p *plyReader) skipProperty(prop plyProperty) error {
+	if prop.countType != "" {
+		return p.skipList(prop)
+	}
+	_, err := p.value(prop.typ)
+	return err
+}
+
+func (p *plyReader) skipList(prop plyProperty) error {
+	count, err := p.value(prop.countType)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < int(count); i++ {
+		if _, err := p.value(prop.typ); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *plyReader) skip(e plyElement) error {
+	for i := 0; i < e.count; i++ {
+		for _, prop := range e.properties {
+			if err := p.skipProperty(prop); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
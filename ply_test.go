@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// plyQuad is a header for a square of two triangles with vertex colors,
+// stored as one four sided face
+const plyQuad = `ply
+format %s 1.0
+comment a unit square
+element vertex 4
+property float x
+property float y
+property float z
+property uchar red
+property uchar green
+property uchar blue
+element face 1
+property list uchar int vertex_indices
+end_header
+`
+
+const plyQuadASCII = `0 0 0 255 0 0
+1 0 0 0 255 0
+1 1 0 0 0 255
+0 1 0 255 255 255
+4 0 1 2 3
+`
+
+// plyQuadBinary is the body of plyQuad in binary, in order
+func plyQuadBinary(order binary.ByteOrder) []byte {
+	var body bytes.Buffer
+	vertices := []struct {
+		p   [3]float32
+		rgb [3]uint8
+	}{
+		{[3]float32{0, 0, 0}, [3]uint8{255, 0, 0}},
+		{[3]float32{1, 0, 0}, [3]uint8{0, 255, 0}},
+		{[3]float32{1, 1, 0}, [3]uint8{0, 0, 255}},
+		{[3]float32{0, 1, 0}, [3]uint8{255, 255, 255}},
+	}
+	for _, v := range vertices {
+		binary.Write(&body, order, v.p)
+		binary.Write(&body, order, v.rgb)
+	}
+	body.WriteByte(4)
+	binary.Write(&body, order, []int32{0, 1, 2, 3})
+	return body.Bytes()
+}
+
+func writeFixture(t *testing.T, name string, data []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPLY(t *testing.T) {
+	header := func(format string) string { return strings.Replace(plyQuad, "%s", format, 1) }
+	tests := []struct {
+		name string
+		file []byte
+	}{
+		{"ascii", []byte(header("ascii") + plyQuadASCII)},
+		{"binary little endian", append([]byte(header("binary_little_endian")), plyQuadBinary(binary.LittleEndian)...)},
+		{"binary big endian", append([]byte(header("binary_big_endian")), plyQuadBinary(binary.BigEndian)...)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := loadPLY(writeFixture(t, "quad.ply", test.file), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []Point3{{0, 0, 0}, {1, 0, 0}, {1, 1, 0}, {0, 1, 0}}; !reflect.DeepEqual(m.positions, want) {
+				t.Errorf("positions = %v, want %v", m.positions, want)
+			}
+			if want := []int{0, 1, 2, 0, 2, 3}; !reflect.DeepEqual(m.indices, want) {
+				t.Errorf("indices = %v, want %v", m.indices, want)
+			}
+			if want := []Color3{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}, {1, 1, 1}}; !reflect.DeepEqual(m.colors, want) {
+				t.Errorf("colors = %v, want %v", m.colors, want)
+			}
+			if m.normals != nil || m.uvs != nil {
+				t.Errorf("got normals %v and uvs %v the file doesn't have", m.normals, m.uvs)
+			}
+			if m.area != 1 {
+				t.Errorf("area = %v, want 1", m.area)
+			}
+		})
+	}
+}
+
+func TestLoadPLYErrors(t *testing.T) {
+	header := func(format string) string { return strings.Replace(plyQuad, "%s", format, 1) }
+	little := append([]byte(header("binary_little_endian")), plyQuadBinary(binary.LittleEndian)...)
+	tests := []struct {
+		name string
+		file string
+		want string
+	}{
+		{"not a ply file", "solid cube\n", "not a PLY file"},
+		{"unknown format", header("utf8"), `header line 2: unknown format "utf8"`},
+		{"property first", "ply\nformat ascii 1.0\nproperty float x\nend_header\n", "header line 3: property before any element"},
+		{"unknown type", strings.Replace(header("ascii"), "uchar red", "half red", 1), `header line 8: unknown property type "half"`},
+		{"unknown keyword", strings.Replace(header("ascii"), "comment", "remark", 1), `header line 3: unknown header keyword "remark"`},
+		{"bad count", strings.Replace(header("ascii"), "vertex 4", "vertex four", 1), `header line 4: invalid element count "four"`},
+		{"no end of header", "ply\nformat ascii 1.0\nelement vertex 4\n", "header line 4: EOF"},
+		{"truncated ascii", header("ascii") + plyQuadASCII[:40], "reading vertex elements: unexpected EOF"},
+		{"huge count", strings.Replace(header("ascii"), "vertex 4", "vertex 900000000000", 1) + plyQuadASCII, "reading vertex elements: unexpected EOF"},
+		{"huge binary count", strings.Replace(header("binary_little_endian"), "face 1", "face 900000000000", 1) + string(plyQuadBinary(binary.LittleEndian)), "reading face elements: unexpected EOF"},
+		{"truncated binary", string(little[:len(little)-6]), "reading face elements: unexpected EOF"},
+		{"index out of range", header("ascii") + strings.Replace(plyQuadASCII, "4 0 1 2 3", "4 0 1 2 4", 1), "reading face elements: face 0: vertex index 4 out of range, there are 4"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeFixture(t, "bad.ply", []byte(test.file))
+			_, err := loadPLY(path, nil)
+			if err == nil {
+				t.Fatalf("loaded a broken file, want %q", test.want)
+			}
+			if want := path + ": " + test.want; err.Error() != want {
+				t.Errorf("error = %q, want %q", err, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// renderProgressive renders in passes that double the samples per pixel
+// taken so far (1, 2, 4, ...) and rewrites the image after each of them, so
+// there is something to look at from the start. With cfg.saveEvery passes
+// are kept short enough to save about that often.
+//
+// It stops at the options' samples per pixel, after cfg.timeLimit or on
+// Ctrl-C, and saves what it has: tiles that were finished keep the samples
+// of the last pass, the others don't.
+//
+// With cfg.checkpoint the render is also saved there after every pass that
+// finished, and with cfg.resume it goes on from the one saved last.
+func renderProgressive(r *tileRenderer, splats *splatFilm, cfg *config) error {
+	samples := 0
+	var hash uint64
+	if cfg.checkpoint != "" {
+		var err error
+		if hash, err = renderHash(cfg); err != nil {
+			return err
+		}
+		if _, ok, err := readCheckpointHeader(cfg.checkpoint); err != nil {
+			return err
+		} else if ok && cfg.resume {
+			if samples, err = loadCheckpoint(cfg.checkpoint, hash, r.film, splats); err != nil {
+				return err
+			}
+			fmt.Printf("Resuming from %d samples per pixel\n", samples)
+		}
+	}
+
+	stop := make(chan struct{})
+	var once sync.Once
+	halt := func(why string) {
+		once.Do(func() {
+			fmt.Println(why + ", saving the image so far")
+			close(stop)
+		})
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-interrupt:
+			halt("Interrupted")
+		case <-done:
+		}
+	}()
+	if cfg.timeLimit > 0 {
+		timer := time.AfterFunc(cfg.timeLimit, func() { halt("Out of time") })
+		defer timer.Stop()
+	}
+
+	if samples >= r.opts.samplesPerPixel {
+		return saveImages(cfg, r.film, splats)
+	}
+
+	t0 := time.Now()
+	target := r.opts.samplesPerPixel
+	firstSamples := samples
+	for samples < target {
+		pass := samples
+		if pass == 0 {
+			pass = 1
+		}
+		if pass > target-samples {
+			pass = target - samples
+		}
+		if cfg.saveEvery > 0 && samples > firstSamples {
+			perSample := time.Since(t0) / time.Duration(samples-firstSamples)
+			if fit := int(cfg.saveEvery / perSample); fit < pass {
+				pass = fit
+			}
+			if pass < 1 {
+				pass = 1
+			}
+		}
+
+		finished := r.renderSamples(samples, pass, stop, func(int) {})
+		if err := saveImages(cfg, r.film, splats); err != nil {
+			return err
+		}
+		if !finished {
+			break
+		}
+		samples += pass
+		if cfg.checkpoint != "" {
+			if err := saveCheckpoint(cfg.checkpoint, hash, cfg.seed, samples, r.film, splats); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("%d/%d samples per pixel after %v\n", samples, target, time.Since(t0).Round(time.Millisecond))
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math/rand"
+)
+
+// splitMix is a SplitMix64 source of random numbers. It is tiny and setting
+// its state is free, so every pixel sample can have a stream of its own.
+type splitMix struct {
+	state uint64
+}
+
+func (s *splitMix) Seed(seed int64) {
+	s.state = uint64(seed)
+}
+
+func (s *splitMix) Uint64() uint64 {
+	s.state += 0x9e3779b97f4a7c15
+	z := s.state
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	return z ^ z>>31
+}
+
+func (s *splitMix) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+// What a stream of random numbers is for, so streams made from the same
+// seed and numbers never overlap
+const (
+	sceneStream = iota
+	sampleStream
+	photonStream
+)
+
+// streamSeed mixes the render's seed with the numbers that identify one of
+// its streams (like the pixel and sample) into the seed of that stream
+func streamSeed(seed int64, ids ...int) uint64 {
+	s := splitMix{uint64(seed)}
+	h := s.Uint64()
+	for _, id := range ids {
+		s.state = h + uint64(id)
+		h = s.Uint64()
+	}
+	return h
+}
+
+// newStream is the stream of random numbers identified by ids in a render
+// with the given seed, the same for the same seed and ids whatever renders it
+func newStream(seed int64, ids ...int) *independentSampler {
+	source := &splitMix{streamSeed(seed, ids...)}
+	return &independentSampler{seed, source, rand.New(source)}
+}
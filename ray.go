@@ -1,9 +1,5 @@
 package main
 
-import (
-	"math/rand"
-)
-
 type ray struct {
 	origin    Point3
 	direction Vec3
@@ -14,54 +10,53 @@ func (r *ray) At(t float64) Point3 {
 	return r.origin.Add(r.direction.Mult(t))
 }
 
-//"Background" color (colors can be changed)
-// func (r *ray) RayColor(world hittable, background Color3, maxDepth int, rnd *rand.Rand) Color3 {
-// 	if maxDepth <= 0 {
-// 		//No more light gathered
-// 		return Color3{0, 0, 0}
-// 	}
-
-// 	rec, hit := world.hit(r, 0.001, infinity)
-// 	if !hit {
-// 		return background
-// 	}
-
-// 	emitted := rec.mat.emitted(r, rec, rec.u, rec.v, rec.p)
-// 	scattered, albedo, pdf, scatter := rec.mat.scatter(r, rec, rnd)
-// 	// attenuation.Print()
-// 	if !scatter {
-// 		return emitted
-// 	}
-// 	return emitted.Add(albedo.MultEach(scattered.RayColor(world, background, maxDepth-1, rnd).Mult(rec.mat.scatteringPdf(r, rec, scattered)).Div(pdf)))
-// }
-
-func (r *ray) RayColor(world hittable, background Color3, maxDepth int, rnd *rand.Rand, lights hittable) Color3 {
-	if maxDepth <= 0 {
-		//No more light gathered
-		return Color3{0, 0, 0}
-	}
-
-	rec, hit := world.hit(r, 0.001, infinity)
-	if !hit {
-		return background
+// RayColor follows the ray through the world, sampling a 50/50 mixture of
+// directions towards the lights and from the material at diffuse bounces.
+// The path is a loop carrying the fraction of the light that makes it back
+// to the camera (throughput), so deep paths don't grow the stack.
+func (r *ray) RayColor(world hittable, lights hittable, opts *options, rnd sampler) Color3 {
+	sampleLights := hasLights(lights)
+
+	color := Color3{0, 0, 0}
+	throughput := Color3{1, 1, 1}
+	current := *r
+
+	for depth := 0; depth < opts.maxDepth; depth++ {
+		rec, hit := world.hit(&current, 0.001, infinity, rnd)
+		if !hit {
+			color = color.Add(throughput.MultEach(opts.background))
+			break
+		}
+
+		color = color.Add(throughput.MultEach(rec.mat.emitted(&current, rec, rec.u, rec.v, rec.p)))
+		sRec, scatter := rec.mat.scatter(&current, rec, rnd)
+		if !scatter {
+			break
+		}
+
+		if sRec.isSpecular {
+			throughput = throughput.MultEach(sRec.attenuation)
+			current = sRec.specularRay
+			current.time = r.time
+		} else {
+			var p pdf = sRec.pdf
+			if sampleLights {
+				p = mixturePdf{[2]pdf{hittablePdf{lights, rec.p}, sRec.pdf}}
+			}
+
+			scattered := ray{rec.p, p.generate(rnd), r.time}
+			pdfVal := p.value(scattered.direction)
+			if pdfVal <= 0 {
+				break
+			}
+			throughput = throughput.MultEach(sRec.attenuation).Mult(rec.mat.scatteringPdf(&current, rec, &scattered) / pdfVal)
+			current = scattered
+		}
+
+		if !russianRoulette(&throughput, depth+1, opts, rnd) {
+			break
+		}
 	}
 
-	emitted := rec.mat.emitted(r, rec, rec.u, rec.v, rec.p)
-	sRec, scatter := rec.mat.scatter(r, rec, rnd)
-	// attenuation.Print()
-	if !scatter {
-		return emitted
-	}
-
-	if sRec.isSpecular {
-		return sRec.attenuation.MultEach(sRec.specularRay.RayColor(world, background, maxDepth-1, rnd, lights))
-	}
-
-	light := hittablePdf{lights, rec.p}
-	p := mixturePdf{[2]pdf{light, sRec.pdf}}
-
-	scattered := &ray{rec.p, p.generate(rnd), r.time}
-	pdfVal := p.value(scattered.direction)
-
-	return emitted.Add(sRec.attenuation.MultEach(scattered.RayColor(world, background, maxDepth-1, rnd, lights).Mult(rec.mat.scatteringPdf(r, rec, scattered)).Div(pdfVal)))
+	return color
 }
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+// film is what the samples taken of every pixel add up to, row 0 at the
+// bottom of the image. Every sample goes into the pixels around it weighted
+// by the filter, which is what the image is made of. The samples of each
+// pixel are also kept on their own, with how many there are, for adaptive
+// sampling: renders that are stopped halfway and adaptive sampling leave some
+// pixels with more samples than others.
+type film struct {
+	width, height int
+	pixels        []Color3  //sum of the pixel's own samples
+	sumSquares    []float64 //of the luminance of the samples, for their variance
+	samples       []int
+	filter        *pixelFilter
+	filtered      []fixedColor //sum of the samples around the pixel, weighted by the filter
+	weights       []fixed
+}
+
+func newFilm(width int, height int, filter *pixelFilter) *film {
+	n := width * height
+	return &film{width, height, make([]Color3, n), make([]float64, n), make([]int, n), filter, make([]fixedColor, n), make([]fixed, n)}
+}
+
+// add adds the sum c of samples more samples to a pixel, and the sum of the
+// squares of their luminance
+func (f *film) add(x int, y int, c Color3, sumSquares float64, samples int) {
+	f.pixels[y*f.width+x] = f.pixels[y*f.width+x].Add(c)
+	f.sumSquares[y*f.width+x] += sumSquares
+	f.samples[y*f.width+x] += samples
+}
+
+// displayError is the standard error of a pixel's brightness as it is
+// displayed, after gamma correction: 0.01 is about 2.5 levels of 255
+func (f *film) displayError(x int, y int) float64 {
+	i := y*f.width + x
+	n := float64(f.samples[i])
+	if n < 2 {
+		return math.Inf(1)
+	}
+	mean := luminance(f.pixels[i]) / n
+	variance := math.Max(f.sumSquares[i]/n-mean*mean, 0)
+	stdErr := math.Sqrt(variance / n)
+	if stdErr == 0 {
+		return 0
+	}
+	if mean <= 0 {
+		return math.Inf(1)
+	}
+	// The image shows sqrt(mean), whose error is about stdErr / 2 sqrt(mean)
+	return stdErr / (2 * math.Sqrt(mean))
+}
+
+func luminance(c Color3) float64 {
+	return 0.2126*c[0] + 0.7152*c[1] + 0.0722*c[2]
+}
+
+func (f *film) at(x int, y int) (Color3, int) {
+	return f.pixels[y*f.width+x], f.samples[y*f.width+x]
+}
+
+// minFilterWeight is the least weight a pixel's filtered samples can have
+// for their average to mean anything. A sample at the center of a pixel weighs
+// about 1, but filters with negative lobes can cancel out to next to nothing.
+const minFilterWeight = 1e-3
+
+// color is the pixel as the filter reconstructs it from the samples around
+// it. Pixels with too little weight are the plain average of their own
+// samples instead, and negative lobes can't make them darker than black.
+func (f *film) color(x int, y int) Color3 {
+	i := y*f.width + x
+	var c Color3
+	switch weight := f.weights[i].float(); {
+	case weight > minFilterWeight:
+		c = f.filtered[i].color().Div(weight)
+	case f.samples[i] > 0:
+		c = f.pixels[i].Div(float64(f.samples[i]))
+	}
+	for j := range c {
+		c[j] = math.Max(c[j], 0)
+	}
+	return c
+}
+
+// filmTile is the filtered samples of a tile before they go on the film.
+// They spill over the edges of the tile by up to the filter's radius, so
+// tiles rendered at the same time would add to the same pixels.
+type filmTile struct {
+	bounds   tile //the pixels the tile's samples reach, inside the image
+	filtered []fixedColor
+	weights  []fixed
+}
+
+func (f *film) newTile(t tile) *filmTile {
+	margin := int(math.Ceil(f.filter.radius))
+	b := tile{t.x0 - margin, t.y0 - margin, t.x1 + margin, t.y1 + margin}
+	if b.x0 < 0 {
+		b.x0 = 0
+	}
+	if b.y0 < 0 {
+		b.y0 = 0
+	}
+	if b.x1 > f.width {
+		b.x1 = f.width
+	}
+	if b.y1 > f.height {
+		b.y1 = f.height
+	}
+	n := (b.x1 - b.x0) * (b.y1 - b.y0)
+	return &filmTile{b, make([]fixedColor, n), make([]fixed, n)}
+}
+
+// addSample adds a sample taken at x, y (in pixels, the center of pixel i
+// is at i + 0.5) to the pixels within the filter's radius
+func (f *film) addSample(ft *filmTile, x float64, y float64, c Color3) {
+	b := ft.bounds
+	r := f.filter.radius
+	// The pixels whose centers are in (x - r, x + r]
+	x0, x1 := int(math.Floor(x-0.5-r))+1, int(math.Floor(x-0.5+r))
+	y0, y1 := int(math.Floor(y-0.5-r))+1, int(math.Floor(y-0.5+r))
+	if x0 < b.x0 {
+		x0 = b.x0
+	}
+	if y0 < b.y0 {
+		y0 = b.y0
+	}
+	if x1 >= b.x1 {
+		x1 = b.x1 - 1
+	}
+	if y1 >= b.y1 {
+		y1 = b.y1 - 1
+	}
+	for py := y0; py <= y1; py++ {
+		for px := x0; px <= x1; px++ {
+			w := f.filter.weight(float64(px)+0.5-x, float64(py)+0.5-y)
+			if w == 0 {
+				continue
+			}
+			i := (py-b.y0)*(b.x1-b.x0) + px - b.x0
+			ft.filtered[i] = ft.filtered[i].add(c.Mult(w))
+			ft.weights[i] = ft.weights[i].add(toFixed(w))
+		}
+	}
+}
+
+// fixed is a number in 128 bit fixed point, 64 bits of it after the point.
+// The filtered samples are added up in it because its sums are exact, so they
+// don't depend on the order they are added in: pixels near the edges of tiles
+// get the samples of several tiles, and the image must be the same however
+// it is split into them. With a fixed quantum of 2^-64 even very dim
+// scenes keep their precision.
+//
+// Its fields are exported for encoding/binary, which saves it in checkpoints.
+type fixed struct {
+	Hi int64  //the whole part, rounded down
+	Lo uint64 //the fraction, in units of 2^-64
+}
+
+// fixedLimit is the largest magnitude toFixed keeps, above it a sum of many
+// could overflow
+const fixedLimit = 1 << 52
+
+// toFixed is x truncated to a multiple of 2^-64. NaNs add nothing and
+// infinities are clamped.
+func toFixed(x float64) fixed {
+	if math.IsNaN(x) {
+		return fixed{}
+	}
+	abs := math.Min(math.Abs(x), fixedLimit)
+	whole := math.Floor(abs)
+	f := fixed{int64(whole), uint64((abs - whole) * (1 << 64))}
+	if x < 0 {
+		return f.neg()
+	}
+	return f
+}
+
+func (a fixed) add(b fixed) fixed {
+	lo, carry := bits.Add64(a.Lo, b.Lo, 0)
+	return fixed{a.Hi + b.Hi + int64(carry), lo}
+}
+
+func (a fixed) neg() fixed {
+	lo, borrow := bits.Sub64(0, a.Lo, 0)
+	return fixed{-a.Hi - int64(borrow), lo}
+}
+
+func (a fixed) float() float64 {
+	if a.Hi < 0 {
+		return -a.neg().float()
+	}
+	return float64(a.Hi) + float64(a.Lo)/(1<<64)
+}
+
+type fixedColor [3]fixed
+
+func (a fixedColor) add(c Color3) fixedColor {
+	return fixedColor{a[0].add(toFixed(c[0])), a[1].add(toFixed(c[1])), a[2].add(toFixed(c[2]))}
+}
+
+func (a fixedColor) addFixed(b fixedColor) fixedColor {
+	return fixedColor{a[0].add(b[0]), a[1].add(b[1]), a[2].add(b[2])}
+}
+
+func (a fixedColor) color() Color3 {
+	return Color3{a[0].float(), a[1].float(), a[2].float()}
+}
+
+// merge adds a tile's filtered samples to the film
+func (f *film) merge(ft *filmTile) {
+	b := ft.bounds
+	for y := b.y0; y < b.y1; y++ {
+		for x := b.x0; x < b.x1; x++ {
+			i := (y-b.y0)*(b.x1-b.x0) + x - b.x0
+			f.filtered[y*f.width+x] = f.filtered[y*f.width+x].addFixed(ft.filtered[i])
+			f.weights[y*f.width+x] = f.weights[y*f.width+x].add(ft.weights[i])
+		}
+	}
+}
+
+// totalSamples is the number of samples taken of all the pixels
+func (f *film) totalSamples() int {
+	total := 0
+	for _, n := range f.samples {
+		total += n
+	}
+	return total
+}
+
+// tile is the pixels in [x0, x1) x [y0, y1)
+type tile struct {
+	x0, y0, x1, y1 int
+}
+
+// splitTiles covers a width by height image with tiles of size by size
+// pixels, smaller at the right and top edges
+func splitTiles(width int, height int, size int) []tile {
+	var tiles []tile
+	for y := 0; y < height; y += size {
+		for x := 0; x < width; x += size {
+			t := tile{x, y, x + size, y + size}
+			if t.x1 > width {
+				t.x1 = width
+			}
+			if t.y1 > height {
+				t.y1 = height
+			}
+			tiles = append(tiles, t)
+		}
+	}
+	return tiles
+}
+
+// tileRenderer renders the image tile by tile on a fixed number of workers.
+// Workers take the next tile left until there are none, so they all keep
+// busy however long each tile takes. A tile is only ever rendered by one
+// worker, which adds its samples straight into the film.
+//
+// Every worker has a sampler of its own, and what a sampler gives a sample of a
+// pixel only depends on the seed, the pixel and the sample. The filtered
+// samples of every tile go on the film in the order of the tiles once they
+// are all done, so the image is the same whichever worker renders what.
+type tileRenderer struct {
+	cam      *camera
+	integ    integrator
+	opts     *options
+	film     *film
+	tiles    []tile
+	workers  int
+	seed     int64
+	adaptive adaptiveSampling
+}
+
+// adaptiveSampling stops sampling pixels once their displayError is below
+// threshold, checking every minSamples samples (and not before). A zero
+// threshold samples every pixel as much as asked.
+type adaptiveSampling struct {
+	threshold  float64
+	minSamples int
+}
+
+func newTileRenderer(cam *camera, integ integrator, opts *options, f *film, tileSize int, workers int, seed int64) *tileRenderer {
+	return &tileRenderer{cam, integ, opts, f, splitTiles(f.width, f.height, tileSize), workers, seed, adaptiveSampling{}}
+}
+
+// renderSamples takes samples more samples of every pixel, numbered from
+// firstSample. Integrators that work in passes get one pass per sample.
+// It calls tileDone (from any worker) with the number of samples every
+// finished tile was given (adaptive sampling may take fewer). Once stop is closed no more tiles are started, and
+// it returns false.
+func (r *tileRenderer) renderSamples(firstSample int, samples int, stop <-chan struct{}, tileDone func(samples int)) bool {
+	passInteg, byPass := r.integ.(passIntegrator)
+	if !byPass {
+		return r.render(firstSample, samples, stop, tileDone)
+	}
+	for pass := firstSample; pass < firstSample+samples; pass++ {
+		passInteg.startPass(pass)
+		if !r.render(pass, 1, stop, tileDone) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *tileRenderer) render(firstSample int, samples int, stop <-chan struct{}, tileDone func(samples int)) bool {
+	var next atomic.Int64
+	var stopped atomic.Bool
+	done := make([]*filmTile, len(r.tiles))
+	wg := sync.WaitGroup{}
+	for w := 0; w < r.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rnd := samplers[r.opts.sampler](r.seed, r.opts.samplesPerPixel)
+			for {
+				select {
+				case <-stop:
+					stopped.Store(true)
+					return
+				default:
+				}
+				i := int(next.Add(1)) - 1
+				if i >= len(r.tiles) {
+					return
+				}
+				t := r.tiles[i]
+				done[i] = r.renderTile(t, firstSample, samples, rnd)
+				tileDone((t.x1 - t.x0) * (t.y1 - t.y0) * samples)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, ft := range done {
+		if ft != nil {
+			r.film.merge(ft)
+		}
+	}
+	return !stopped.Load()
+}
+
+func (r *tileRenderer) renderTile(t tile, firstSample int, samples int, rnd sampler) *filmTile {
+	ft := r.film.newTile(t)
+	for y := t.y0; y < t.y1; y++ {
+		for x := t.x0; x < t.x1; x++ {
+			batch := samples
+			if r.adaptive.threshold > 0 {
+				batch = r.adaptive.minSamples
+			}
+			for s := firstSample; s < firstSample+samples; s += batch {
+				if r.adaptive.threshold > 0 && r.film.samples[y*r.film.width+x] >= r.adaptive.minSamples &&
+					r.film.displayError(x, y) <= r.adaptive.threshold {
+					break
+				}
+				end := s + batch
+				if end > firstSample+samples {
+					end = firstSample + samples
+				}
+				r.renderPixel(x, y, s, end, rnd, ft)
+			}
+		}
+	}
+	return ft
+}
+
+// renderPixel adds samples [start, end) of pixel x, y to the film and to
+// the tile's filtered samples
+func (r *tileRenderer) renderPixel(x int, y int, start int, end int, rnd sampler, ft *filmTile) {
+	pixelColor := Color3{0, 0, 0}
+	sumSquares := 0.0
+	for s := start; s < end; s++ {
+		rnd.startPixelSample(x, y, s)
+
+		du, dv := rnd.get2D()
+		filmX, filmY := float64(x)+du, float64(y)+dv
+		//Horizontal ratio?
+		u := filmX / float64(r.opts.imageWidth-1)
+		//Vertical ratio?
+		v := filmY / float64(r.opts.imageHeight-1)
+
+		sample := r.integ.rayColor(r.cam.getRay(u, v, rnd), rnd)
+		pixelColor = pixelColor.Add(sample)
+		sumSquares += luminance(sample) * luminance(sample)
+		r.film.addSample(ft, filmX, filmY, sample)
+	}
+	r.film.add(x, y, pixelColor, sumSquares, end-start)
+}
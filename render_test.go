@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// A render is the same whatever the number of threads and the size of the
+// tiles, with every sampler and with filters that reach across tiles
+func TestRenderIsDeterministic(t *testing.T) {
+	s, _ := findScene("cornellSmoke")
+	world := s.build(s.cam.time0, s.cam.time1, newStream(1, sceneStream))
+	lights := s.lights
+	if lights == nil {
+		lights = collectLights(world)
+	}
+	c := s.cam.build(s.opts.aspectRatio)
+
+	render := func(samplerName string, filter string, workers int, tileSize int) *film {
+		opts := s.opts
+		opts.imageWidth, opts.imageHeight = 20, 20
+		opts.samplesPerPixel = 4
+		opts.sampler, opts.filter = samplerName, filter
+		splats := newSplatFilm(opts.imageWidth, opts.imageHeight)
+		integ, err := integrators[opts.integrator](&renderScene{world, lights, &c, &opts, splats, 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := newFilm(opts.imageWidth, opts.imageHeight, newPixelFilter(opts.filter, 0))
+		newTileRenderer(&c, integ, &opts, f, tileSize, workers, 1).renderSamples(0, opts.samplesPerPixel, nil, func(int) {})
+		return f
+	}
+
+	for _, samplerName := range samplerNames() {
+		for _, filter := range []string{"box", "gaussian", "lanczos"} {
+			want := render(samplerName, filter, 1, 16)
+			for _, run := range [][2]int{{4, 16}, {3, 7}, {2, 1}} {
+				got := render(samplerName, filter, run[0], run[1])
+				if fmt.Sprint(got.pixels, got.filtered, got.weights) != fmt.Sprint(want.pixels, want.filtered, want.weights) {
+					t.Errorf("%s sampler, %s filter: %d threads with %d pixel tiles render a different image", samplerName, filter, run[0], run[1])
+				}
+			}
+		}
+	}
+}
+
+// Light is added up on the film exactly enough for a scene a million times
+// dimmer to come out as the same image, a million times dimmer
+func TestDimSceneKeepsItsImage(t *testing.T) {
+	s, _ := findScene("twoSpheres")
+	world := s.build(s.cam.time0, s.cam.time1, newStream(1, sceneStream))
+	c := s.cam.build(s.opts.aspectRatio)
+
+	render := func(brightness float64) *film {
+		opts := s.opts
+		opts.imageWidth, opts.imageHeight = 20, 20
+		opts.samplesPerPixel = 4
+		opts.filter = "gaussian"
+		opts.background = opts.background.Mult(brightness)
+		integ, err := integrators["path"](&renderScene{world, collectLights(world), &c, &opts, nil, 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := newFilm(opts.imageWidth, opts.imageHeight, newPixelFilter(opts.filter, 0))
+		newTileRenderer(&c, integ, &opts, f, 7, 1, 1).renderSamples(0, opts.samplesPerPixel, nil, func(int) {})
+		return f
+	}
+
+	const dim = 1e-6
+	bright, dimmed := render(1), render(dim)
+	for y := 0; y < bright.height; y++ {
+		for x := 0; x < bright.width; x++ {
+			want := bright.color(x, y)
+			got := dimmed.color(x, y).Div(dim)
+			for i := range want {
+				if math.Abs(got[i]-want[i]) > 1e-9*want[i] {
+					t.Errorf("pixel %d, %d is %v dimmed, %v times brighter, want %v", x, y, dimmed.color(x, y), 1/dim, want)
+				}
+			}
+		}
+	}
+}
+
+// Fixed point sums come out the same in any order, for numbers of any sign
+// and size, and as close as a float64 gets to the exact sum
+func TestFixedSums(t *testing.T) {
+	xs := []float64{0.3, -1e-7, 2.5e-12, -17.25, 1e6, 3e-9, -0.75, 42, math.NaN()}
+	want := 0.3 - 1e-7 + 2.5e-12 - 17.25 + 1e6 + 3e-9 - 0.75 + 42
+
+	rnd := newStream(1)
+	var first fixed
+	for run := 0; run < 20; run++ {
+		var sum fixed
+		for _, i := range permutation(len(xs), rnd) {
+			sum = sum.add(toFixed(xs[i]))
+		}
+		if run == 0 {
+			first = sum
+		} else if sum != first {
+			t.Fatalf("sums in different orders are %v and %v", sum, first)
+		}
+	}
+	if got := first.float(); math.Abs(got-want) > 1e-9 {
+		t.Errorf("sum is %v, want %v", got, want)
+	}
+
+	for _, x := range []float64{0, 1, -1, 1e-7, -1e-7, 1e-15, -1e-15, 123.456, -123.456} {
+		// Truncated to a multiple of 2^-64
+		if got := toFixed(x).float(); math.Abs(got-x) > math.Ldexp(1, -64)+1e-15*math.Abs(x) {
+			t.Errorf("%v comes back from fixed point as %v", x, got)
+		}
+	}
+}
+
+func permutation(n int, rnd sampler) []int {
+	p := make([]int, n)
+	for i := range p {
+		j := randomInt(rnd, i+1)
+		p[i], p[j] = p[j], i
+	}
+	return p
+}
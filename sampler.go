@@ -0,0 +1,309 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"math/rand"
+	"sort"
+)
+
+// sampler gives the numbers in [0, 1) a pixel sample is made of. Every
+// number a sample takes is a dimension of it, in the order they are taken:
+// the jitter of the pixel, the lens, the time, then the bounces of the path.
+// Samplers that know every sample of a pixel can spread each dimension over
+// [0, 1) better than random numbers would, so the same number of samples has
+// less noise. Each worker has a sampler of its own.
+type sampler interface {
+	// startPixelSample starts sample index of pixel x, y from its first dimension
+	startPixelSample(x int, y int, index int)
+	get1D() float64
+	get2D() (float64, float64)
+}
+
+// samplers are made with the seed of the render and how many samples it
+// takes of every pixel, which is how many they spread over [0, 1)
+var samplers = map[string]func(seed int64, samplesPerPixel int) sampler{
+	"independent": func(seed int64, samplesPerPixel int) sampler { return newStream(seed) },
+	"stratified":  newStratifiedSampler,
+	"halton":      newHaltonSampler,
+	"sobol":       newSobolSampler,
+}
+
+func samplerNames() []string {
+	var names []string
+	for name := range samplers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// oneMinusEpsilon is the largest float64 below 1
+const oneMinusEpsilon = 0x1.fffffffffffffp-1
+
+// randomInt is a random number in [0, n)
+func randomInt(rnd sampler, n int) int {
+	i := int(rnd.get1D() * float64(n))
+	if i >= n {
+		return n - 1
+	}
+	return i
+}
+
+// independentSampler takes every dimension from a stream of random numbers,
+// from newStream until startPixelSample moves it to the pixel sample's
+type independentSampler struct {
+	seed   int64
+	source *splitMix
+	rnd    *rand.Rand
+}
+
+func (s *independentSampler) startPixelSample(x int, y int, index int) {
+	s.source.state = streamSeed(s.seed, sampleStream, x, y, index)
+}
+
+func (s *independentSampler) get1D() float64 {
+	return s.rnd.Float64()
+}
+
+func (s *independentSampler) get2D() (float64, float64) {
+	return s.rnd.Float64(), s.rnd.Float64()
+}
+
+// pixelSample is where in the pixels, their samples and the dimensions of
+// the samples a sampler is. Its hash gives each dimension of each pixel its
+// own scrambling, so pixels and dimensions don't repeat each other's
+// patterns.
+type pixelSample struct {
+	seed            int64
+	samplesPerPixel int
+	x, y            int
+	index           int
+	dimension       int
+}
+
+func (p *pixelSample) startPixelSample(x int, y int, index int) {
+	p.x, p.y, p.index, p.dimension = x, y, index, 0
+}
+
+// next moves on to the next dimension and returns the hash of the one it was at
+func (p *pixelSample) next() uint64 {
+	hash := streamSeed(p.seed, sampleStream, p.x, p.y, p.dimension)
+	p.dimension++
+	return hash
+}
+
+// nextStratum is next for samplers that spread samplesPerPixel samples:
+// it returns the index among them too. Samples past samplesPerPixel start
+// over with new hashes, so renders that go on for longer don't take the same
+// samples again.
+func (p *pixelSample) nextStratum() (hash uint64, index int) {
+	round := splitMix{p.next() + uint64(p.index/p.samplesPerPixel)}
+	return round.Uint64(), p.index % p.samplesPerPixel
+}
+
+// stratifiedSampler splits every 1D dimension into samplesPerPixel strata and
+// every 2D one into a grid of about as many cells, with one jittered sample
+// in each. The 2D ones are correlated multi-jittered (Kensler, "Correlated
+// Multi-Jittered Sampling"), so they are stratified along each axis too.
+type stratifiedSampler struct {
+	pixelSample
+}
+
+func newStratifiedSampler(seed int64, samplesPerPixel int) sampler {
+	return &stratifiedSampler{pixelSample{seed: seed, samplesPerPixel: samplesPerPixel}}
+}
+
+func (s *stratifiedSampler) get1D() float64 {
+	hash, index := s.nextStratum()
+	n := s.samplesPerPixel
+	stratum := permutationElement(uint32(index), uint32(n), uint32(hash))
+	jitter := randFloat(uint32(index), uint32(hash>>32))
+	return math.Min((float64(stratum)+jitter)/float64(n), oneMinusEpsilon)
+}
+
+func (s *stratifiedSampler) get2D() (float64, float64) {
+	hash, index := s.nextStratum()
+	// m columns by n rows, as square as it gets with at least samplesPerPixel cells
+	m := int(math.Sqrt(float64(s.samplesPerPixel)))
+	n := (s.samplesPerPixel + m - 1) / m
+	p := uint32(hash)
+
+	i := permutationElement(uint32(index), uint32(m*n), p*0x51633e2d)
+	sx := permutationElement(i%uint32(m), uint32(m), p*0x68bc21eb)
+	sy := permutationElement(i/uint32(m), uint32(n), p*0x02e5be93)
+	jx := randFloat(i, p*0x967a889b)
+	jy := randFloat(i, p*0x368cc8b7)
+	x := (float64(i%uint32(m)) + (float64(sy)+jx)/float64(n)) / float64(m)
+	y := (float64(i/uint32(m)) + (float64(sx)+jy)/float64(m)) / float64(n)
+	return math.Min(x, oneMinusEpsilon), math.Min(y, oneMinusEpsilon)
+}
+
+// haltonSampler takes dimension d of sample i from the radical inverse of i
+// in the d-th prime base. Every pixel and dimension scrambles the digits in
+// its own way, which keeps the high dimensions from lining up and the pixels
+// from looking the same. Dimensions past the last prime are random.
+type haltonSampler struct {
+	pixelSample
+}
+
+func newHaltonSampler(seed int64, samplesPerPixel int) sampler {
+	return &haltonSampler{pixelSample{seed: seed, samplesPerPixel: samplesPerPixel}}
+}
+
+// haltonPrimes are the bases of the dimensions of a haltonSampler
+var haltonPrimes = primesBelow(1000)
+
+func primesBelow(n int) []uint64 {
+	composite := make([]bool, n)
+	var primes []uint64
+	for i := 2; i < n; i++ {
+		if composite[i] {
+			continue
+		}
+		primes = append(primes, uint64(i))
+		for j := i * i; j < n; j += i {
+			composite[j] = true
+		}
+	}
+	return primes
+}
+
+func (s *haltonSampler) get1D() float64 {
+	dimension := s.dimension
+	hash := s.next()
+	if dimension >= len(haltonPrimes) {
+		return float64(streamSeed(int64(hash), s.index)>>11) / (1 << 53)
+	}
+	return scrambledRadicalInverse(haltonPrimes[dimension], uint64(s.index), hash)
+}
+
+func (s *haltonSampler) get2D() (float64, float64) {
+	return s.get1D(), s.get1D()
+}
+
+// scrambledRadicalInverse mirrors the digits of index in base around the
+// decimal point, putting every digit (even the zeros past the last one)
+// through a random permutation of its own
+func scrambledRadicalInverse(base uint64, index uint64, hash uint64) float64 {
+	invBase := 1 / float64(base)
+	scale := invBase
+	result := 0.0
+	digits := splitMix{hash}
+	for scale > 1e-17 {
+		digit := permutationElement(uint32(index%base), uint32(base), uint32(digits.Uint64()))
+		result += float64(digit) * scale
+		index /= base
+		scale *= invBase
+	}
+	return math.Min(result, oneMinusEpsilon)
+}
+
+// sobolSampler pads samples out of 2D Sobol points: every dimension (or pair
+// of them) is the first two dimensions of the Sobol sequence, with the order
+// of the points shuffled and their bits Owen scrambled by a hash of the pixel
+// and dimension. The shuffle is itself an Owen scrambling of the index, which
+// keeps the first 2^k samples of a pixel well spread for every k (Burley,
+// "Practical Hash-based Owen Scrambling"), so it is best with a power of two
+// samples per pixel.
+type sobolSampler struct {
+	pixelSample
+}
+
+func newSobolSampler(seed int64, samplesPerPixel int) sampler {
+	return &sobolSampler{pixelSample{seed: seed, samplesPerPixel: samplesPerPixel}}
+}
+
+func (s *sobolSampler) get1D() float64 {
+	hash := s.next()
+	i := owenScramble(uint32(s.index), uint32(hash))
+	return sobolSample(i, 0, uint32(hash>>32))
+}
+
+func (s *sobolSampler) get2D() (float64, float64) {
+	hash := s.next()
+	i := owenScramble(uint32(s.index), uint32(hash))
+	return sobolSample(i, 0, uint32(hash>>32)), sobolSample(i, 1, uint32(hash>>16)^uint32(hash>>48))
+}
+
+// sobolSample is dimension 0 or 1 of the Sobol point i, Owen scrambled with seed
+func sobolSample(i uint32, dimension int, seed uint32) float64 {
+	var v uint32
+	if dimension == 0 {
+		// The van der Corput sequence
+		v = bits.Reverse32(i)
+	} else {
+		// Direction numbers v_k = v_{k-1} ^ v_{k-1}>>1, from v_0 = 1<<31
+		direction := uint32(1 << 31)
+		for ; i != 0; i >>= 1 {
+			if i&1 != 0 {
+				v ^= direction
+			}
+			direction ^= direction >> 1
+		}
+	}
+	v = owenScramble(v, seed)
+	return math.Min(float64(v)/(1<<32), oneMinusEpsilon)
+}
+
+// owenScramble flips every bit of v depending on the bits above it, a
+// hash based Owen scrambling (Burley, "Practical Hash-based Owen Scrambling")
+func owenScramble(v uint32, seed uint32) uint32 {
+	v = bits.Reverse32(v)
+	v ^= v * 0x3d20adea
+	v += seed
+	v *= (seed >> 16) | 1
+	v ^= v * 0x05526c56
+	v ^= v * 0x53a22864
+	return bits.Reverse32(v)
+}
+
+// permutationElement is where i goes in a random permutation of [0, l)
+// chosen by p, without making the permutation (Kensler's permute)
+func permutationElement(i uint32, l uint32, p uint32) uint32 {
+	w := l - 1
+	w |= w >> 1
+	w |= w >> 2
+	w |= w >> 4
+	w |= w >> 8
+	w |= w >> 16
+	for {
+		i ^= p
+		i *= 0xe170893d
+		i ^= p >> 16
+		i ^= (i & w) >> 4
+		i ^= p >> 8
+		i *= 0x0929eb3f
+		i ^= p >> 23
+		i ^= (i & w) >> 1
+		i *= 1 | p>>27
+		i *= 0x6935fa69
+		i ^= (i & w) >> 11
+		i *= 0x74dcb303
+		i ^= (i & w) >> 2
+		i *= 0x9e501cc3
+		i ^= (i & w) >> 2
+		i *= 0xc860a3df
+		i &= w
+		i ^= i >> 5
+		if i < l {
+			break
+		}
+	}
+	return (i + p) % l
+}
+
+// randFloat is a number in [0, 1) that looks random, chosen by i and p
+func randFloat(i uint32, p uint32) float64 {
+	i ^= p
+	i ^= i >> 17
+	i ^= i >> 10
+	i *= 0xb36534e5
+	i ^= i >> 12
+	i ^= i >> 21
+	i *= 0x93fc4795
+	i ^= 0xdf6e307f
+	i ^= i >> 17
+	i *= 1 | p>>18
+	return float64(i) / 4294967808
+}
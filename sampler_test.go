@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// drawSample takes dimensions of sample index of pixel x, y: four 1D ones
+// then four 2D ones
+func drawSample(s sampler, x int, y int, index int) []float64 {
+	s.startPixelSample(x, y, index)
+	var values []float64
+	for d := 0; d < 4; d++ {
+		values = append(values, s.get1D())
+	}
+	for d := 0; d < 4; d++ {
+		u, v := s.get2D()
+		values = append(values, u, v)
+	}
+	return values
+}
+
+// Every sampler gives numbers in [0, 1) that only depend on the seed, the
+// pixel, the sample and the dimension, not on what the sampler did before
+func TestSamplersAreDeterministic(t *testing.T) {
+	const spp = 16
+	pixels := [][2]int{{0, 0}, {1, 0}, {7, 3}, {640, 480}}
+	for _, name := range samplerNames() {
+		t.Run(name, func(t *testing.T) {
+			first := samplers[name](1, spp)
+			want := map[string][]float64{}
+			for _, p := range pixels {
+				for i := 0; i < 2*spp; i++ {
+					values := drawSample(first, p[0], p[1], i)
+					for d, v := range values {
+						if v < 0 || v >= 1 {
+							t.Fatalf("pixel %v sample %d dimension %d is %v", p, i, d, v)
+						}
+					}
+					want[fmt.Sprint(p, i)] = values
+				}
+			}
+
+			// A new sampler taking the samples backwards
+			second := samplers[name](1, spp)
+			for j := len(pixels) - 1; j >= 0; j-- {
+				p := pixels[j]
+				for i := 2*spp - 1; i >= 0; i-- {
+					if got := drawSample(second, p[0], p[1], i); fmt.Sprint(got) != fmt.Sprint(want[fmt.Sprint(p, i)]) {
+						t.Fatalf("pixel %v sample %d is %v the second time, want %v", p, i, got, want[fmt.Sprint(p, i)])
+					}
+				}
+			}
+
+			other := samplers[name](2, spp)
+			if got := drawSample(other, 7, 3, 0); fmt.Sprint(got) == fmt.Sprint(want[fmt.Sprint(pixels[2], 0)]) {
+				t.Errorf("seeds 1 and 2 give the same sample %v", got)
+			}
+		})
+	}
+}
+
+// stratified tells if there is one point in each of the nx by ny cells of [0, 1)²
+func stratified(points [][2]float64, nx int, ny int) bool {
+	seen := make([]bool, nx*ny)
+	for _, p := range points {
+		cell := int(p[1]*float64(ny))*nx + int(p[0]*float64(nx))
+		if seen[cell] {
+			return false
+		}
+		seen[cell] = true
+	}
+	return len(points) == nx*ny
+}
+
+// Samplers other than the independent one spread the samples of a pixel:
+// every dimension has one of them in each of spp strata, and the 2D ones in
+// each cell of a grid too
+func TestSamplersAreStratified(t *testing.T) {
+	tests := []struct {
+		name string
+		spp  int
+		// dimensions the 1D test takes, all of them stratified
+		dimensions1D int
+		grids        [][2]int //cells of the grids the first 2D dimension is stratified in
+	}{
+		{"stratified", 16, 4, [][2]int{{4, 4}, {16, 1}, {1, 16}}},
+		{"stratified", 12, 4, [][2]int{{3, 4}, {12, 1}, {1, 12}}},
+		{"sobol", 16, 4, [][2]int{{4, 4}, {2, 8}, {8, 2}, {16, 1}, {1, 16}}},
+		{"sobol", 64, 4, [][2]int{{8, 8}, {4, 16}, {64, 1}, {1, 64}}},
+		// Only the first dimension of a haltonSampler is in base 2, and its
+		// first 2D point is in bases 2 and 3
+		{"halton", 16, 1, nil},
+		{"halton", 6, 0, [][2]int{{2, 3}}},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s/%d", test.name, test.spp), func(t *testing.T) {
+			s := samplers[test.name](1, test.spp)
+			for _, p := range [][2]int{{0, 0}, {3, 9}} {
+				// Every round of spp samples is stratified on its own
+				for round := 0; round < 2; round++ {
+					oneD := make([][][2]float64, test.dimensions1D)
+					var twoD [][2]float64
+					for i := round * test.spp; i < (round+1)*test.spp; i++ {
+						s.startPixelSample(p[0], p[1], i)
+						for d := range oneD {
+							oneD[d] = append(oneD[d], [2]float64{s.get1D(), 0})
+						}
+						s.startPixelSample(p[0], p[1], i)
+						u, v := s.get2D()
+						twoD = append(twoD, [2]float64{u, v})
+					}
+					for d, values := range oneD {
+						if !stratified(values, test.spp, 1) {
+							t.Errorf("pixel %v round %d: dimension %d isn't stratified: %v", p, round, d, values)
+						}
+					}
+					for _, grid := range test.grids {
+						if !stratified(twoD, grid[0], grid[1]) {
+							t.Errorf("pixel %v round %d: 2D points aren't one in each of %dx%d cells: %v", p, round, grid[0], grid[1], twoD)
+						}
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,815 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sceneLoader turns a scene description file (see scenes/README.md) into the
+// same hittable/material/texture graph the Go scenes build by hand.
+// The first error found is kept in err and later lookups become no-ops, so
+// the builders below read straight through without checking at every step.
+type sceneLoader struct {
+	path string
+	dir  string
+	err  error
+
+	textures  map[string]texture
+	materials map[string]material
+	geometry  map[string]hittable
+
+	// Shutter times of the file's camera, nested bvhs are built for them
+	time0, time1 float64
+
+	rnd sampler //for noise textures
+
+	files []string //every other file read, for the checkpoint's renderHash
+}
+
+func loadSceneFile(path string, rnd sampler) (sceneInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return sceneInfo{}, err
+	}
+
+	root, err := parseJSON(data)
+	if err != nil {
+		return sceneInfo{}, fmt.Errorf("%s:%v", path, err)
+	}
+
+	l := sceneLoader{
+		path:      path,
+		dir:       filepath.Dir(path),
+		textures:  map[string]texture{},
+		materials: map[string]material{},
+		geometry:  map[string]hittable{},
+		rnd:       rnd,
+	}
+	scene := l.scene(root)
+	if l.err != nil {
+		return sceneInfo{}, l.err
+	}
+	scene.files = l.files
+	return scene, nil
+}
+
+func (l *sceneLoader) fail(n *jsonNode, format string, args ...interface{}) {
+	if l.err == nil {
+		l.err = fmt.Errorf("%s:%s: %s", l.path, n.pos(), fmt.Sprintf(format, args...))
+	}
+}
+
+func (l *sceneLoader) expect(n *jsonNode, kind jsonKind, what string) bool {
+	if l.err != nil {
+		return false
+	}
+	if n.kind != kind {
+		l.fail(n, "%s must be a %v, got %v", what, kind, n.kind)
+		return false
+	}
+	return true
+}
+
+// done reports the first key of an object that no builder asked for, which
+// is almost always a typo
+func (l *sceneLoader) done(n *jsonNode, what string) {
+	if key, ok := n.unusedKey(); ok && l.err == nil {
+		l.fail(n.fields[key], "unknown field %q in %s", key, what)
+	}
+}
+
+func (l *sceneLoader) required(obj *jsonNode, name string, what string) *jsonNode {
+	f := obj.field(name)
+	if f == nil {
+		l.fail(obj, "%s is missing field %q", what, name)
+	}
+	return f
+}
+
+func (l *sceneLoader) number(obj *jsonNode, name string, what string) float64 {
+	f := l.required(obj, name, what)
+	if f == nil || !l.expect(f, jsonNumber, what+" "+name) {
+		return 0
+	}
+	return f.number
+}
+
+func (l *sceneLoader) optNumber(obj *jsonNode, name string, what string, def float64) float64 {
+	if obj.field(name) == nil {
+		return def
+	}
+	return l.number(obj, name, what)
+}
+
+func (l *sceneLoader) integer(obj *jsonNode, name string, what string, def int) int {
+	if obj.field(name) == nil {
+		return def
+	}
+	x := l.number(obj, name, what)
+	if x != float64(int(x)) {
+		l.fail(obj.field(name), "%s %s must be a whole number", what, name)
+	}
+	return int(x)
+}
+
+func (l *sceneLoader) vecValue(n *jsonNode, what string) Vec3 {
+	var v Vec3
+	if !l.expect(n, jsonArray, what) {
+		return v
+	}
+	if len(n.items) != 3 {
+		l.fail(n, "%s must have 3 components, got %d", what, len(n.items))
+		return v
+	}
+	for i, item := range n.items {
+		if !l.expect(item, jsonNumber, what) {
+			return v
+		}
+		v[i] = item.number
+	}
+	return v
+}
+
+func (l *sceneLoader) vec3(obj *jsonNode, name string, what string) Vec3 {
+	f := l.required(obj, name, what)
+	if f == nil {
+		return Vec3{}
+	}
+	return l.vecValue(f, what+" "+name)
+}
+
+func (l *sceneLoader) optVec3(obj *jsonNode, name string, what string, def Vec3) Vec3 {
+	if obj.field(name) == nil {
+		return def
+	}
+	return l.vec3(obj, name, what)
+}
+
+func (l *sceneLoader) str(obj *jsonNode, name string, what string) string {
+	f := l.required(obj, name, what)
+	if f == nil || !l.expect(f, jsonString, what+" "+name) {
+		return ""
+	}
+	return f.str
+}
+
+// typeOf returns the "type" member every texture, material and object has
+func (l *sceneLoader) typeOf(n *jsonNode, what string) string {
+	if !l.expect(n, jsonObject, what) {
+		return ""
+	}
+	return l.str(n, "type", what)
+}
+
+// resolve makes paths in the scene file relative to the file itself, and
+// records them as read
+func (l *sceneLoader) resolve(path string) string {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(l.dir, path)
+	}
+	l.files = append(l.files, path)
+	return path
+}
+
+func (l *sceneLoader) scene(root *jsonNode) sceneInfo {
+	scene := sceneInfo{
+		name: strings.TrimSuffix(filepath.Base(l.path), filepath.Ext(l.path)),
+		opts: defaultOptions(),
+		cam:  defaultCamera(),
+	}
+	if !l.expect(root, jsonObject, "scene") {
+		return scene
+	}
+
+	if cam := root.field("camera"); cam != nil {
+		scene.cam = l.camera(cam)
+	}
+	l.time0, l.time1 = scene.cam.time0, scene.cam.time1
+	if opts := root.field("options"); opts != nil {
+		scene.opts = l.options(opts)
+	}
+
+	if textures := root.field("textures"); textures != nil && l.expect(textures, jsonObject, "textures") {
+		for _, name := range textures.keys {
+			textures.used[name] = true
+			l.textures[name] = l.texture(textures.fields[name])
+		}
+	}
+	if materials := root.field("materials"); materials != nil && l.expect(materials, jsonObject, "materials") {
+		for _, name := range materials.keys {
+			materials.used[name] = true
+			l.materials[name] = l.material(materials.fields[name])
+		}
+	}
+
+	if geometry := root.field("geometry"); geometry != nil && l.expect(geometry, jsonObject, "geometry") {
+		for _, name := range geometry.keys {
+			geometry.used[name] = true
+			obj := l.object(geometry.fields[name])
+			// Shared geometry is traced once per instance, flatten it up front
+			if bvh, ok := obj.(*bvhNode); ok {
+				obj = newLinearBvh(bvh)
+			}
+			l.geometry[name] = obj
+		}
+	}
+
+	objects := l.objectList(root, "objects", "scene")
+	if len(objects) == 0 && l.err == nil {
+		l.fail(root, "scene has no objects")
+	}
+
+	// Without a lights list they are collected from the objects
+	var lights *hittableList
+	if f := root.field("lights"); f != nil {
+		lights = &hittableList{l.objectList(root, "lights", "scene")}
+		for i, obj := range lights.objects {
+			if err := validateLights(obj); err != nil && l.err == nil {
+				l.fail(f.items[i], "%v", err)
+			}
+		}
+	}
+
+	l.done(root, "scene")
+
+	// Check the objects can go in a bvh now, to report errors where they are
+	l.bounded(root, nil, func() hittable { return newBvhNode(objects, scene.cam.time0, scene.cam.time1) })
+	if l.err != nil {
+		return scene
+	}
+	scene.build = func(time0 float64, time1 float64, rnd sampler) hittable { return newBvhNode(objects, time0, time1) }
+	if lights != nil {
+		scene.lights = lights
+	}
+	return scene
+}
+
+func (l *sceneLoader) camera(n *jsonNode) cameraSettings {
+	c := defaultCamera()
+	if !l.expect(n, jsonObject, "camera") {
+		return c
+	}
+	c.lookFrom = l.vec3(n, "lookFrom", "camera")
+	c.lookAt = l.vec3(n, "lookAt", "camera")
+	c.up = l.optVec3(n, "up", "camera", c.up)
+	c.vfov = l.optNumber(n, "vfov", "camera", c.vfov)
+	c.aperture = l.optNumber(n, "aperture", "camera", c.aperture)
+	c.focusDist = l.optNumber(n, "focusDist", "camera", c.focusDist)
+	c.time0 = l.optNumber(n, "time0", "camera", c.time0)
+	c.time1 = l.optNumber(n, "time1", "camera", c.time1)
+	if c.time1 < c.time0 && l.err == nil {
+		l.fail(n, "camera time1 must not be before time0")
+	}
+	l.done(n, "camera")
+	return c
+}
+
+func (l *sceneLoader) options(n *jsonNode) options {
+	o := defaultOptions()
+	if !l.expect(n, jsonObject, "options") {
+		return o
+	}
+	if f := n.field("aspectRatio"); f != nil {
+		switch f.kind {
+		case jsonString:
+			r, err := parseAspectRatio(f.str)
+			if err != nil {
+				l.fail(f, "invalid aspectRatio %q: %v", f.str, err)
+			}
+			o.aspectRatio = r
+		default:
+			o.aspectRatio = l.number(n, "aspectRatio", "options")
+		}
+	}
+	o.imageWidth = l.integer(n, "width", "options", o.imageWidth)
+	o.samplesPerPixel = l.integer(n, "samplesPerPixel", "options", o.samplesPerPixel)
+	o.maxDepth = l.integer(n, "maxDepth", "options", o.maxDepth)
+	o.rouletteDepth = l.integer(n, "rouletteDepth", "options", o.rouletteDepth)
+	o.background = l.optVec3(n, "background", "options", o.background)
+	o.filterRadius = l.optNumber(n, "filterRadius", "options", o.filterRadius)
+	o.photons = l.integer(n, "photons", "options", o.photons)
+	o.photonRadius = l.optNumber(n, "photonRadius", "options", o.photonRadius)
+	if f := n.field("integrator"); f != nil && l.expect(f, jsonString, "options integrator") {
+		if _, ok := integrators[f.str]; !ok {
+			l.fail(f, "unknown integrator %q, expected one of %s", f.str, strings.Join(integratorNames(), ", "))
+		}
+		o.integrator = f.str
+	}
+	if f := n.field("sampler"); f != nil && l.expect(f, jsonString, "options sampler") {
+		if _, ok := samplers[f.str]; !ok {
+			l.fail(f, "unknown sampler %q, expected one of %s", f.str, strings.Join(samplerNames(), ", "))
+		}
+		o.sampler = f.str
+	}
+	if f := n.field("filter"); f != nil && l.expect(f, jsonString, "options filter") {
+		if _, ok := filters[f.str]; !ok {
+			l.fail(f, "unknown filter %q, expected one of %s", f.str, strings.Join(filterNames(), ", "))
+		}
+		o.filter = f.str
+	}
+	if l.err == nil && (o.aspectRatio <= 0 || o.imageWidth <= 0 || o.samplesPerPixel <= 0 || o.maxDepth <= 0) {
+		l.fail(n, "aspectRatio, width, samplesPerPixel and maxDepth must be positive")
+	}
+	if l.err == nil && o.rouletteDepth < 0 {
+		l.fail(n, "rouletteDepth cannot be negative")
+	}
+	if l.err == nil && o.filterRadius < 0 {
+		l.fail(n, "filterRadius cannot be negative")
+	}
+	if l.err == nil && (o.photons <= 0 || o.photonRadius < 0) {
+		l.fail(n, "photons must be positive and photonRadius cannot be negative")
+	}
+	l.done(n, "options")
+	return o
+}
+
+// texture accepts a color ([r, g, b]), the name of a texture from the
+// "textures" section or an inline texture object
+func (l *sceneLoader) texture(n *jsonNode) texture {
+	if l.err != nil {
+		return nil
+	}
+
+	switch n.kind {
+	case jsonArray:
+		return solidColor{l.vecValue(n, "color")}
+	case jsonString:
+		tex, ok := l.textures[n.str]
+		if !ok {
+			l.fail(n, "unknown texture %q", n.str)
+		}
+		return tex
+	}
+
+	var tex texture
+	switch typ := l.typeOf(n, "texture"); typ {
+	case "":
+	case "solidColor":
+		tex = solidColor{l.vec3(n, "color", typ)}
+	case "checkerTexture":
+		odd := l.required(n, "odd", typ)
+		even := l.required(n, "even", typ)
+		if odd != nil && even != nil {
+			tex = checkerTexture{l.texture(odd), l.texture(even)}
+		}
+	case "noiseTexture":
+		tex = noiseTexture{newPerlin(l.rnd), l.number(n, "scale", typ)}
+	case "vertexColor":
+		tex = vertexColorTexture{}
+	case "imageTexture":
+		file := l.str(n, "file", typ)
+		if l.err == nil {
+			img, err := loadImageTexture(l.resolve(file))
+			if err != nil {
+				l.fail(n.field("file"), "%v", err)
+			}
+			tex = img
+		}
+	default:
+		l.fail(n.field("type"), "unknown texture type %q", typ)
+	}
+	l.done(n, "texture")
+	return tex
+}
+
+// material accepts the name of a material from the "materials" section or an
+// inline material object
+func (l *sceneLoader) material(n *jsonNode) material {
+	if l.err != nil {
+		return nil
+	}
+
+	if n.kind == jsonString {
+		mat, ok := l.materials[n.str]
+		if !ok {
+			l.fail(n, "unknown material %q", n.str)
+		}
+		return mat
+	}
+
+	var mat material
+	switch typ := l.typeOf(n, "material"); typ {
+	case "":
+	case "lambertian":
+		if f := l.required(n, "albedo", typ); f != nil {
+			mat = lambertian{l.texture(f)}
+		}
+	case "metal":
+		mat = metal{l.vec3(n, "albedo", typ), l.optNumber(n, "fuzz", typ, 0)}
+	case "dielectric":
+		mat = dielectric{l.number(n, "ir", typ)}
+	case "diffuseLight":
+		if f := l.required(n, "emit", typ); f != nil {
+			mat = diffuseLight{l.texture(f)}
+		}
+	case "isotropic":
+		if f := l.required(n, "albedo", typ); f != nil {
+			mat = isotropic{l.texture(f)}
+		}
+	default:
+		l.fail(n.field("type"), "unknown material type %q", typ)
+	}
+	l.done(n, "material")
+	return mat
+}
+
+func (l *sceneLoader) objectMaterial(n *jsonNode, typ string) material {
+	f := l.required(n, "material", typ)
+	if f == nil {
+		return nil
+	}
+	return l.material(f)
+}
+
+func (l *sceneLoader) objectList(obj *jsonNode, name string, what string) []hittable {
+	f := l.required(obj, name, what)
+	if f == nil || !l.expect(f, jsonArray, what+" "+name) {
+		return nil
+	}
+	objects := make([]hittable, 0, len(f.items))
+	for _, item := range f.items {
+		if h := l.object(item); h != nil {
+			objects = append(objects, h)
+		}
+	}
+	return objects
+}
+
+func (l *sceneLoader) child(n *jsonNode, name string, typ string) hittable {
+	f := l.required(n, name, typ)
+	if f == nil {
+		return nil
+	}
+	return l.object(f)
+}
+
+func (l *sceneLoader) object(n *jsonNode) hittable {
+	if l.err != nil {
+		return nil
+	}
+
+	var obj hittable
+	switch typ := l.typeOf(n, "object"); typ {
+	case "":
+	case "sphere":
+		obj = &sphere{l.vec3(n, "center", typ), l.number(n, "radius", typ), l.objectMaterial(n, typ)}
+	case "movingSphere":
+		obj = &movingSphere{
+			l.vec3(n, "center0", typ), l.vec3(n, "center1", typ),
+			l.optNumber(n, "time0", typ, 0), l.optNumber(n, "time1", typ, 1),
+			l.number(n, "radius", typ), l.objectMaterial(n, typ),
+		}
+	case "xyRect":
+		obj = &xyRect{l.objectMaterial(n, typ),
+			l.number(n, "x0", typ), l.number(n, "x1", typ),
+			l.number(n, "y0", typ), l.number(n, "y1", typ), l.number(n, "k", typ)}
+	case "xzRect":
+		obj = &xzRect{l.objectMaterial(n, typ),
+			l.number(n, "x0", typ), l.number(n, "x1", typ),
+			l.number(n, "z0", typ), l.number(n, "z1", typ), l.number(n, "k", typ)}
+	case "yzRect":
+		obj = &yzRect{l.objectMaterial(n, typ),
+			l.number(n, "y0", typ), l.number(n, "y1", typ),
+			l.number(n, "z0", typ), l.number(n, "z1", typ), l.number(n, "k", typ)}
+	case "triangle":
+		mat := l.objectMaterial(n, typ)
+		tri, err := newTriangle(l.vec3(n, "v0", typ), l.vec3(n, "v1", typ), l.vec3(n, "v2", typ), mat)
+		if err != nil && l.err == nil {
+			l.fail(n, "%v", err)
+		}
+		obj = tri
+	case "mesh":
+		obj = l.mesh(n, typ)
+	case "obj", "ply", "stl":
+		obj = l.model(n, typ)
+	case "box":
+		obj = newBox(l.vec3(n, "min", typ), l.vec3(n, "max", typ), l.objectMaterial(n, typ))
+	case "translate":
+		offset := l.vec3(n, "offset", typ)
+		if child := l.child(n, "object", typ); child != nil {
+			obj = &translate{child, offset}
+		}
+	case "rotateY":
+		angle := l.number(n, "angle", typ)
+		if child := l.child(n, "object", typ); child != nil {
+			obj = l.bounded(n, child, func() hittable { return newRotateY(child, angle) })
+		}
+	case "instance":
+		geometry := l.str(n, "geometry", typ)
+		m := l.transform(n, typ)
+		if l.err != nil {
+			break
+		}
+		shared, ok := l.geometry[geometry]
+		if !ok {
+			l.fail(n.field("geometry"), "unknown geometry %q", geometry)
+			break
+		}
+		if _, ok := shared.boundingBox(0, 1); !ok {
+			l.fail(n.field("geometry"), "geometry %q has no bounding box", geometry)
+			break
+		}
+		obj = l.transformed(n, shared, m)
+	case "transform":
+		m := l.transform(n, typ)
+		if child := l.child(n, "object", typ); child != nil {
+			obj = l.transformed(n, child, m)
+		}
+	case "animated":
+		keys := l.keyframes(n, typ)
+		if child := l.child(n, "object", typ); child != nil {
+			a, err := newAnimatedTransform(child, keys)
+			if err != nil {
+				l.fail(n.field("keyframes"), "%v", err)
+			}
+			obj = a
+		}
+	case "flipFace":
+		if child := l.child(n, "object", typ); child != nil {
+			obj = &flipFace{child}
+		}
+	case "constantMedium":
+		density := l.number(n, "density", typ)
+		if density <= 0 && l.err == nil {
+			l.fail(n.field("density"), "constantMedium density must be positive")
+		}
+		var albedo texture
+		if f := l.required(n, "albedo", typ); f != nil {
+			albedo = l.texture(f)
+		}
+		if child := l.child(n, "boundary", typ); child != nil {
+			obj = newConstantMedium(child, density, albedo)
+		}
+	case "list":
+		var list hittableList
+		list.objects = l.objectList(n, "objects", typ)
+		obj = &list
+	case "bvh":
+		objects := l.objectList(n, "objects", typ)
+		if len(objects) == 0 && l.err == nil {
+			l.fail(n, "bvh needs at least one object")
+		}
+		obj = l.bounded(n, nil, func() hittable { return newBvhNode(objects, l.time0, l.time1) })
+	default:
+		l.fail(n.field("type"), "unknown object type %q", typ)
+	}
+	if f := n.field("important"); f != nil && l.expect(f, jsonBool, "important") && f.boolean && obj != nil {
+		if err := validateLights(obj); err != nil {
+			l.fail(f, "%v", err)
+		}
+		obj = &important{obj}
+	}
+	l.done(n, "object")
+	if l.err != nil {
+		return nil
+	}
+	return obj
+}
+
+func (l *sceneLoader) transformed(n *jsonNode, obj hittable, m Mat4) hittable {
+	if l.err != nil {
+		return nil
+	}
+	t, err := newTransform(obj, m)
+	if err != nil {
+		l.fail(n.field("transform"), "%v", err)
+		return nil
+	}
+	return t
+}
+
+// transform reads an optional list of steps (see scenes/README.md) and
+// composes them, the first step being applied first
+func (l *sceneLoader) transform(n *jsonNode, typ string) Mat4 {
+	m := Identity4()
+	f := n.field("transform")
+	if f == nil || !l.expect(f, jsonArray, typ+" transform") {
+		return m
+	}
+
+	for _, step := range f.items {
+		if !l.expect(step, jsonObject, "transform step") {
+			return m
+		}
+		if len(step.keys) != 1 {
+			l.fail(step, "transform step must have exactly one field")
+			return m
+		}
+
+		var s Mat4
+		switch key := step.keys[0]; key {
+		case "translate":
+			s = Translate4(l.vec3(step, key, "transform"))
+		case "rotateX":
+			s = RotateX4(l.number(step, key, "transform"))
+		case "rotateY":
+			s = RotateY4(l.number(step, key, "transform"))
+		case "rotateZ":
+			s = RotateZ4(l.number(step, key, "transform"))
+		case "rotate":
+			if r := step.field(key); l.expect(r, jsonObject, "rotate") {
+				axis := l.vec3(r, "axis", "rotate")
+				angle := l.number(r, "angle", "rotate")
+				l.done(r, "rotate")
+				if axis.NearZero() && l.err == nil {
+					l.fail(r, "rotate axis can't be zero")
+				}
+				s = RotateAxis4(axis, angle)
+			}
+		case "scale":
+			if v := step.field(key); v.kind == jsonNumber {
+				s = Scale4(Vec3{v.number, v.number, v.number})
+			} else {
+				s = Scale4(l.vec3(step, key, "transform"))
+			}
+		case "matrix":
+			s = l.matrix(step.field(key))
+		default:
+			l.fail(step, "unknown transform step %q", key)
+		}
+		m = s.Mul(m)
+	}
+	return m
+}
+
+// keyframes reads the keyframes of an animated object. Each one has a time
+// and optionally a translate, rotate ({"axis": [x, y, z], "angle": degrees})
+// and scale (a number or [x, y, z]).
+func (l *sceneLoader) keyframes(n *jsonNode, typ string) []keyframe {
+	f := l.required(n, "keyframes", typ)
+	if f == nil || !l.expect(f, jsonArray, typ+" keyframes") {
+		return nil
+	}
+
+	keys := make([]keyframe, 0, len(f.items))
+	for _, item := range f.items {
+		if !l.expect(item, jsonObject, "keyframe") {
+			return nil
+		}
+		k := keyframe{
+			time:        l.number(item, "time", "keyframe"),
+			translation: l.optVec3(item, "translate", "keyframe", Vec3{}),
+			rotation:    Quat{0, 0, 0, 1},
+			scale:       Vec3{1, 1, 1},
+		}
+		if r := item.field("rotate"); r != nil && l.expect(r, jsonObject, "keyframe rotate") {
+			axis := l.vec3(r, "axis", "rotate")
+			angle := l.number(r, "angle", "rotate")
+			l.done(r, "rotate")
+			if axis.NearZero() && l.err == nil {
+				l.fail(r, "rotate axis can't be zero")
+			}
+			k.rotation = QuatAxisAngle(axis, angle)
+		}
+		if sc := item.field("scale"); sc != nil {
+			if sc.kind == jsonNumber {
+				k.scale = Vec3{sc.number, sc.number, sc.number}
+			} else {
+				k.scale = l.vec3(item, "scale", "keyframe")
+			}
+		}
+		l.done(item, "keyframe")
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// matrix reads an affine matrix as 3 or 4 rows of 4 numbers
+func (l *sceneLoader) matrix(n *jsonNode) Mat4 {
+	m := Identity4()
+	if !l.expect(n, jsonArray, "matrix") {
+		return m
+	}
+	if len(n.items) != 3 && len(n.items) != 4 {
+		l.fail(n, "matrix must have 3 or 4 rows, got %d", len(n.items))
+		return m
+	}
+	for i, row := range n.items {
+		if !l.expect(row, jsonArray, "matrix row") {
+			return m
+		}
+		if len(row.items) != 4 {
+			l.fail(row, "matrix row must have 4 numbers, got %d", len(row.items))
+			return m
+		}
+		for j, item := range row.items {
+			if !l.expect(item, jsonNumber, "matrix element") {
+				return m
+			}
+			m[i][j] = item.number
+		}
+	}
+	if m[3] != [4]float64{0, 0, 0, 1} {
+		l.fail(n.items[3], "the last matrix row must be 0, 0, 0, 1")
+	}
+	return m
+}
+
+// model loads a mesh file. Without a material, models get a light gray
+// lambertian, or their vertex colors if they have them.
+func (l *sceneLoader) model(n *jsonNode, typ string) hittable {
+	file := l.str(n, "file", typ)
+	var mat material = lambertian{solidColor{Color3{0.73, 0.73, 0.73}}}
+	f := n.field("material")
+	if f != nil {
+		mat = l.material(f)
+	}
+	if l.err != nil {
+		return nil
+	}
+
+	var model hittable
+	var err error
+	switch typ {
+	case "obj":
+		var files []string
+		model, files, err = objModel(l.resolve(file), mat)
+		l.files = append(l.files, files...)
+	case "ply":
+		var m *triangleMesh
+		if m, err = loadPLY(l.resolve(file), mat); err == nil {
+			if m.colors != nil && f == nil {
+				m.mat = lambertian{vertexColorTexture{}}
+			}
+			model = m
+		}
+	case "stl":
+		model, err = loadSTL(l.resolve(file), mat)
+	}
+	if err != nil {
+		l.fail(n.field("file"), "%v", err)
+		return nil
+	}
+	return model
+}
+
+func (l *sceneLoader) mesh(n *jsonNode, typ string) hittable {
+	var positions, normals []Vec3
+	var uvs [][2]float64
+	var indices []int
+
+	if f := l.required(n, "positions", typ); f != nil && l.expect(f, jsonArray, "mesh positions") {
+		for _, item := range f.items {
+			positions = append(positions, l.vecValue(item, "mesh position"))
+		}
+	}
+	if f := n.field("normals"); f != nil && l.expect(f, jsonArray, "mesh normals") {
+		for _, item := range f.items {
+			normals = append(normals, l.vecValue(item, "mesh normal"))
+		}
+	}
+	if f := n.field("uvs"); f != nil && l.expect(f, jsonArray, "mesh uvs") {
+		for _, item := range f.items {
+			if !l.expect(item, jsonArray, "mesh uv") {
+				break
+			}
+			if len(item.items) != 2 || item.items[0].kind != jsonNumber || item.items[1].kind != jsonNumber {
+				l.fail(item, "mesh uv must be two numbers")
+				break
+			}
+			uvs = append(uvs, [2]float64{item.items[0].number, item.items[1].number})
+		}
+	}
+	if f := l.required(n, "indices", typ); f != nil && l.expect(f, jsonArray, "mesh indices") {
+		for _, item := range f.items {
+			if !l.expect(item, jsonNumber, "mesh index") {
+				break
+			}
+			indices = append(indices, int(item.number))
+		}
+	}
+	mat := l.objectMaterial(n, typ)
+	if l.err != nil {
+		return nil
+	}
+
+	m, err := newTriangleMesh(positions, normals, uvs, indices, mat)
+	if err != nil {
+		l.fail(n, "%v", err)
+		return nil
+	}
+	return m
+}
+
+// bounded runs a constructor that needs bounding boxes, turning its panic
+// into an error at n (e.g. an empty list inside a bvh)
+func (l *sceneLoader) bounded(n *jsonNode, child hittable, build func() hittable) (h hittable) {
+	if l.err != nil {
+		return nil
+	}
+	if child != nil {
+		if _, ok := child.boundingBox(0, 1); !ok {
+			l.fail(n, "object has no bounding box")
+			return nil
+		}
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			l.fail(n, "%v", r)
+			h = nil
+		}
+	}()
+	return build()
+}
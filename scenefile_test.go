@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSceneFileErrorPositions(t *testing.T) {
+	tests := []struct {
+		name  string
+		scene string
+		at    string //the error must point at the first place this is in the scene
+		want  string //and have this message
+	}{
+		{
+			"type error",
+			`{
+  "materials": {"white": {"type": "lambertian", "albedo": [0.73, 0.73, 0.73]}},
+  "objects": [
+    {"type": "sphere", "center": [0, 0, 0], "radius": "big", "material": "white"}
+  ]
+}`,
+			`"big"`,
+			`sphere radius must be a number, got string`,
+		},
+		{
+			"unknown key",
+			`{
+  "materials": {"white": {"type": "lambertian", "albedo": [0.73, 0.73, 0.73]}},
+  "objects": [
+    {"type": "sphere", "center": [0, 0, 0], "radius": 1,
+     "material": "white", "colour": [1, 0, 0]}
+  ]
+}`,
+			`[1, 0, 0]`,
+			`unknown field "colour" in object`,
+		},
+		{
+			"syntax error",
+			"{\n  \"objects\": [,]\n}",
+			`,]`,
+			`invalid character ','`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "scene.json")
+			if err := os.WriteFile(path, []byte(tt.scene), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadSceneFile(path, newStream(1, sceneStream))
+			if err == nil {
+				t.Fatal("loaded a broken scene")
+			}
+			want := fmt.Sprintf("%s:%s: %s", path, position(tt.scene, tt.at), tt.want)
+			if !strings.HasPrefix(err.Error(), want) {
+				t.Errorf("error %q, want %q", err, want)
+			}
+		})
+	}
+}
+
+// position is the line:column of the first s in text, counting from 1
+func position(text string, s string) string {
+	before := text[:strings.Index(text, s)]
+	line := strings.Count(before, "\n") + 1
+	col := len(before) - strings.LastIndex(before, "\n")
+	return fmt.Sprintf("%d:%d", line, col)
+}
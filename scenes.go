@@ -2,10 +2,148 @@ package main
 
 import (
 	"math"
-	"math/rand"
 )
 
-func threeBallScene() hittable {
+// sceneInfo is a built-in scene together with the options and camera it was
+// designed for. Command line flags override these defaults.
+type sceneInfo struct {
+	name   string
+	build  func(time0 float64, time1 float64, rnd sampler) hittable //with the camera's shutter times
+	opts   options
+	cam    cameraSettings
+	lights hittable //importance sampled objects, nil to collect them from the world
+	files  []string //the meshes and images a scene file was built from
+}
+
+var (
+	skyBackground   = Color3{0.7, 0.8, 1.00}
+	blackBackground = Color3{0, 0, 0}
+)
+
+func defaultOptions() options {
+	return options{
+		aspectRatio:     16.0 / 9.0,
+		imageWidth:      800,
+		samplesPerPixel: 500,
+		maxDepth:        5,
+		background:      blackBackground,
+		integrator:      "mixture",
+		sampler:         "independent",
+		filter:          "box",
+		photons:         100000,
+	}
+}
+
+func defaultCamera() cameraSettings {
+	return cameraSettings{
+		up:        Vec3{0, 1, 0},
+		vfov:      40,
+		focusDist: 10,
+		time0:     0,
+		time1:     1,
+	}
+}
+
+func withOptions(f func(o *options)) options {
+	o := defaultOptions()
+	f(&o)
+	return o
+}
+
+func withCamera(f func(c *cameraSettings)) cameraSettings {
+	c := defaultCamera()
+	f(&c)
+	return c
+}
+
+// scenes lists every scene that can be selected with -scene, in -list-scenes order
+var scenes = []sceneInfo{
+	{name: "randomScene", build: randomScene,
+		opts: withOptions(func(o *options) { o.background = skyBackground }),
+		cam: withCamera(func(c *cameraSettings) {
+			c.lookFrom, c.lookAt = Point3{13, 2, 3}, Point3{0, 0, 0}
+			c.aperture, c.vfov = 0.1, 20
+		})},
+	{name: "randomSceneMoving", build: randomSceneMoving,
+		opts: withOptions(func(o *options) { o.background = skyBackground }),
+		cam: withCamera(func(c *cameraSettings) {
+			c.lookFrom, c.lookAt = Point3{13, 2, 3}, Point3{0, 0, 0}
+			c.vfov = 20
+		})},
+	{name: "twoSpheres", build: twoSpheres,
+		opts: withOptions(func(o *options) { o.background = skyBackground }),
+		cam: withCamera(func(c *cameraSettings) {
+			c.lookFrom, c.lookAt = Point3{13, 2, 3}, Point3{0, 0, 0}
+			c.aperture, c.vfov = 0.1, 20
+		})},
+	{name: "twoPerlinSpheres", build: twoPerlinSpheres,
+		opts: withOptions(func(o *options) { o.background = skyBackground }),
+		cam: withCamera(func(c *cameraSettings) {
+			c.lookFrom, c.lookAt = Point3{13, 2, 3}, Point3{0, 0, 0}
+			c.vfov = 20
+		})},
+	{name: "imageTextureTest", build: imageTextureTest,
+		opts: withOptions(func(o *options) { o.background = skyBackground }),
+		cam: withCamera(func(c *cameraSettings) {
+			c.lookFrom, c.lookAt = Point3{13, 2, 3}, Point3{0, 0, 0}
+			c.vfov = 20
+		})},
+	{name: "simpleLight", build: simpleLight,
+		opts: withOptions(func(o *options) { o.samplesPerPixel = 50 }),
+		cam: withCamera(func(c *cameraSettings) {
+			c.lookFrom, c.lookAt = Point3{26, 3, 6}, Point3{0, 2, 0}
+			c.vfov = 20
+		})},
+	{name: "cornellBox", build: cornellBox,
+		//next week chapter 6.11 -> 2min
+		opts: withOptions(func(o *options) {
+			o.aspectRatio, o.imageWidth = 1.0, 600
+			o.samplesPerPixel = 2000
+		}),
+		cam: withCamera(func(c *cameraSettings) {
+			c.lookFrom, c.lookAt = Point3{278, 278, -800}, Point3{278, 278, 0}
+		})},
+	{name: "cornellSmoke", build: cornellSmoke,
+		opts: withOptions(func(o *options) {
+			o.aspectRatio, o.imageWidth = 1.0, 600
+			o.samplesPerPixel = 50
+		}),
+		cam: withCamera(func(c *cameraSettings) {
+			c.lookFrom, c.lookAt = Point3{278, 278, -800}, Point3{278, 278, 0}
+		})},
+	{name: "finalScene", build: finalScene,
+		opts: withOptions(func(o *options) {
+			o.aspectRatio, o.imageWidth = 1.0, 800
+			o.samplesPerPixel = 100
+			o.maxDepth = 3
+		}),
+		cam: withCamera(func(c *cameraSettings) {
+			c.lookFrom, c.lookAt = Point3{478, 278, -600}, Point3{278, 278, 0}
+		})},
+	{name: "threeBallScene", build: threeBallScene,
+		opts: withOptions(func(o *options) { o.background = skyBackground }),
+		cam: withCamera(func(c *cameraSettings) {
+			c.lookFrom, c.lookAt = Point3{3, 3, 2}, Point3{0, 0, -1}
+			c.vfov = 20
+		})},
+	{name: "testWideViewScene", build: testWideViewScene,
+		opts: withOptions(func(o *options) { o.background = skyBackground }),
+		cam: withCamera(func(c *cameraSettings) {
+			c.lookFrom, c.lookAt = Point3{0, 0, 0}, Point3{0, 0, -1}
+			c.vfov = 90
+		})},
+}
+
+func findScene(name string) (sceneInfo, bool) {
+	for _, s := range scenes {
+		if s.name == name {
+			return s, true
+		}
+	}
+	return sceneInfo{}, false
+}
+
+func threeBallScene(time0 float64, time1 float64, rnd sampler) hittable {
 
 	var world hittableList
 
@@ -22,10 +160,10 @@ func threeBallScene() hittable {
 	world.Add(&sphere{Point3{-1, 0, -1}, -0.4, materialLeft}) //TGlass ball
 	world.Add(&sphere{Point3{1, 0, -1}, 0.5, materialRight})
 
-	return newBvhNode(world.objects, 0.0, 1.0)
+	return newBvhNode(world.objects, time0, time1)
 }
 
-func testWideViewScene() hittable {
+func testWideViewScene(time0 float64, time1 float64, rnd sampler) hittable {
 
 	var world hittableList
 	//Test of wide view
@@ -36,10 +174,10 @@ func testWideViewScene() hittable {
 	world.Add(&sphere{Point3{-R, 0, -1}, R, materialLeft})
 	world.Add(&sphere{Point3{R, 0, -1}, R, materialRight})
 
-	return newBvhNode(world.objects, 0.0, 1.0)
+	return newBvhNode(world.objects, time0, time1)
 }
 
-func randomScene() hittable {
+func randomScene(time0 float64, time1 float64, rnd sampler) hittable {
 	var world hittableList
 
 	groundMaterial := lambertian{checkerTexture{solidColor{Color3{0.2, 0.3, 0.1}}, solidColor{Color3{0.9, 0.9, 0.9}}}}
@@ -47,20 +185,20 @@ func randomScene() hittable {
 
 	for a := -11; a < 11; a++ {
 		for b := -11; b < 11; b++ {
-			chooseMat := rand.Float64()
+			chooseMat := RandomDouble(rnd)
 
-			center := Point3{float64(a) + 0.9*rand.Float64(), 0.2, float64(b) + 0.9*rand.Float64()}
+			center := Point3{float64(a) + 0.9*RandomDouble(rnd), 0.2, float64(b) + 0.9*RandomDouble(rnd)}
 
 			if center.Sub(Point3{4, 0.2, 0}).Length() > 0.9 {
 				if chooseMat < 0.8 {
 					// diffuse
-					albedo := Color3{rand.Float64() * rand.Float64(), rand.Float64() * rand.Float64(), rand.Float64() * rand.Float64()}
+					albedo := Color3{RandomDouble(rnd) * RandomDouble(rnd), RandomDouble(rnd) * RandomDouble(rnd), RandomDouble(rnd) * RandomDouble(rnd)}
 					sphereMaterial := lambertian{solidColor{albedo}}
 					world.Add(&sphere{center, 0.2, sphereMaterial})
 				} else if chooseMat < 0.95 {
 					// metal
-					albedo := Color3{0.5 * (1 + rand.Float64()), 0.5 * (1 + rand.Float64()), 0.5 * (1 + rand.Float64())}
-					fuzz := 0.5 * rand.Float64()
+					albedo := Color3{0.5 * (1 + RandomDouble(rnd)), 0.5 * (1 + RandomDouble(rnd)), 0.5 * (1 + RandomDouble(rnd))}
+					fuzz := 0.5 * RandomDouble(rnd)
 					sphereMaterial := metal{albedo, fuzz}
 					world.Add(&sphere{center, 0.2, sphereMaterial})
 				} else {
@@ -82,11 +220,11 @@ func randomScene() hittable {
 	material3 := metal{Color3{0.7, 0.6, 0.5}, 0.0}
 	world.Add(&sphere{Point3{4, 1, 0}, 1.0, material3})
 
-	return newBvhNode(world.objects, 0.0, 1.0)
+	return newBvhNode(world.objects, time0, time1)
 
 }
 
-func randomSceneMoving() hittable {
+func randomSceneMoving(time0 float64, time1 float64, rnd sampler) hittable {
 
 	var world hittableList
 
@@ -95,21 +233,21 @@ func randomSceneMoving() hittable {
 
 	for a := -11; a < 11; a++ {
 		for b := -11; b < 11; b++ {
-			chooseMat := rand.Float64()
+			chooseMat := RandomDouble(rnd)
 
-			center := Point3{float64(a) + 0.9*rand.Float64(), 0.2, float64(b) + 0.9*rand.Float64()}
+			center := Point3{float64(a) + 0.9*RandomDouble(rnd), 0.2, float64(b) + 0.9*RandomDouble(rnd)}
 
 			if center.Sub(Point3{4, 0.2, 0}).Length() > 0.9 {
 				if chooseMat < 0.8 {
 					// diffuse
-					albedo := Color3{rand.Float64() * rand.Float64(), rand.Float64() * rand.Float64(), rand.Float64() * rand.Float64()}
-					center2 := center.Add(Vec3{0, 0.5 * rand.Float64(), 0})
+					albedo := Color3{RandomDouble(rnd) * RandomDouble(rnd), RandomDouble(rnd) * RandomDouble(rnd), RandomDouble(rnd) * RandomDouble(rnd)}
+					center2 := center.Add(Vec3{0, 0.5 * RandomDouble(rnd), 0})
 					sphereMaterial := lambertian{solidColor{albedo}}
 					world.Add(&movingSphere{center, center2, 0.0, 1.0, 0.2, sphereMaterial})
 				} else if chooseMat < 0.95 {
 					// metal
-					albedo := Color3{0.5 * (1 + rand.Float64()), 0.5 * (1 + rand.Float64()), 0.5 * (1 + rand.Float64())}
-					fuzz := 0.5 * rand.Float64()
+					albedo := Color3{0.5 * (1 + RandomDouble(rnd)), 0.5 * (1 + RandomDouble(rnd)), 0.5 * (1 + RandomDouble(rnd))}
+					fuzz := 0.5 * RandomDouble(rnd)
 					sphereMaterial := metal{albedo, fuzz}
 					world.Add(&sphere{center, 0.2, sphereMaterial})
 				} else {
@@ -131,11 +269,11 @@ func randomSceneMoving() hittable {
 	material3 := metal{Color3{0.7, 0.6, 0.5}, 0.0}
 	world.Add(&sphere{Point3{4, 1, 0}, 1.0, material3})
 
-	return newBvhNode(world.objects, 0.0, 1.0)
+	return newBvhNode(world.objects, time0, time1)
 
 }
 
-func twoSpheres() hittable {
+func twoSpheres(time0 float64, time1 float64, rnd sampler) hittable {
 	var world hittableList
 
 	checker := lambertian{checkerTexture{solidColor{Color3{0.2, 0.3, 0.1}}, solidColor{Color3{0.9, 0.9, 0.9}}}}
@@ -143,21 +281,21 @@ func twoSpheres() hittable {
 	world.Add(&sphere{Point3{0, -10, 0}, 10, checker})
 	world.Add(&sphere{Point3{0, 10, 0}, 10, checker})
 
-	return newBvhNode(world.objects, 0.0, 1.0)
+	return newBvhNode(world.objects, time0, time1)
 }
 
-func twoPerlinSpheres() hittable {
+func twoPerlinSpheres(time0 float64, time1 float64, rnd sampler) hittable {
 	var world hittableList
 
-	noise := lambertian{noiseTexture{newPerlin(), 4}}
+	noise := lambertian{noiseTexture{newPerlin(rnd), 4}}
 
 	world.Add(&sphere{Point3{0, -1000, 0}, 1000, noise})
 	world.Add(&sphere{Point3{0, 2, 0}, 2, noise})
 
-	return newBvhNode(world.objects, 0.0, 1.0)
+	return newBvhNode(world.objects, time0, time1)
 }
 
-func imageTextureTest() hittable {
+func imageTextureTest(time0 float64, time1 float64, rnd sampler) hittable {
 	var world hittableList
 
 	// imTex := lambertian{newImageTexture("unknown.png")}
@@ -165,13 +303,13 @@ func imageTextureTest() hittable {
 
 	world.Add(&sphere{Point3{0, 0, 0}, 2, imTex})
 
-	return newBvhNode(world.objects, 0.0, 1.0)
+	return newBvhNode(world.objects, time0, time1)
 }
 
-func simpleLight() hittable {
+func simpleLight(time0 float64, time1 float64, rnd sampler) hittable {
 	var world hittableList
 
-	noise := lambertian{noiseTexture{newPerlin(), 4}}
+	noise := lambertian{noiseTexture{newPerlin(rnd), 4}}
 
 	world.Add(&sphere{Point3{0, -1000, 0}, 1000, noise})
 	world.Add(&sphere{Point3{0, 2, 0}, 2, noise})
@@ -179,10 +317,10 @@ func simpleLight() hittable {
 	diffLight := diffuseLight{solidColor{Color3{4, 4, 4}}}
 	world.Add(&xyRect{diffLight, 3, 5, 1, 3, -2})
 
-	return newBvhNode(world.objects, 0.0, 1.0)
+	return newBvhNode(world.objects, time0, time1)
 }
 
-func cornellBox() hittable {
+func cornellBox(time0 float64, time1 float64, rnd sampler) hittable {
 	var world hittableList
 
 	red := lambertian{solidColor{Color3{0.65, 0.05, 0.05}}}
@@ -209,13 +347,14 @@ func cornellBox() hittable {
 	// box2 = &translate{box2, Vec3{130, 0, 65}}
 	// world.Add(box2)
 
+	// The glass sphere focuses the light, sampling it cuts down on caustic noise
 	glass := dielectric{1.5}
-	world.Add(&sphere{Point3{190, 90, 190}, 90, glass})
+	world.Add(&important{&sphere{Point3{190, 90, 190}, 90, glass}})
 
-	return newBvhNode(world.objects, 0.0, 1.0)
+	return newBvhNode(world.objects, time0, time1)
 }
 
-func cornellSmoke() hittable {
+func cornellSmoke(time0 float64, time1 float64, rnd sampler) hittable {
 	var world hittableList
 
 	red := lambertian{solidColor{Color3{0.65, 0.05, 0.05}}}
@@ -241,10 +380,10 @@ func cornellSmoke() hittable {
 	world.Add(newConstantMedium(box1, 0.01, solidColor{Color3{0, 0, 0}}))
 	// world.Add(newConstantMedium(box2, 0.01, solidColor{Color3{1, 1, 1}}))
 
-	return newBvhNode(world.objects, 0.0, 1.0)
+	return newBvhNode(world.objects, time0, time1)
 }
 
-func finalScene() hittable {
+func finalScene(time0 float64, time1 float64, rnd sampler) hittable {
 	var boxes1 hittableList
 	ground := lambertian{solidColor{Color3{0.48, 0.83, 0.53}}}
 
@@ -256,7 +395,7 @@ func finalScene() hittable {
 			z0 := -1000.0 + float64(j)*w
 			y0 := 0.0
 			x1 := x0 + w
-			y1 := 1 + 100.0*rand.Float64() //1--100
+			y1 := 1 + 100.0*RandomDouble(rnd) //1--100
 			z1 := z0 + w
 
 			boxes1.Add(newBox(Point3{x0, y0, z0}, Point3{x1, y1, z1}, ground))
@@ -264,7 +403,7 @@ func finalScene() hittable {
 	}
 
 	var objects hittableList
-	objects.Add(newBvhNode(boxes1.objects, 0, 1))
+	objects.Add(newBvhNode(boxes1.objects, time0, time1))
 
 	light := diffuseLight{solidColor{Color3{7, 7, 7}}}
 	objects.Add(&xzRect{light, 123, 423, 147, 412, 554})
@@ -285,14 +424,14 @@ func finalScene() hittable {
 
 	emat := lambertian{newImageTexture("earthmap.jpg")}
 	objects.Add(&sphere{Point3{400, 200, 400}, 100, emat})
-	pertext := noiseTexture{newPerlin(), 0.1}
+	pertext := noiseTexture{newPerlin(rnd), 0.1}
 	objects.Add(&sphere{Point3{220, 280, 300}, 80, lambertian{pertext}})
 
 	// var boxes2 hittableList
 	// white := lambertian{solidColor{Color3{0.73, 0.73, 0.73}}}
 	// ns := 20
 	// for j := 0; j < ns; j++ {
-	// 	boxes2.Add(&sphere{Point3{rand.Float64() * 165, rand.Float64() * 165, rand.Float64() * 165}, 10, white})
+	// 	boxes2.Add(&sphere{Point3{RandomDouble(rnd) * 165, RandomDouble(rnd) * 165, RandomDouble(rnd) * 165}, 10, white})
 	// }
 
 	// objects.Add(&translate{
@@ -301,5 +440,5 @@ func finalScene() hittable {
 	// 	Vec3{-100, 270, 395},
 	// })
 
-	return newBvhNode(objects.objects, 0, 1)
+	return newBvhNode(objects.objects, time0, time1)
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// loadSTL reads a binary STL file. Triangles are streamed from disk and
+// vertices shared between them are merged, so the mesh is indexed and its
+// memory grows with the number of distinct vertices.
+// STL only has face normals, so the mesh is flat shaded.
+func loadSTL(path string, mat material) (*triangleMesh, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReaderSize(f, 1<<20)
+
+	var header [84]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("%s: not a binary STL file", path)
+	}
+	count := int64(binary.LittleEndian.Uint32(header[80:]))
+
+	// ASCII files also start with "solid", the size tells them apart
+	if size := info.Size(); size != 84+50*count {
+		if string(header[:5]) == "solid" {
+			return nil, fmt.Errorf("%s: ASCII STL files are not supported", path)
+		}
+		return nil, fmt.Errorf("%s: size %d does not match %d triangles", path, size, count)
+	}
+
+	var positions []Point3
+	indices := make([]int, 0, 3*count)
+	vertexIndex := map[Point3]int{}
+
+	var record [50]byte
+	for i := int64(0); i < count; i++ {
+		if _, err := io.ReadFull(r, record[:]); err != nil {
+			return nil, fmt.Errorf("%s: triangle %d: %v", path, i, err)
+		}
+		// 12 bytes of normal, then three vertices and a 2 byte attribute
+		for v := 0; v < 3; v++ {
+			var p Point3
+			for c := 0; c < 3; c++ {
+				offset := 12 + 12*v + 4*c
+				p[c] = float64(math.Float32frombits(binary.LittleEndian.Uint32(record[offset:])))
+			}
+			idx, ok := vertexIndex[p]
+			if !ok {
+				idx = len(positions)
+				vertexIndex[p] = idx
+				positions = append(positions, p)
+			}
+			indices = append(indices, idx)
+		}
+	}
+
+	m, err := newTriangleMesh(positions, nil, nil, indices, mat)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// stlFile is a binary STL file of triangles
+func stlFile(triangles ...[3][3]float32) []byte {
+	var b bytes.Buffer
+	b.Write(make([]byte, 80))
+	binary.Write(&b, binary.LittleEndian, uint32(len(triangles)))
+	for _, tri := range triangles {
+		binary.Write(&b, binary.LittleEndian, [3]float32{0, 0, 1}) //normal
+		binary.Write(&b, binary.LittleEndian, tri)
+		binary.Write(&b, binary.LittleEndian, uint16(0)) //attribute
+	}
+	return b.Bytes()
+}
+
+func TestLoadSTL(t *testing.T) {
+	file := stlFile(
+		[3][3]float32{{0, 0, 0}, {1, 0, 0}, {1, 1, 0}},
+		[3][3]float32{{0, 0, 0}, {1, 1, 0}, {0, 1, 0}},
+	)
+	m, err := loadSTL(writeFixture(t, "quad.stl", file), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The vertices the triangles share are merged
+	if want := []Point3{{0, 0, 0}, {1, 0, 0}, {1, 1, 0}, {0, 1, 0}}; !reflect.DeepEqual(m.positions, want) {
+		t.Errorf("positions = %v, want %v", m.positions, want)
+	}
+	if want := []int{0, 1, 2, 0, 2, 3}; !reflect.DeepEqual(m.indices, want) {
+		t.Errorf("indices = %v, want %v", m.indices, want)
+	}
+	if m.normals != nil {
+		t.Errorf("normals = %v, want flat shading", m.normals)
+	}
+}
+
+func TestLoadSTLErrors(t *testing.T) {
+	triangle := [3][3]float32{{0, 0, 0}, {1, 0, 0}, {1, 1, 0}}
+	ascii := append([]byte("solid cube"), make([]byte, 100)...)
+	tests := []struct {
+		name string
+		file []byte
+		want string
+	}{
+		{"short header", make([]byte, 40), "not a binary STL file"},
+		{"ascii", ascii, "ASCII STL files are not supported"},
+		{"truncated", stlFile(triangle, triangle)[:84+50+20], "size 154 does not match 2 triangles"},
+		{"degenerate", stlFile([3][3]float32{{0, 0, 0}, {1, 0, 0}, {2, 0, 0}}), "mesh has no area"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeFixture(t, "bad.stl", test.file)
+			_, err := loadSTL(path, nil)
+			if err == nil {
+				t.Fatalf("loaded a broken file, want %q", test.want)
+			}
+			if want := path + ": " + test.want; err.Error() != want {
+				t.Errorf("error = %q, want %q", err, want)
+			}
+		})
+	}
+}
@@ -13,6 +13,19 @@ type texture interface {
 	value(u float64, v float64, p Vec3) Color3
 }
 
+// hitTexture is implemented by textures that need more of the hit than u, v and p
+type hitTexture interface {
+	hitValue(rec *hitRecord) Color3
+}
+
+// textureValue looks up t at the point of rec
+func textureValue(t texture, rec *hitRecord) Color3 {
+	if ht, ok := t.(hitTexture); ok {
+		return ht.hitValue(rec)
+	}
+	return t.value(rec.u, rec.v, rec.p)
+}
+
 type solidColor struct {
 	colorValue Color3
 }
@@ -44,6 +57,18 @@ func (s noiseTexture) value(u float64, v float64, p Vec3) Color3 {
 	return Color3{1, 1, 1}.Mult(0.5).Mult(1 + math.Sin(p.Z()*s.scale+10*s.noise.turb(p, 7)))
 }
 
+// vertexColorTexture is the color interpolated between the vertices of a mesh
+// that has per-vertex colors (e.g. a scanned PLY)
+type vertexColorTexture struct{}
+
+func (s vertexColorTexture) value(u float64, v float64, p Vec3) Color3 {
+	return Color3{0.5, 0.5, 0.5}
+}
+
+func (s vertexColorTexture) hitValue(rec *hitRecord) Color3 {
+	return rec.vertexColor
+}
+
 type imageTexture struct {
 	im            image.Image
 	width, height int
@@ -51,21 +76,29 @@ type imageTexture struct {
 }
 
 func newImageTexture(filename string) imageTexture {
-	reader, err := os.Open("textures/" + filename)
+	tex, err := loadImageTexture("textures/" + filename)
 	if err != nil {
-		fmt.Print("Could not open file: " + filename)
+		fmt.Print(err)
 		return imageTexture{nil, 0, 0, false}
 	}
+	return tex
+}
+
+// loadImageTexture reads the image at path as is, without the textures/ prefix
+func loadImageTexture(path string) (imageTexture, error) {
+	reader, err := os.Open(path)
+	if err != nil {
+		return imageTexture{}, fmt.Errorf("could not open file: %s", path)
+	}
 	defer reader.Close()
 
 	im, _, err := image.Decode(reader)
 	if err != nil {
-		fmt.Print("Error decoding image: " + filename)
-		return imageTexture{nil, 0, 0, false}
+		return imageTexture{}, fmt.Errorf("error decoding image %s: %v", path, err)
 	}
 	b := im.Bounds()
 
-	return imageTexture{im, b.Max.X, b.Max.Y, true}
+	return imageTexture{im, b.Dx(), b.Dy(), true}, nil
 }
 
 func (s imageTexture) value(u float64, v float64, p Vec3) Color3 {
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+// transform places an object in the world with any affine transform:
+// rotations about any axis, non-uniform scales, shears or a combination.
+// Rays are moved into the object's space, so composing several transforms
+// into one matrix re-transforms the rays only once.
+//
+// The object can be shared by any number of transforms (it's usually a mesh
+// or a bvh of its own), so repeating it costs one matrix per copy; a bvh over
+// these instances makes a two level acceleration structure.
+type transform struct {
+	obj           hittable
+	objectToWorld Mat4
+	worldToObject Mat4
+	normalMatrix  Mat4    //Inverse transpose of objectToWorld, for normals
+	det           float64 //Determinant of worldToObject, for pdfValue
+	box           aabb
+	hasBox        bool
+}
+
+func newTransform(obj hittable, objectToWorld Mat4) (*transform, error) {
+	worldToObject, ok := objectToWorld.Inverse()
+	if !ok {
+		return nil, errors.New("transform can't be inverted")
+	}
+
+	t := transform{
+		obj:           obj,
+		objectToWorld: objectToWorld,
+		worldToObject: worldToObject,
+		normalMatrix:  worldToObject.Transpose(),
+		det:           math.Abs(worldToObject.Det3()),
+	}
+	if box, ok := obj.boundingBox(0, 1); ok {
+		t.box, t.hasBox = transformBox(objectToWorld, box), true
+	}
+	return &t, nil
+}
+
+// transformBox bounds the 8 transformed corners of box
+func transformBox(m Mat4, box aabb) aabb {
+	var out aabb
+	for i := 0; i < 8; i++ {
+		corner := box.minimum
+		for a := 0; a < 3; a++ {
+			if i&(1<<a) != 0 {
+				corner[a] = box.maximum[a]
+			}
+		}
+		p := m.MulPoint(corner)
+		if i == 0 {
+			out = aabb{p, p}
+		} else {
+			out = surroundingBox(out, aabb{p, p})
+		}
+	}
+	return out
+}
+
+func (t *transform) hit(r *ray, tMin float64, tMax float64, rnd sampler) (*hitRecord, bool) {
+	// The direction isn't normalized, so t is the same in both spaces
+	objectRay := ray{t.worldToObject.MulPoint(r.origin), t.worldToObject.MulVector(r.direction), r.time}
+
+	rec, hit := t.obj.hit(&objectRay, tMin, tMax, rnd)
+	if !hit {
+		return nil, false
+	}
+
+	// n·d keeps its sign through the inverse transpose, so frontFace still holds
+	rec.p = t.objectToWorld.MulPoint(rec.p)
+	rec.normal = t.normalMatrix.MulVector(rec.normal).Normalize()
+
+	return rec, true
+}
+
+func (t *transform) boundingBox(time0 float64, time1 float64) (aabb, bool) {
+	return t.box, t.hasBox
+}
+
+// pdfValue converts the object's density over directions in its own space to
+// one over world directions. Directions d map to A·d/|A·d| (A being
+// worldToObject), which stretches solid angle by |det A| / |A·d|³.
+func (t *transform) pdfValue(o Point3, v Vec3) float64 {
+	objectV := t.worldToObject.MulVector(v)
+	pdf := t.obj.pdfValue(t.worldToObject.MulPoint(o), objectV)
+
+	stretch := objectV.Length() / v.Length()
+	return pdf * t.det / (stretch * stretch * stretch)
+}
+
+func (t *transform) random(o Vec3, rnd sampler) Vec3 {
+	return t.objectToWorld.MulVector(t.obj.random(t.worldToObject.MulPoint(o), rnd))
+}
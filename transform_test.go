@@ -0,0 +1,49 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// Normals of a non-uniformly scaled object are not the scaled normals: they
+// go through the inverse transpose, which keeps them perpendicular to the
+// surface. The scaled sphere is an ellipsoid whose normals are known.
+func TestTransformNormalsUnderNonUniformScale(t *testing.T) {
+	scale := Vec3{3, 1, 0.5}
+	rotation := RotateAxis4(Vec3{1, 1, 0}, 40)
+	objectToWorld := Translate4(Vec3{1, 2, 3}).Mul(rotation).Mul(Scale4(scale))
+	tr, err := newTransform(&sphere{Point3{0, 0, 0}, 1, nil}, objectToWorld)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rnd := newStream(1)
+	for i := 0; i < 100; i++ {
+		// Aim at a point of the ellipsoid from outside of it
+		objectPoint := RandomUnitVector(rnd)
+		target := objectToWorld.MulPoint(objectPoint)
+		origin := target.Add(objectToWorld.MulVector(objectPoint).Mult(2))
+		rec, hit := tr.hit(&ray{origin, target.Sub(origin), 0}, 0.001, infinity, rnd)
+		if !hit {
+			t.Fatalf("missed the ellipsoid at %v", target)
+		}
+
+		// x²/a² + y²/b² + z²/c² = 1 has the normal (x/a², y/b², z/c²), which is
+		// then rotated. Here x is a times x on the unit sphere, and so on.
+		local := Vec3{objectPoint[0] / scale[0], objectPoint[1] / scale[1], objectPoint[2] / scale[2]}
+		want := rotation.MulVector(local).Normalize()
+		if rec.normal.Dot(want) < 1-1e-9 {
+			t.Errorf("normal at %v is %v, want %v", rec.p, rec.normal, want)
+		}
+		if !rec.frontFace {
+			t.Errorf("hit the ellipsoid at %v from inside", rec.p)
+		}
+		if d := rec.p.Sub(target).Length(); d > 1e-9 {
+			t.Errorf("hit at %v, want %v", rec.p, target)
+		}
+	}
+
+	if want := 1 / (scale[0] * scale[1] * scale[2]); math.Abs(tr.det-want) > 1e-12 {
+		t.Errorf("det = %v, want %v", tr.det, want)
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"math"
-	"math/rand"
 )
 
 const infinity float64 = math.MaxFloat64
@@ -13,12 +12,12 @@ func DegToRad(deg float64) float64 {
 }
 
 //RandomDouble return a random float64 in [0.0, 1.0)
-func RandomDouble(rnd *rand.Rand) float64 {
-	return rnd.Float64()
+func RandomDouble(rnd sampler) float64 {
+	return rnd.get1D()
 }
 
 //RandomDoubleRange return random vlaue in [min, max)
-func RandomDoubleRange(min float64, max float64, rnd *rand.Rand) float64 {
+func RandomDoubleRange(min float64, max float64, rnd sampler) float64 {
 	return min + (max-min)*RandomDouble(rnd)
 }
 
@@ -33,9 +32,8 @@ func Clamp(x float64, min float64, max float64) float64 {
 	return x
 }
 
-func RandomCosineDirection(rnd *rand.Rand) Vec3 {
-	r1 := RandomDouble(rnd)
-	r2 := RandomDouble(rnd)
+func RandomCosineDirection(rnd sampler) Vec3 {
+	r1, r2 := rnd.get2D()
 	z := math.Sqrt(1 - r2)
 
 	phi := 2 * math.Pi * r1
@@ -45,9 +43,8 @@ func RandomCosineDirection(rnd *rand.Rand) Vec3 {
 	return Vec3{x, y, z}
 }
 
-func RandomToSphere(radius float64, distanceSquared float64, rnd *rand.Rand) Vec3 {
-	r1 := RandomDouble(rnd)
-	r2 := RandomDouble(rnd)
+func RandomToSphere(radius float64, distanceSquared float64, rnd sampler) Vec3 {
+	r1, r2 := rnd.get2D()
 	z := 1 + r2*(math.Sqrt(1-radius*radius/distanceSquared)-1)
 
 	phi := 2 * math.Pi * r1
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"image/color"
 	"math"
-	"math/rand"
 )
 
 // Vec3 -> X Y Z
@@ -98,33 +97,32 @@ func Lerp(start Vec3, end Vec3, t float64) Vec3 {
 }
 
 // RandomVec3 gives a vec3 with random values in  [0.0, 1.0)
-func RandomVec3(rnd *rand.Rand) Vec3 {
+func RandomVec3(rnd sampler) Vec3 {
 	return Vec3{RandomDouble(rnd), RandomDouble(rnd), RandomDouble(rnd)}
 }
 
 // RandomRangeVec3 is RandomVec3 but with range [min, max)
-func RandomRangeVec3(min float64, max float64, rnd *rand.Rand) Vec3 {
+func RandomRangeVec3(min float64, max float64, rnd sampler) Vec3 {
 	return Vec3{RandomDoubleRange(min, max, rnd), RandomDoubleRange(min, max, rnd), RandomDoubleRange(min, max, rnd)}
 }
 
 // RandomInUnitSphere is a random vec3 with length inferior to 1
-func RandomInUnitSphere(rnd *rand.Rand) Vec3 {
-	for {
-		p := RandomRangeVec3(-1, 1, rnd)
-		if p.LengthSquared() >= 1 {
-			continue
-		}
-		return p
-	}
+func RandomInUnitSphere(rnd sampler) Vec3 {
+	// Uniform in volume: the radius goes with the cube root
+	return RandomUnitVector(rnd).Mult(math.Cbrt(RandomDouble(rnd)))
 }
 
-// RandomUnitVector is RandomInUnitSphere but normalized
-func RandomUnitVector(rnd *rand.Rand) Vec3 {
-	return RandomInUnitSphere(rnd).Normalize()
+// RandomUnitVector is a random direction, uniform over the unit sphere
+func RandomUnitVector(rnd sampler) Vec3 {
+	u1, u2 := rnd.get2D()
+	z := 1 - 2*u1
+	r := math.Sqrt(math.Max(0, 1-z*z))
+	phi := 2 * math.Pi * u2
+	return Vec3{r * math.Cos(phi), r * math.Sin(phi), z}
 }
 
 // RandomInHemisphere not sure
-func RandomInHemisphere(normal Vec3, rnd *rand.Rand) Vec3 {
+func RandomInHemisphere(normal Vec3, rnd sampler) Vec3 {
 	inUnitSphere := RandomInUnitSphere(rnd)
 
 	if inUnitSphere.Dot(normal) > 0.0 {
@@ -135,14 +133,21 @@ func RandomInHemisphere(normal Vec3, rnd *rand.Rand) Vec3 {
 }
 
 // RandomInUnitDisk is a random vec3 in a circunference with z = 0 and length < 1
-func RandomInUnitDisk(rnd *rand.Rand) Vec3 {
-	for {
-		p := Vec3{RandomDoubleRange(-1, 1, rnd), RandomDoubleRange(-1, 1, rnd), 0}
-		if p.LengthSquared() >= 1 {
-			continue
-		}
-		return p
+func RandomInUnitDisk(rnd sampler) Vec3 {
+	// Shirley's concentric mapping of the square onto the disk, which keeps
+	// samples that were spread out in the square spread out on the disk
+	u1, u2 := rnd.get2D()
+	a, b := 2*u1-1, 2*u2-1
+	if a == 0 && b == 0 {
+		return Vec3{0, 0, 0}
+	}
+	var r, theta float64
+	if math.Abs(a) > math.Abs(b) {
+		r, theta = a, math.Pi/4*(b/a)
+	} else {
+		r, theta = b, math.Pi/2-math.Pi/4*(a/b)
 	}
+	return Vec3{r * math.Cos(theta), r * math.Sin(theta), 0}
 }
 
 // NearZero checks if all values of a vec3 are close to zero
@@ -217,3 +222,216 @@ func RGBAToColor3(c color.Color) Color3 {
 	// 	uint8(256.0 * Clamp(b, 0.0, 0.999)),
 	// 	0xff}
 }
+
+// Mat4 is a 4x4 matrix in row major order, used for affine transforms of
+// points (w = 1) and vectors (w = 0)
+type Mat4 [4][4]float64
+
+// Identity4 is the identity matrix
+func Identity4() Mat4 {
+	return Mat4{{1, 0, 0, 0}, {0, 1, 0, 0}, {0, 0, 1, 0}, {0, 0, 0, 1}}
+}
+
+// Translate4 moves points by offset
+func Translate4(offset Vec3) Mat4 {
+	m := Identity4()
+	m[0][3], m[1][3], m[2][3] = offset[0], offset[1], offset[2]
+	return m
+}
+
+// Scale4 scales each axis by the matching component of s
+func Scale4(s Vec3) Mat4 {
+	m := Identity4()
+	m[0][0], m[1][1], m[2][2] = s[0], s[1], s[2]
+	return m
+}
+
+// RotateX4 rotates by angle degrees around the x axis
+func RotateX4(angle float64) Mat4 {
+	return RotateAxis4(Vec3{1, 0, 0}, angle)
+}
+
+// RotateY4 rotates by angle degrees around the y axis, like rotateY
+func RotateY4(angle float64) Mat4 {
+	return RotateAxis4(Vec3{0, 1, 0}, angle)
+}
+
+// RotateZ4 rotates by angle degrees around the z axis
+func RotateZ4(angle float64) Mat4 {
+	return RotateAxis4(Vec3{0, 0, 1}, angle)
+}
+
+// RotateAxis4 rotates by angle degrees around axis, counter-clockwise when
+// looking down the axis towards the origin
+func RotateAxis4(axis Vec3, angle float64) Mat4 {
+	a := axis.Normalize()
+	sin, cos := math.Sin(DegToRad(angle)), math.Cos(DegToRad(angle))
+	k := 1 - cos
+
+	m := Identity4()
+	m[0][0] = cos + a[0]*a[0]*k
+	m[0][1] = a[0]*a[1]*k - a[2]*sin
+	m[0][2] = a[0]*a[2]*k + a[1]*sin
+	m[1][0] = a[1]*a[0]*k + a[2]*sin
+	m[1][1] = cos + a[1]*a[1]*k
+	m[1][2] = a[1]*a[2]*k - a[0]*sin
+	m[2][0] = a[2]*a[0]*k - a[1]*sin
+	m[2][1] = a[2]*a[1]*k + a[0]*sin
+	m[2][2] = cos + a[2]*a[2]*k
+	return m
+}
+
+// Mul is m * m2, the transform that applies m2 first and then m
+func (m Mat4) Mul(m2 Mat4) Mat4 {
+	var r Mat4
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			for k := 0; k < 4; k++ {
+				r[i][j] += m[i][k] * m2[k][j]
+			}
+		}
+	}
+	return r
+}
+
+// Transpose of m
+func (m Mat4) Transpose() Mat4 {
+	var r Mat4
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			r[i][j] = m[j][i]
+		}
+	}
+	return r
+}
+
+// Det3 is the determinant of the upper 3x3 of m, how much it scales volumes
+func (m Mat4) Det3() float64 {
+	return m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) +
+		m[0][1]*(m[1][2]*m[2][0]-m[1][0]*m[2][2]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+}
+
+// Inverse of an affine m (the last row is 0 0 0 1). ok is false when m
+// flattens space and can't be inverted.
+func (m Mat4) Inverse() (inv Mat4, ok bool) {
+	// Inverse of the upper 3x3 through its cofactors
+	c00 := m[1][1]*m[2][2] - m[1][2]*m[2][1]
+	c01 := m[1][2]*m[2][0] - m[1][0]*m[2][2]
+	c02 := m[1][0]*m[2][1] - m[1][1]*m[2][0]
+	det := m.Det3()
+	if math.Abs(det) < 1e-12 {
+		return inv, false
+	}
+	invDet := 1 / det
+
+	inv[0][0] = c00 * invDet
+	inv[0][1] = (m[0][2]*m[2][1] - m[0][1]*m[2][2]) * invDet
+	inv[0][2] = (m[0][1]*m[1][2] - m[0][2]*m[1][1]) * invDet
+	inv[1][0] = c01 * invDet
+	inv[1][1] = (m[0][0]*m[2][2] - m[0][2]*m[2][0]) * invDet
+	inv[1][2] = (m[0][2]*m[1][0] - m[0][0]*m[1][2]) * invDet
+	inv[2][0] = c02 * invDet
+	inv[2][1] = (m[0][1]*m[2][0] - m[0][0]*m[2][1]) * invDet
+	inv[2][2] = (m[0][0]*m[1][1] - m[0][1]*m[1][0]) * invDet
+
+	// The translation is undone after the rest
+	t := inv.MulVector(Vec3{m[0][3], m[1][3], m[2][3]})
+	inv[0][3], inv[1][3], inv[2][3] = -t[0], -t[1], -t[2]
+	inv[3][3] = 1
+	return inv, true
+}
+
+// MulPoint transforms the point p
+func (m Mat4) MulPoint(p Point3) Point3 {
+	return Point3{
+		m[0][0]*p[0] + m[0][1]*p[1] + m[0][2]*p[2] + m[0][3],
+		m[1][0]*p[0] + m[1][1]*p[1] + m[1][2]*p[2] + m[1][3],
+		m[2][0]*p[0] + m[2][1]*p[1] + m[2][2]*p[2] + m[2][3],
+	}
+}
+
+// MulVector transforms the direction v, ignoring the translation
+func (m Mat4) MulVector(v Vec3) Vec3 {
+	return Vec3{
+		m[0][0]*v[0] + m[0][1]*v[1] + m[0][2]*v[2],
+		m[1][0]*v[0] + m[1][1]*v[1] + m[1][2]*v[2],
+		m[2][0]*v[0] + m[2][1]*v[1] + m[2][2]*v[2],
+	}
+}
+
+// Quat is a rotation quaternion: x, y, z, w
+type Quat [4]float64
+
+// QuatAxisAngle rotates by angle degrees around axis, like RotateAxis4
+func QuatAxisAngle(axis Vec3, angle float64) Quat {
+	a := axis.Normalize()
+	half := DegToRad(angle) / 2
+	sin := math.Sin(half)
+	return Quat{a[0] * sin, a[1] * sin, a[2] * sin, math.Cos(half)}
+}
+
+// Dot product of q and q2, the cosine of half the angle between them
+func (q Quat) Dot(q2 Quat) float64 {
+	return q[0]*q2[0] + q[1]*q2[1] + q[2]*q2[2] + q[3]*q2[3]
+}
+
+// Normalize q
+func (q Quat) Normalize() Quat {
+	l := math.Sqrt(q.Dot(q))
+	return Quat{q[0] / l, q[1] / l, q[2] / l, q[3] / l}
+}
+
+// Conjugate is the opposite rotation of a unit q
+func (q Quat) Conjugate() Quat {
+	return Quat{-q[0], -q[1], -q[2], q[3]}
+}
+
+// Rotate applies the rotation q to v
+func (q Quat) Rotate(v Vec3) Vec3 {
+	// v + 2w(u x v) + 2u x (u x v), u being the vector part
+	u := Vec3{q[0], q[1], q[2]}
+	t := u.Cross(v).Mult(2)
+	return v.Add(t.Mult(q[3])).Add(u.Cross(t))
+}
+
+// Mat4 is the rotation q as a matrix
+func (q Quat) Mat4() Mat4 {
+	x, y, z, w := q[0], q[1], q[2], q[3]
+	return Mat4{
+		{1 - 2*(y*y+z*z), 2 * (x*y - z*w), 2 * (x*z + y*w), 0},
+		{2 * (x*y + z*w), 1 - 2*(x*x+z*z), 2 * (y*z - x*w), 0},
+		{2 * (x*z - y*w), 2 * (y*z + x*w), 1 - 2*(x*x+y*y), 0},
+		{0, 0, 0, 1},
+	}
+}
+
+// Slerp interpolates between the rotations q1 and q2 at a constant angular
+// speed, the short way around
+func Slerp(q1 Quat, q2 Quat, t float64) Quat {
+	cos := q1.Dot(q2)
+	if cos < 0 {
+		q2 = Quat{-q2[0], -q2[1], -q2[2], -q2[3]}
+		cos = -cos
+	}
+	if cos > 0.9995 {
+		// Nearly the same rotation, a linear blend is accurate and stable
+		return Quat{
+			q1[0] + t*(q2[0]-q1[0]), q1[1] + t*(q2[1]-q1[1]),
+			q1[2] + t*(q2[2]-q1[2]), q1[3] + t*(q2[3]-q1[3]),
+		}.Normalize()
+	}
+
+	theta := math.Acos(cos)
+	s1 := math.Sin((1-t)*theta) / math.Sin(theta)
+	s2 := math.Sin(t*theta) / math.Sin(theta)
+	return Quat{
+		s1*q1[0] + s2*q2[0], s1*q1[1] + s2*q2[1],
+		s1*q1[2] + s2*q2[2], s1*q1[3] + s2*q2[3],
+	}
+}
+
+// Angle between the rotations q1 and q2 in radians
+func (q Quat) Angle(q2 Quat) float64 {
+	return 2 * math.Acos(Clamp(math.Abs(q.Dot(q2)), 0, 1))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func mat4Near(a Mat4, b Mat4, tolerance float64) bool {
+	for i := range a {
+		for j := range a[i] {
+			if math.Abs(a[i][j]-b[i][j]) > tolerance {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// shear4 moves x along with y and z
+func shear4(xy float64, xz float64) Mat4 {
+	m := Identity4()
+	m[0][1], m[0][2] = xy, xz
+	return m
+}
+
+func TestMat4InverseAndDet3(t *testing.T) {
+	tests := []struct {
+		name string
+		m    Mat4
+		det  float64
+	}{
+		{"identity", Identity4(), 1},
+		{"translation", Translate4(Vec3{1, -2, 3}), 1},
+		{"non-uniform scale", Scale4(Vec3{2, 0.5, 3}), 3},
+		{"mirror", Scale4(Vec3{-1, 1, 1}), -1},
+		{"rotation", RotateAxis4(Vec3{1, 2, 3}, 37), 1},
+		{"shear", shear4(0.5, -1.5), 1},
+		{"everything", Translate4(Vec3{1, 2, 3}).Mul(RotateAxis4(Vec3{-1, 1, 2}, 110)).Mul(Scale4(Vec3{4, 0.25, 2})).Mul(shear4(0.3, 0.7)), 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if det := test.m.Det3(); math.Abs(det-test.det) > 1e-12 {
+				t.Errorf("Det3 = %v, want %v", det, test.det)
+			}
+			inv, ok := test.m.Inverse()
+			if !ok {
+				t.Fatal("Inverse failed")
+			}
+			if !mat4Near(test.m.Mul(inv), Identity4(), 1e-12) || !mat4Near(inv.Mul(test.m), Identity4(), 1e-12) {
+				t.Errorf("m times its inverse %v is not the identity", inv)
+			}
+			if det := inv.Det3(); math.Abs(det*test.det-1) > 1e-12 {
+				t.Errorf("inverse Det3 = %v, want %v", det, 1/test.det)
+			}
+		})
+	}
+}
+
+func TestMat4InverseOfFlatMatrix(t *testing.T) {
+	for _, m := range []Mat4{Scale4(Vec3{1, 0, 1}), Translate4(Vec3{1, 2, 3}).Mul(Scale4(Vec3{0, 0, 0})), shear4(1, 0).Mul(Scale4(Vec3{1, 1, 0}))} {
+		if inv, ok := m.Inverse(); ok {
+			t.Errorf("inverted %v into %v", m, inv)
+		}
+	}
+}
+
+func TestSlerp(t *testing.T) {
+	tests := []struct {
+		name   string
+		q1, q2 Quat
+	}{
+		{"quarter turn", QuatAxisAngle(Vec3{0, 1, 0}, 0), QuatAxisAngle(Vec3{0, 1, 0}, 90)},
+		{"different axes", QuatAxisAngle(Vec3{1, 2, 3}, 30), QuatAxisAngle(Vec3{-2, 1, 0}, 150)},
+		// q1·q2 < 0: 170 and -170 degrees are 20 apart the short way
+		{"the long way", QuatAxisAngle(Vec3{0, 0, 1}, 170), QuatAxisAngle(Vec3{0, 0, 1}, -170)},
+		{"same rotation negated", QuatAxisAngle(Vec3{1, 1, 0}, 60), QuatAxisAngle(Vec3{1, 1, 0}, 60+360)},
+		{"nearly parallel", QuatAxisAngle(Vec3{0, 1, 0}, 45), QuatAxisAngle(Vec3{0, 1, 0}, 45.01)},
+		{"parallel", QuatAxisAngle(Vec3{0, 1, 0}, 45), QuatAxisAngle(Vec3{0, 1, 0}, 45)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Angle doesn't tell q from -q, which are the same rotation
+			if a := Slerp(test.q1, test.q2, 0).Angle(test.q1); a > 1e-7 {
+				t.Errorf("at 0 it is %v from q1", a)
+			}
+			if a := Slerp(test.q1, test.q2, 1).Angle(test.q2); a > 1e-7 {
+				t.Errorf("at 1 it is %v from q2", a)
+			}
+
+			// It turns at a constant speed, the short way, so at t it is t
+			// of the angle between them from q1 and 1-t from q2
+			angle := test.q1.Angle(test.q2)
+			for _, s := range []float64{0.1, 0.25, 0.5, 0.9} {
+				q := Slerp(test.q1, test.q2, s)
+				if l := q.Dot(q); math.Abs(l-1) > 1e-12 {
+					t.Errorf("at %v it has length² %v", s, l)
+				}
+				if a := q.Angle(test.q1); math.Abs(a-s*angle) > 1e-7 {
+					t.Errorf("at %v it is %v from q1, want %v", s, a, s*angle)
+				}
+				if a := q.Angle(test.q2); math.Abs(a-(1-s)*angle) > 1e-7 {
+					t.Errorf("at %v it is %v from q2, want %v", s, a, (1-s)*angle)
+				}
+			}
+		})
+	}
+}